@@ -1,7 +1,60 @@
+-- Every notification carries a "version": the WAL insert position at the time
+-- of the change. Changes to the same row are serialised by its row lock, so the
+-- version grows with every change to a row and the consumer uses it as the
+-- Elasticsearch external version to reject out-of-order writes.
+--
+-- Every notification also carries the "txid" of its transaction. When the
+-- transaction commits, a deferred constraint trigger sends one COMMIT marker
+-- with the txid and the number of changes it made, so the consumer can apply
+-- the whole transaction at once. Notifications are only delivered on commit,
+-- so rolled-back transactions send nothing.
+
+--
+-- UPDATE notifications also carry "old": the previous values of the columns
+-- the update changed, so the consumer can skip updates that change no column
+-- it indexes. Unchanged columns are left out to keep the notification under
+-- the 8000-byte NOTIFY limit, and updates that change nothing send nothing.
+
+-- Sends one change notification and counts it towards the transaction's
+-- COMMIT marker. old is the previous row image on updates and NULL otherwise.
+DROP FUNCTION IF EXISTS pgsync_notify(text, text, json);
+CREATE OR REPLACE FUNCTION pgsync_notify(operation text, table_name text, data json, old json) RETURNS void AS $$
+DECLARE
+    changes int := coalesce(nullif(current_setting('pgsync.tx_changes', true), ''), '0')::int + 1;
+    changed jsonb;
+BEGIN
+    IF old IS NOT NULL THEN
+        SELECT coalesce(jsonb_object_agg(o.key, o.value), '{}'::jsonb) INTO changed
+        FROM jsonb_each(old::jsonb) o
+        WHERE (data::jsonb) -> o.key IS DISTINCT FROM o.value;
+        IF changed = '{}'::jsonb THEN
+            RETURN;
+        END IF;
+    END IF;
+    PERFORM set_config('pgsync.tx_changes', changes::text, true);
+    PERFORM pg_notify('crud_operations', json_build_object('operation', operation, 'table', table_name, 'version', (pg_current_wal_insert_lsn() - '0/0'::pg_lsn)::bigint, 'txid', txid_current(), 'data', data, 'old', changed)::text);
+END;
+$$ LANGUAGE plpgsql;
+
+-- Sends the COMMIT marker. Deferred triggers run at commit, after every row
+-- trigger of the transaction, and the counter is reset so that only the first
+-- of them sends a marker.
+CREATE OR REPLACE FUNCTION pgsync_notify_commit() RETURNS TRIGGER AS $$
+DECLARE
+    changes int := coalesce(nullif(current_setting('pgsync.tx_changes', true), ''), '0')::int;
+BEGIN
+    IF changes > 0 THEN
+        PERFORM set_config('pgsync.tx_changes', '0', true);
+        PERFORM pg_notify('crud_operations', json_build_object('operation', 'COMMIT', 'txid', txid_current(), 'count', changes)::text);
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
 -- Trigger function for INSERT operation
 CREATE OR REPLACE FUNCTION notify_insert_users() RETURNS TRIGGER AS $$
 BEGIN
-    PERFORM pg_notify('crud_operations', json_build_object('operation', 'INSERT', 'table', TG_TABLE_NAME, 'data', row_to_json(NEW))::text);
+    PERFORM pgsync_notify('INSERT', TG_TABLE_NAME, row_to_json(NEW), NULL);
     RETURN NEW;
 END;
 $$ LANGUAGE plpgsql;
@@ -9,7 +62,7 @@ $$ LANGUAGE plpgsql;
 -- Trigger function for UPDATE operation
 CREATE OR REPLACE FUNCTION notify_update_users() RETURNS TRIGGER AS $$
 BEGIN
-    PERFORM pg_notify('crud_operations', json_build_object('operation', 'UPDATE', 'table', TG_TABLE_NAME, 'data', row_to_json(NEW))::text);
+    PERFORM pgsync_notify('UPDATE', TG_TABLE_NAME, row_to_json(NEW), row_to_json(OLD));
     RETURN NEW;
 END;
 $$ LANGUAGE plpgsql;
@@ -17,7 +70,7 @@ $$ LANGUAGE plpgsql;
 -- Trigger function for DELETE operation
 CREATE OR REPLACE FUNCTION notify_delete_users() RETURNS TRIGGER AS $$
 BEGIN
-    PERFORM pg_notify('crud_operations', json_build_object('operation', 'DELETE', 'table', TG_TABLE_NAME, 'data', row_to_json(OLD))::text);
+    PERFORM pgsync_notify('DELETE', TG_TABLE_NAME, row_to_json(OLD), NULL);
     RETURN OLD;
 END;
 $$ LANGUAGE plpgsql;
@@ -26,6 +79,7 @@ $$ LANGUAGE plpgsql;
 DROP TRIGGER IF EXISTS users_notify_insert ON public.users;
 DROP TRIGGER IF EXISTS users_notify_update ON public.users;
 DROP TRIGGER IF EXISTS users_notify_delete ON public.users;
+DROP TRIGGER IF EXISTS users_notify_commit ON public.users;
 
 -- Trigger for INSERT
 CREATE TRIGGER users_notify_insert
@@ -42,11 +96,17 @@ CREATE TRIGGER users_notify_delete
 AFTER DELETE ON public.users
 FOR EACH ROW EXECUTE FUNCTION notify_delete_users();
 
+-- COMMIT marker, sent once per transaction
+CREATE CONSTRAINT TRIGGER users_notify_commit
+AFTER INSERT OR UPDATE OR DELETE ON public.users
+DEFERRABLE INITIALLY DEFERRED
+FOR EACH ROW EXECUTE FUNCTION pgsync_notify_commit();
+
 
 -- Trigger function for INSERT operation
 CREATE OR REPLACE FUNCTION notify_insert_hashtags() RETURNS TRIGGER AS $$
 BEGIN
-    PERFORM pg_notify('crud_operations', json_build_object('operation', 'INSERT', 'table', TG_TABLE_NAME, 'data', row_to_json(NEW))::text);
+    PERFORM pgsync_notify('INSERT', TG_TABLE_NAME, row_to_json(NEW), NULL);
     RETURN NEW;
 END;
 $$ LANGUAGE plpgsql;
@@ -54,7 +114,7 @@ $$ LANGUAGE plpgsql;
 -- Trigger function for UPDATE operation
 CREATE OR REPLACE FUNCTION notify_update_hashtags() RETURNS TRIGGER AS $$
 BEGIN
-    PERFORM pg_notify('crud_operations', json_build_object('operation', 'UPDATE', 'table', TG_TABLE_NAME, 'data', row_to_json(NEW))::text);
+    PERFORM pgsync_notify('UPDATE', TG_TABLE_NAME, row_to_json(NEW), row_to_json(OLD));
     RETURN NEW;
 END;
 $$ LANGUAGE plpgsql;
@@ -62,7 +122,7 @@ $$ LANGUAGE plpgsql;
 -- Trigger function for DELETE operation
 CREATE OR REPLACE FUNCTION notify_delete_hashtags() RETURNS TRIGGER AS $$
 BEGIN
-    PERFORM pg_notify('crud_operations', json_build_object('operation', 'DELETE', 'table', TG_TABLE_NAME, 'data', row_to_json(OLD))::text);
+    PERFORM pgsync_notify('DELETE', TG_TABLE_NAME, row_to_json(OLD), NULL);
     RETURN OLD;
 END;
 $$ LANGUAGE plpgsql;
@@ -71,6 +131,7 @@ $$ LANGUAGE plpgsql;
 DROP TRIGGER IF EXISTS hashtags_notify_insert ON public.hashtags;
 DROP TRIGGER IF EXISTS hashtags_notify_update ON public.hashtags;
 DROP TRIGGER IF EXISTS hashtags_notify_delete ON public.hashtags;
+DROP TRIGGER IF EXISTS hashtags_notify_commit ON public.hashtags;
 
 -- Trigger for INSERT
 CREATE TRIGGER hashtags_notify_insert
@@ -87,11 +148,17 @@ CREATE TRIGGER hashtags_notify_delete
 AFTER DELETE ON public.hashtags
 FOR EACH ROW EXECUTE FUNCTION notify_delete_hashtags();
 
+-- COMMIT marker, sent once per transaction
+CREATE CONSTRAINT TRIGGER hashtags_notify_commit
+AFTER INSERT OR UPDATE OR DELETE ON public.hashtags
+DEFERRABLE INITIALLY DEFERRED
+FOR EACH ROW EXECUTE FUNCTION pgsync_notify_commit();
+
 
 -- Trigger function for INSERT operation
 CREATE OR REPLACE FUNCTION notify_insert_projects() RETURNS TRIGGER AS $$
 BEGIN
-    PERFORM pg_notify('crud_operations', json_build_object('operation', 'INSERT', 'table', TG_TABLE_NAME, 'data', row_to_json(NEW))::text);
+    PERFORM pgsync_notify('INSERT', TG_TABLE_NAME, row_to_json(NEW), NULL);
     RETURN NEW;
 END;
 $$ LANGUAGE plpgsql;
@@ -99,7 +166,7 @@ $$ LANGUAGE plpgsql;
 -- Trigger function for UPDATE operation
 CREATE OR REPLACE FUNCTION notify_update_projects() RETURNS TRIGGER AS $$
 BEGIN
-    PERFORM pg_notify('crud_operations', json_build_object('operation', 'UPDATE', 'table', TG_TABLE_NAME, 'data', row_to_json(NEW))::text);
+    PERFORM pgsync_notify('UPDATE', TG_TABLE_NAME, row_to_json(NEW), row_to_json(OLD));
     RETURN NEW;
 END;
 $$ LANGUAGE plpgsql;
@@ -107,7 +174,7 @@ $$ LANGUAGE plpgsql;
 -- Trigger function for DELETE operation
 CREATE OR REPLACE FUNCTION notify_delete_projects() RETURNS TRIGGER AS $$
 BEGIN
-    PERFORM pg_notify('crud_operations', json_build_object('operation', 'DELETE', 'table', TG_TABLE_NAME, 'data', row_to_json(OLD))::text);
+    PERFORM pgsync_notify('DELETE', TG_TABLE_NAME, row_to_json(OLD), NULL);
     RETURN OLD;
 END;
 $$ LANGUAGE plpgsql;
@@ -116,6 +183,7 @@ $$ LANGUAGE plpgsql;
 DROP TRIGGER IF EXISTS projects_notify_insert ON public.projects;
 DROP TRIGGER IF EXISTS projects_notify_update ON public.projects;
 DROP TRIGGER IF EXISTS projects_notify_delete ON public.projects;
+DROP TRIGGER IF EXISTS projects_notify_commit ON public.projects;
 
 -- Trigger for INSERT
 CREATE TRIGGER projects_notify_insert
@@ -132,11 +200,17 @@ CREATE TRIGGER projects_notify_delete
 AFTER DELETE ON public.projects
 FOR EACH ROW EXECUTE FUNCTION notify_delete_projects();
 
+-- COMMIT marker, sent once per transaction
+CREATE CONSTRAINT TRIGGER projects_notify_commit
+AFTER INSERT OR UPDATE OR DELETE ON public.projects
+DEFERRABLE INITIALLY DEFERRED
+FOR EACH ROW EXECUTE FUNCTION pgsync_notify_commit();
+
 
 -- Trigger function for INSERT operation
 CREATE OR REPLACE FUNCTION notify_insert_user_projects() RETURNS TRIGGER AS $$
 BEGIN
-    PERFORM pg_notify('crud_operations', json_build_object('operation', 'INSERT', 'table', TG_TABLE_NAME, 'data', row_to_json(NEW))::text);
+    PERFORM pgsync_notify('INSERT', TG_TABLE_NAME, row_to_json(NEW), NULL);
     RETURN NEW;
 END;
 $$ LANGUAGE plpgsql;
@@ -144,7 +218,7 @@ $$ LANGUAGE plpgsql;
 -- Trigger function for UPDATE operation
 CREATE OR REPLACE FUNCTION notify_update_user_projects() RETURNS TRIGGER AS $$
 BEGIN
-    PERFORM pg_notify('crud_operations', json_build_object('operation', 'UPDATE', 'table', TG_TABLE_NAME, 'data', row_to_json(NEW))::text);
+    PERFORM pgsync_notify('UPDATE', TG_TABLE_NAME, row_to_json(NEW), row_to_json(OLD));
     RETURN NEW;
 END;
 $$ LANGUAGE plpgsql;
@@ -152,7 +226,7 @@ $$ LANGUAGE plpgsql;
 -- Trigger function for DELETE operation
 CREATE OR REPLACE FUNCTION notify_delete_user_projects() RETURNS TRIGGER AS $$
 BEGIN
-    PERFORM pg_notify('crud_operations', json_build_object('operation', 'DELETE', 'table', TG_TABLE_NAME, 'data', row_to_json(OLD))::text);
+    PERFORM pgsync_notify('DELETE', TG_TABLE_NAME, row_to_json(OLD), NULL);
     RETURN OLD;
 END;
 $$ LANGUAGE plpgsql;
@@ -161,6 +235,7 @@ $$ LANGUAGE plpgsql;
 DROP TRIGGER IF EXISTS user_projects_notify_insert ON public.user_projects;
 DROP TRIGGER IF EXISTS user_projects_notify_update ON public.user_projects;
 DROP TRIGGER IF EXISTS user_projects_notify_delete ON public.user_projects;
+DROP TRIGGER IF EXISTS user_projects_notify_commit ON public.user_projects;
 
 -- Trigger for INSERT
 CREATE TRIGGER user_projects_notify_insert
@@ -177,11 +252,17 @@ CREATE TRIGGER user_projects_notify_delete
 AFTER DELETE ON public.user_projects
 FOR EACH ROW EXECUTE FUNCTION notify_delete_user_projects();
 
+-- COMMIT marker, sent once per transaction
+CREATE CONSTRAINT TRIGGER user_projects_notify_commit
+AFTER INSERT OR UPDATE OR DELETE ON public.user_projects
+DEFERRABLE INITIALLY DEFERRED
+FOR EACH ROW EXECUTE FUNCTION pgsync_notify_commit();
+
 
 -- Trigger function for INSERT operation
 CREATE OR REPLACE FUNCTION notify_insert_project_hashtags() RETURNS TRIGGER AS $$
 BEGIN
-    PERFORM pg_notify('crud_operations', json_build_object('operation', 'INSERT', 'table', TG_TABLE_NAME, 'data', row_to_json(NEW))::text);
+    PERFORM pgsync_notify('INSERT', TG_TABLE_NAME, row_to_json(NEW), NULL);
     RETURN NEW;
 END;
 $$ LANGUAGE plpgsql;
@@ -189,7 +270,7 @@ $$ LANGUAGE plpgsql;
 -- Trigger function for UPDATE operation
 CREATE OR REPLACE FUNCTION notify_update_project_hashtags() RETURNS TRIGGER AS $$
 BEGIN
-    PERFORM pg_notify('crud_operations', json_build_object('operation', 'UPDATE', 'table', TG_TABLE_NAME, 'data', row_to_json(NEW))::text);
+    PERFORM pgsync_notify('UPDATE', TG_TABLE_NAME, row_to_json(NEW), row_to_json(OLD));
     RETURN NEW;
 END;
 $$ LANGUAGE plpgsql;
@@ -197,7 +278,7 @@ $$ LANGUAGE plpgsql;
 -- Trigger function for DELETE operation
 CREATE OR REPLACE FUNCTION notify_delete_project_hashtags() RETURNS TRIGGER AS $$
 BEGIN
-    PERFORM pg_notify('crud_operations', json_build_object('operation', 'DELETE', 'table', TG_TABLE_NAME, 'data', row_to_json(OLD))::text);
+    PERFORM pgsync_notify('DELETE', TG_TABLE_NAME, row_to_json(OLD), NULL);
     RETURN OLD;
 END;
 $$ LANGUAGE plpgsql;
@@ -206,6 +287,7 @@ $$ LANGUAGE plpgsql;
 DROP TRIGGER IF EXISTS project_hashtags_notify_insert ON public.project_hashtags;
 DROP TRIGGER IF EXISTS project_hashtags_notify_update ON public.project_hashtags;
 DROP TRIGGER IF EXISTS project_hashtags_notify_delete ON public.project_hashtags;
+DROP TRIGGER IF EXISTS project_hashtags_notify_commit ON public.project_hashtags;
 
 -- Trigger for INSERT
 CREATE TRIGGER project_hashtags_notify_insert
@@ -222,3 +304,9 @@ CREATE TRIGGER project_hashtags_notify_delete
 AFTER DELETE ON public.project_hashtags
 FOR EACH ROW EXECUTE FUNCTION notify_delete_project_hashtags();
 
+-- COMMIT marker, sent once per transaction
+CREATE CONSTRAINT TRIGGER project_hashtags_notify_commit
+AFTER INSERT OR UPDATE OR DELETE ON public.project_hashtags
+DEFERRABLE INITIALLY DEFERRED
+FOR EACH ROW EXECUTE FUNCTION pgsync_notify_commit();
+
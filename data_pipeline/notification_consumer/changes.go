@@ -0,0 +1,62 @@
+package main
+
+import "reflect"
+
+// watchColumns records, per source table, the columns whose changes can
+// affect an index: indexed columns and their new names, primary keys, link
+// columns and soft-delete columns.
+func (s *Schema) watchColumns() {
+	s.watchedColumns = make(map[string]map[string]bool)
+	watch := func(table string, columns ...string) {
+		if s.watchedColumns[table] == nil {
+			s.watchedColumns[table] = make(map[string]bool)
+		}
+		for _, column := range columns {
+			s.watchedColumns[table][column] = true
+		}
+	}
+	for _, table := range s.Tables {
+		for column := range table.declaredColumns() {
+			watch(table.Name, column)
+		}
+	}
+	for _, relationship := range s.Relationships {
+		watch(relationship.Table, relationship.Left.Column, relationship.Right.Column)
+		if relationship.SoftDelete != nil {
+			watch(relationship.Table, relationship.SoftDelete.Column)
+		}
+	}
+}
+
+// isNoopUpdate reports whether an update changed none of the columns the
+// schema watches on its table, so that it cannot change any document.
+// Updates without the old row image, from triggers installed before it was
+// sent, are never no-ops. On tables that index added columns, a change to
+// any undeclared column counts too.
+func isNoopUpdate(notification Notification, schema *Schema) bool {
+	if notification.Operation != OperationUpdate || notification.Old == nil {
+		return false
+	}
+	for column := range schema.watchedColumns[notification.Table] {
+		if columnChanged(notification, column) {
+			return false
+		}
+	}
+	if table, ok := schema.Table(notification.Table); ok && table.Evolution.Added == EvolutionAdd {
+		for column := range notification.Data {
+			if !table.knownColumns[column] && columnChanged(notification, column) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// columnChanged reports whether an update changed column. Without the old
+// row image every column counts as changed.
+func columnChanged(notification Notification, column string) bool {
+	if notification.Old == nil {
+		return true
+	}
+	return !reflect.DeepEqual(notification.Old[column], notification.Data[column])
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"log"
+	"time"
+)
+
+// DeadLetterQueue parks messages the consumer cannot process on a separate
+// topic so that the main topic keeps moving.
+type DeadLetterQueue struct {
+	producer *kafka.Producer
+	topic    string
+}
+
+func newDeadLetterQueue(brokers, topic string) (*DeadLetterQueue, error) {
+	producer, err := kafka.NewProducer(&kafka.ConfigMap{"bootstrap.servers": brokers})
+	if err != nil {
+		return nil, err
+	}
+	return &DeadLetterQueue{producer: producer, topic: topic}, nil
+}
+
+// Send publishes the original message with the failure reason and its source
+// position in the headers, and waits for the delivery report. A failed
+// delivery is tried again, up to DeadLetterAttempts times, and then
+// returned: the caller must not commit the message's offset, so that it is
+// read again rather than lost. A nil queue, as in a dry run, only logs the
+// message.
+func (d *DeadLetterQueue) Send(message *kafka.Message, reason error) error {
+	source := message.TopicPartition
+	sourceTopic := ""
+	if source.Topic != nil {
+		sourceTopic = *source.Topic
+	}
+	if d == nil {
+		log.Printf("Message from %s[%d]@%v would be dead-lettered: %v", sourceTopic, source.Partition, source.Offset, reason)
+		return nil
+	}
+	deadLetter := &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &d.topic, Partition: kafka.PartitionAny},
+		Key:            message.Key,
+		Value:          message.Value,
+		Headers: append(message.Headers,
+			kafka.Header{Key: "dlq.error", Value: []byte(reason.Error())},
+			kafka.Header{Key: "dlq.source", Value: []byte(fmt.Sprintf("%s[%d]@%v", sourceTopic, source.Partition, source.Offset))},
+		),
+	}
+
+	var err error
+	for attempt := 1; attempt <= DeadLetterAttempts; attempt++ {
+		if err = d.produce(deadLetter); err == nil {
+			log.Printf("Message from %s[%d]@%v sent to dead-letter topic %s: %v",
+				sourceTopic, source.Partition, source.Offset, d.topic, reason)
+			return nil
+		}
+		log.Printf("Dead-letter delivery to %s failed (attempt %d of %d): %v", d.topic, attempt, DeadLetterAttempts, err)
+		if attempt < DeadLetterAttempts {
+			time.Sleep(DeadLetterBackoff)
+		}
+	}
+	return fmt.Errorf("dead-lettering message from %s[%d]@%v: %w", sourceTopic, source.Partition, source.Offset, err)
+}
+
+// produce publishes one message and waits for its delivery report.
+func (d *DeadLetterQueue) produce(message *kafka.Message) error {
+	deliveryChan := make(chan kafka.Event, 1)
+	if err := d.producer.Produce(message, deliveryChan); err != nil {
+		return err
+	}
+	e := <-deliveryChan
+	return e.(*kafka.Message).TopicPartition.Error
+}
+
+func (d *DeadLetterQueue) Close() {
+	if d == nil {
+		return
+	}
+	d.producer.Flush(5000)
+	d.producer.Close()
+}
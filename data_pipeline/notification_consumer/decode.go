@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const ColumnTypeAny = ""
+const ColumnTypeInteger = "integer"
+const ColumnTypeFloat = "float"
+const ColumnTypeString = "string"
+const ColumnTypeBoolean = "boolean"
+const ColumnTypeTimestamp = "timestamp"
+const ColumnTypeJSON = "json"
+
+const NullPolicyAllow = "allow"
+const NullPolicyOmit = "omit"
+const NullPolicyReject = "reject"
+
+const DecodeErrorMissing = "missing"
+const DecodeErrorNull = "null"
+const DecodeErrorWrongType = "wrong_type"
+
+// timestampLayouts are the formats row_to_json produces for timestamp and
+// timestamptz columns.
+var timestampLayouts = []string{
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999Z07:00",
+	"2006-01-02T15:04:05.999999999Z07",
+	"2006-01-02",
+}
+
+// ColumnError describes a single column that could not be decoded.
+type ColumnError struct {
+	Column   string
+	Kind     string
+	Expected string
+	Value    interface{}
+}
+
+func (e *ColumnError) Error() string {
+	switch e.Kind {
+	case DecodeErrorMissing:
+		return fmt.Sprintf("column %s is missing", e.Column)
+	case DecodeErrorNull:
+		return fmt.Sprintf("column %s is null", e.Column)
+	default:
+		return fmt.Sprintf("column %s: expected %s, got %T", e.Column, e.Expected, e.Value)
+	}
+}
+
+// DecodeError collects every column error found in a row.
+type DecodeError struct {
+	Table   string
+	Columns []*ColumnError
+}
+
+func (e *DecodeError) Error() string {
+	messages := make([]string, 0, len(e.Columns))
+	for _, column := range e.Columns {
+		messages = append(messages, column.Error())
+	}
+	return fmt.Sprintf("decoding %s row: %s", e.Table, strings.Join(messages, "; "))
+}
+
+// decodeDocument turns a row image into the document indexed for table and
+// returns the document id taken from the primary key. Renamed columns are
+// read under their new names, and the table's evolution rules decide what
+// missing and undeclared columns do.
+func decodeDocument(table *TableConfig, row map[string]interface{}) (map[string]interface{}, string, error) {
+	decodeErr := &DecodeError{Table: table.Name}
+	document := make(map[string]interface{}, len(table.Columns))
+	var primaryKey interface{}
+	primaryKeyIndexed := false
+
+	for _, column := range table.Columns {
+		nullPolicy := column.Null
+		if column.Name == table.PrimaryKey {
+			// A row without a primary key cannot be addressed in the index.
+			nullPolicy = NullPolicyReject
+			primaryKeyIndexed = true
+		}
+		value, present, err := decodeColumn(table.sourceColumn(column.Name, row), column.Type, nullPolicy, row)
+		if err != nil {
+			// A column dropped in Postgres is left out when the rules allow
+			if err.Kind == DecodeErrorMissing && column.Name != table.PrimaryKey && table.Evolution.Removed != EvolutionFail {
+				continue
+			}
+			decodeErr.Columns = append(decodeErr.Columns, err)
+			continue
+		}
+		if present {
+			document[column.FieldName()] = value
+		}
+		if column.Name == table.PrimaryKey {
+			primaryKey = value
+		}
+	}
+	if !primaryKeyIndexed {
+		value, _, err := decodeColumn(table.PrimaryKey, ColumnTypeAny, NullPolicyReject, row)
+		if err != nil {
+			decodeErr.Columns = append(decodeErr.Columns, err)
+		}
+		primaryKey = value
+	}
+
+	if len(decodeErr.Columns) > 0 {
+		return nil, "", decodeErr
+	}
+	if table.Evolution.Added == EvolutionAdd {
+		for name, raw := range row {
+			if _, exists := document[name]; !exists && !table.knownColumns[name] {
+				document[name] = linkValue(raw)
+			}
+		}
+	}
+	documentID, _ := documentIDFromValue(primaryKey)
+	return document, documentID, nil
+}
+
+// decodeRelationshipIDs returns the left and right ids of a relationship row.
+func decodeRelationshipIDs(relationship *RelationshipConfig, row map[string]interface{}) (interface{}, interface{}, error) {
+	decodeErr := &DecodeError{Table: relationship.Table}
+	leftID, _, leftErr := decodeColumn(relationship.Left.Column, relationship.Left.Type, NullPolicyReject, row)
+	if leftErr != nil {
+		decodeErr.Columns = append(decodeErr.Columns, leftErr)
+	}
+	rightID, _, rightErr := decodeColumn(relationship.Right.Column, relationship.Right.Type, NullPolicyReject, row)
+	if rightErr != nil {
+		decodeErr.Columns = append(decodeErr.Columns, rightErr)
+	}
+	if len(decodeErr.Columns) > 0 {
+		return nil, nil, decodeErr
+	}
+	return leftID, rightID, nil
+}
+
+// decodeColumn reads one column from a row, applying the null policy and
+// checking the value against columnType. present is false when the column
+// should be left out of the document.
+func decodeColumn(name, columnType, nullPolicy string, row map[string]interface{}) (interface{}, bool, *ColumnError) {
+	raw, ok := row[name]
+	if !ok {
+		return nil, false, &ColumnError{Column: name, Kind: DecodeErrorMissing}
+	}
+	if raw == nil {
+		switch nullPolicy {
+		case NullPolicyReject:
+			return nil, false, &ColumnError{Column: name, Kind: DecodeErrorNull}
+		case NullPolicyOmit:
+			return nil, false, nil
+		default:
+			return nil, true, nil
+		}
+	}
+
+	value, ok := convertColumnValue(columnType, raw)
+	if !ok {
+		return nil, false, &ColumnError{Column: name, Kind: DecodeErrorWrongType, Expected: columnType, Value: raw}
+	}
+	return value, true, nil
+}
+
+// convertColumnValue checks a non-null JSON value against columnType and
+// normalises it for indexing.
+func convertColumnValue(columnType string, raw interface{}) (interface{}, bool) {
+	switch columnType {
+	case ColumnTypeAny:
+		return linkValue(raw), true
+	case ColumnTypeInteger:
+		v, ok := raw.(float64)
+		if !ok || v != float64(int64(v)) {
+			return nil, false
+		}
+		return int64(v), true
+	case ColumnTypeFloat:
+		v, ok := raw.(float64)
+		return v, ok
+	case ColumnTypeString:
+		v, ok := raw.(string)
+		return v, ok
+	case ColumnTypeBoolean:
+		v, ok := raw.(bool)
+		return v, ok
+	case ColumnTypeTimestamp:
+		v, ok := raw.(string)
+		if !ok {
+			return nil, false
+		}
+		for _, layout := range timestampLayouts {
+			if _, err := time.Parse(layout, v); err == nil {
+				return v, true
+			}
+		}
+		return nil, false
+	case ColumnTypeJSON:
+		switch raw.(type) {
+		case map[string]interface{}, []interface{}:
+			return raw, true
+		}
+		return nil, false
+	default:
+		return nil, false
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// Outcomes of a write in a diff.
+const DiffCreated = "create"
+const DiffChanged = "change"
+const DiffDeleted = "delete"
+const DiffUnchanged = "noop"
+const DiffStale = "stale"
+const DiffMissing = "missing"
+const DiffUnsimulated = "unsimulated"
+const DiffFailed = "error"
+
+// DocumentDiff is what one write would do to one document: its outcome and
+// the fields it would add, remove or change.
+type DocumentDiff struct {
+	Request string        `json:"request"`
+	Index   string        `json:"index"`
+	ID      string        `json:"id"`
+	Outcome string        `json:"outcome"`
+	Changes []FieldChange `json:"changes,omitempty"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// FieldChange is one top-level field of a document before and after a write.
+// Added and Removed mark a field the write adds or removes; a field that is
+// or becomes null has a nil Before or After without either.
+type FieldChange struct {
+	Field   string
+	Before  interface{}
+	After   interface{}
+	Added   bool
+	Removed bool
+}
+
+// MarshalJSON leaves before out of an added field and after out of a removed
+// one, and writes a null value as null.
+func (c FieldChange) MarshalJSON() ([]byte, error) {
+	var change struct {
+		Field  string       `json:"field"`
+		Before *interface{} `json:"before,omitempty"`
+		After  *interface{} `json:"after,omitempty"`
+	}
+	change.Field = c.Field
+	if !c.Added {
+		change.Before = &c.Before
+	}
+	if !c.Removed {
+		change.After = &c.After
+	}
+	return json.Marshal(change)
+}
+
+// diffWriter performs no writes. It fetches each document a write targets
+// and reports the field-level diff the write would cause, as text or, when
+// asJSON is set, as one JSON object per line. Since nothing is written, every
+// write is compared with the document as it is currently indexed, and writes
+// collected for a transaction are diffed as they are collected.
+type diffWriter struct {
+	client *elasticsearch.TypedClient
+	asJSON bool
+
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func newDiffWriter(client *elasticsearch.TypedClient, out io.Writer, asJSON bool) *diffWriter {
+	return &diffWriter{client: client, out: out, asJSON: asJSON}
+}
+
+func (w *diffWriter) Apply(operation, indexName, documentID string, document interface{}, version int64) error {
+	diff := DocumentDiff{Request: applyRequest(operation), Index: indexName, ID: documentID}
+	current, currentVersion, found, err := fetchDocument(w.client, indexName, documentID)
+	switch {
+	case err != nil:
+		diff.Outcome, diff.Error = DiffFailed, err.Error()
+	case found && version > 0 && currentVersion >= version:
+		// External versioning rejects the write as a stale redelivery
+		diff.Outcome = DiffStale
+	case operation == OperationDelete && !found:
+		diff.Outcome = DiffUnchanged
+	case operation == OperationDelete:
+		diff.Outcome, diff.Changes = DiffDeleted, diffFields(current, nil)
+	default:
+		after, _ := canonicalJSON(document).(map[string]interface{})
+		diff.Changes = diffFields(current, after)
+		diff.Outcome = changeOutcome(found, diff.Changes)
+	}
+	w.emit(diff)
+	return nil
+}
+
+// Update simulates the link scripts on the current document, or indexes the
+// upsert when the document does not exist yet.
+func (w *diffWriter) Update(indexName, documentID string, query map[string]interface{}) error {
+	diff := DocumentDiff{Request: RequestUpdate, Index: indexName, ID: documentID}
+	current, _, found, err := fetchDocument(w.client, indexName, documentID)
+	switch {
+	case err != nil:
+		diff.Outcome, diff.Error = DiffFailed, err.Error()
+	case !found && query["upsert"] == nil:
+		diff.Outcome = DiffMissing
+	case !found:
+		upsert, _ := canonicalJSON(query["upsert"]).(map[string]interface{})
+		diff.Outcome, diff.Changes = DiffCreated, diffFields(nil, upsert)
+	default:
+		w.simulate(&diff, query, current)
+	}
+	w.emit(diff)
+	return nil
+}
+
+// UpdateByQuery simulates the script on the first DiffQueryLimit documents
+// matching the query.
+func (w *diffWriter) UpdateByQuery(indexName string, query map[string]interface{}) error {
+	hits, total, err := searchDocuments(w.client, indexName, query["query"], DiffQueryLimit)
+	if err != nil {
+		w.emit(DocumentDiff{Request: RequestUpdateByQuery, Index: indexName, ID: "_query", Outcome: DiffFailed, Error: err.Error()})
+		return nil
+	}
+	if total > len(hits) {
+		log.Printf("Dry run: %d documents of %s match an update by query, diffing the first %d", total, indexName, len(hits))
+	}
+	for _, hit := range hits {
+		diff := DocumentDiff{Request: RequestUpdateByQuery, Index: indexName, ID: hit.ID}
+		w.simulate(&diff, query, hit.Source)
+		w.emit(diff)
+	}
+	return nil
+}
+
+// Bulk returns the writer itself: there is nothing to hold until Flush.
+func (w *diffWriter) Bulk() BatchWriter {
+	return w
+}
+
+func (w *diffWriter) Flush() error {
+	return nil
+}
+
+// simulate fills diff with the changes the script of query makes to current.
+func (w *diffWriter) simulate(diff *DocumentDiff, query map[string]interface{}, current map[string]interface{}) {
+	script, _ := canonicalJSON(query["script"]).(map[string]interface{})
+	source, _ := script["source"].(string)
+	params, _ := script["params"].(map[string]interface{})
+	after, ok := runScript(source, params, current)
+	if !ok {
+		diff.Outcome = DiffUnsimulated
+		return
+	}
+	diff.Changes = diffFields(current, after)
+	diff.Outcome = changeOutcome(true, diff.Changes)
+}
+
+// runScript returns current as the given script would leave it, and false for
+// a script it does not know. The scripts are those the consumer sends; their
+// params hold the field, id, embed and summary they work on.
+func runScript(source string, params, current map[string]interface{}) (map[string]interface{}, bool) {
+	document, _ := canonicalJSON(current).(map[string]interface{})
+	if document == nil {
+		document = make(map[string]interface{})
+	}
+	field, _ := params["field"].(string)
+	embed, _ := params["embed"].(string)
+	id, summary := params["id"], params["summary"]
+
+	if (source == linkAddScript || source == linkRemoveScript) && staleLinkChange(document, params) {
+		return document, true
+	}
+	switch source {
+	case linkAddScript:
+		ids, _ := document[field].([]interface{})
+		if indexOf(ids, id) < 0 {
+			ids = append(ids, id)
+		}
+		document[field] = ids
+		if embed != "" && summary != nil {
+			summaries, _ := document[embed].([]interface{})
+			if i := summaryIndex(summaries, id); i >= 0 {
+				summaries[i] = summary
+			} else {
+				summaries = append(summaries, summary)
+			}
+			document[embed] = summaries
+		}
+	case linkRemoveScript:
+		if ids, ok := document[field].([]interface{}); ok {
+			if i := indexOf(ids, id); i >= 0 {
+				document[field] = append(ids[:i], ids[i+1:]...)
+			}
+		}
+		if summaries, ok := document[embed].([]interface{}); ok {
+			kept := make([]interface{}, 0, len(summaries))
+			for i, s := range summaries {
+				if summaryIndex(summaries[i:i+1], id) < 0 {
+					kept = append(kept, s)
+				}
+			}
+			document[embed] = kept
+		}
+	case summaryUpdateScript:
+		if summaries, ok := document[embed].([]interface{}); ok {
+			for i, s := range summaries {
+				if s, ok := s.(map[string]interface{}); ok && reflect.DeepEqual(s["id"], id) {
+					summaries[i] = summary
+				}
+			}
+		}
+	default:
+		return nil, false
+	}
+	return document, true
+}
+
+// staleLinkChange runs the version check of the link scripts on document: it
+// reports whether the document holds a newer change to the link than params
+// carry, and otherwise records their version.
+func staleLinkChange(document, params map[string]interface{}) bool {
+	version, ok := params["version"].(float64)
+	if !ok {
+		return false
+	}
+	versionsField, _ := params["versions"].(string)
+	link, _ := params["link"].(string)
+	versions, _ := document[versionsField].(map[string]interface{})
+	if versions == nil {
+		versions = make(map[string]interface{})
+		document[versionsField] = versions
+	}
+	if seen, ok := versions[link].(float64); ok && seen > version {
+		return true
+	}
+	versions[link] = version
+	return false
+}
+
+func indexOf(values []interface{}, value interface{}) int {
+	for i, v := range values {
+		if reflect.DeepEqual(v, value) {
+			return i
+		}
+	}
+	return -1
+}
+
+func summaryIndex(summaries []interface{}, id interface{}) int {
+	for i, s := range summaries {
+		if s, ok := s.(map[string]interface{}); ok && reflect.DeepEqual(s["id"], id) {
+			return i
+		}
+	}
+	return -1
+}
+
+func changeOutcome(found bool, changes []FieldChange) string {
+	switch {
+	case !found:
+		return DiffCreated
+	case len(changes) > 0:
+		return DiffChanged
+	}
+	return DiffUnchanged
+}
+
+// diffFields compares the top-level fields of two documents as decoded from
+// JSON, either of which may be nil, and returns the changed fields by name.
+func diffFields(before, after map[string]interface{}) []FieldChange {
+	var changes []FieldChange
+	for field, old := range before {
+		value, ok := after[field]
+		if !ok {
+			changes = append(changes, FieldChange{Field: field, Before: old, Removed: true})
+		} else if !reflect.DeepEqual(old, value) {
+			changes = append(changes, FieldChange{Field: field, Before: old, After: value})
+		}
+	}
+	for field, value := range after {
+		if _, ok := before[field]; !ok {
+			changes = append(changes, FieldChange{Field: field, After: value, Added: true})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes
+}
+
+// emit writes a diff as one JSON line, or as a header line followed by a line
+// per field: "+" for an added field, "-" for a removed one and "~" for a
+// changed one.
+func (w *diffWriter) emit(diff DocumentDiff) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.asJSON {
+		if err := json.NewEncoder(w.out).Encode(diff); err != nil {
+			log.Printf("Error writing diff of %s/%s: %v", diff.Index, diff.ID, err)
+		}
+		return
+	}
+	line := fmt.Sprintf("%s\t%s/%s\t%s", diff.Request, diff.Index, diff.ID, diff.Outcome)
+	if diff.Error != "" {
+		line += "\t" + diff.Error
+	}
+	fmt.Fprintln(w.out, line)
+	for _, change := range diff.Changes {
+		switch {
+		case change.Added:
+			fmt.Fprintf(w.out, "  + %s: %s\n", change.Field, encodeValue(change.After))
+		case change.Removed:
+			fmt.Fprintf(w.out, "  - %s: %s\n", change.Field, encodeValue(change.Before))
+		default:
+			fmt.Fprintf(w.out, "  ~ %s: %s -> %s\n", change.Field, encodeValue(change.Before), encodeValue(change.After))
+		}
+	}
+}
+
+func encodeValue(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
+
+// fetchDocument returns the source and version of a document, and whether it
+// exists. A missing index holds no documents.
+func fetchDocument(esClient *elasticsearch.TypedClient, indexName, documentID string) (map[string]interface{}, int64, bool, error) {
+	response, err := esapi.GetRequest{Index: indexName, DocumentID: documentID}.Do(context.Background(), esClient)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return nil, 0, false, nil
+	}
+	if response.IsError() {
+		return nil, 0, false, newStatusError(response)
+	}
+
+	var result struct {
+		Version int64                  `json:"_version"`
+		Source  map[string]interface{} `json:"_source"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return nil, 0, false, err
+	}
+	return result.Source, result.Version, true, nil
+}
+
+// searchHit is a document found by searchDocuments.
+type searchHit struct {
+	ID     string                 `json:"_id"`
+	Source map[string]interface{} `json:"_source"`
+}
+
+// searchDocuments returns up to size documents of indexName matching query,
+// and how many match in all.
+func searchDocuments(esClient *elasticsearch.TypedClient, indexName string, query interface{}, size int) ([]searchHit, int, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"size":             size,
+		"query":            query,
+		"track_total_hits": true,
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	response, err := esapi.SearchRequest{Index: []string{indexName}, Body: bytes.NewReader(body)}.Do(context.Background(), esClient)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return nil, 0, nil
+	}
+	if response.IsError() {
+		return nil, 0, newStatusError(response)
+	}
+
+	var result struct {
+		Hits struct {
+			Total struct {
+				Value int `json:"value"`
+			} `json:"total"`
+			Hits []searchHit `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return nil, 0, err
+	}
+	return result.Hits.Hits, result.Hits.Total.Value, nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"log"
+	"reflect"
+	"time"
+)
+
+// summaryUpdateScript rewrites the summary with id params.id in the array
+// params.embed, so that renaming a document shows on every document it is
+// embedded in.
+const summaryUpdateScript = "boolean changed = false; def list = ctx._source[params.embed]; " +
+	"if (list != null) { for (int i = 0; i < list.size(); i++) { " +
+	"if (list[i].id == params.id && !list[i].equals(params.summary)) { list[i] = params.summary; changed = true } } } " +
+	"if (!changed) { ctx.op = 'noop' }"
+
+// summarize builds the summary of an entity's document embedded by the other
+// side of a relationship: the id the relationship links with, and the
+// embedded fields.
+func summarize(embed *EmbedConfig, id interface{}, document map[string]interface{}) map[string]interface{} {
+	summary := make(map[string]interface{}, len(embed.Fields)+1)
+	for _, field := range embed.Fields {
+		summary[field] = document[field]
+	}
+	summary["id"] = id
+	return summary
+}
+
+// loadSummaries reads the entities on side whose rows match condition, an
+// SQL condition on rows aliased o, and returns their summaries keyed by
+// document id. Rows are decoded and transformed as they are for indexing;
+// rows that fail to decode or that a transformer skips have no summary.
+func loadSummaries(db *sql.DB, embed *EmbedConfig, side RelationshipSide, condition string, args ...interface{}) (map[string]map[string]interface{}, error) {
+	entity := side.entity
+	query := fmt.Sprintf(`SELECT row_to_json(o) FROM %s o WHERE %s`, quoteIdentifier(entity.Name), condition)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	entityRows, err := scanJSONRows(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	summaries := make(map[string]map[string]interface{}, len(entityRows))
+	for _, row := range entityRows {
+		document, documentID, err := decodeDocument(entity, row)
+		if err != nil {
+			log.Printf("Skipping summary of %s: %v", entity.Name, err)
+			continue
+		}
+		if keep, err := applyTransformers(entity, OperationInsert, row, document); err != nil || !keep {
+			continue
+		}
+		id, _, columnErr := decodeColumn(entity.PrimaryKey, side.Type, NullPolicyReject, row)
+		if columnErr != nil {
+			continue
+		}
+		summaries[documentID] = summarize(embed, id, document)
+	}
+	return summaries, nil
+}
+
+// loadSummary returns the summary of the entity with id on side, or nil when
+// own does not embed it or it cannot be read.
+func loadSummary(db *sql.DB, own, side RelationshipSide, id interface{}) map[string]interface{} {
+	if own.Embed == nil || side.entity == nil {
+		return nil
+	}
+	documentID, ok := documentIDFromValue(id)
+	if !ok {
+		return nil
+	}
+	condition := fmt.Sprintf("o.%s = $1", quoteIdentifier(side.entity.PrimaryKey))
+	summaries, err := loadSummaries(db, own.Embed, side, condition, id)
+	if err != nil {
+		log.Printf("Error loading summary of %s %v: %v", side.entity.Name, id, err)
+		return nil
+	}
+	return summaries[documentID]
+}
+
+// fanOutSummaries rewrites the summary of an updated entity in every document
+// that embeds it, with one update-by-query per embedding relationship side.
+// When the old row image shows the summary did not change, nothing is sent.
+func fanOutSummaries(schema *Schema, table *TableConfig, notification Notification, document map[string]interface{}, writer DocumentWriter) {
+	row := notification.Data
+	var oldDocument map[string]interface{}
+	if notification.Old != nil {
+		decoded, _, err := decodeDocument(table, notification.Old)
+		if err == nil {
+			if keep, err := applyTransformers(table, OperationUpdate, notification.Old, decoded); err == nil && keep {
+				oldDocument = decoded
+			}
+		}
+	}
+	for i := range schema.Relationships {
+		relationship := &schema.Relationships[i]
+		for _, sides := range [][2]RelationshipSide{{relationship.Left, relationship.Right}, {relationship.Right, relationship.Left}} {
+			own, other := sides[0], sides[1]
+			if own.Embed == nil || other.entity != table {
+				continue
+			}
+			id, _, columnErr := decodeColumn(table.PrimaryKey, other.Type, NullPolicyReject, row)
+			if columnErr != nil {
+				log.Printf("Skipping summaries of %s in %s: %v", table.Name, own.Index, columnErr)
+				continue
+			}
+			summary := summarize(own.Embed, id, document)
+			if oldDocument != nil && reflect.DeepEqual(summary, summarize(own.Embed, id, oldDocument)) {
+				continue
+			}
+			query := map[string]interface{}{
+				"query": map[string]interface{}{
+					"term": map[string]interface{}{own.Field: id},
+				},
+				"script": map[string]interface{}{
+					"source": summaryUpdateScript,
+					"lang":   "painless",
+					"params": map[string]interface{}{
+						"embed":   own.Embed.Field,
+						"id":      id,
+						"summary": summary,
+					},
+				},
+			}
+			if err := writer.UpdateByQuery(own.Index, query); err != nil {
+				log.Printf("Error updating summaries of %s in %s: %v", table.Name, own.Index, err)
+			}
+		}
+	}
+}
+
+// updateDocumentsByQuery runs a script over every document in indexName that
+// matches the query. Documents changed while it runs are skipped rather than
+// failing the request, and the request is sent again, up to
+// UpdateRetryOnConflict times, until no document was skipped. The scripts it
+// runs are idempotent, so documents already updated are not harmed by a
+// retry, and a failed request, including one rejected for overload, can be
+// sent again.
+func updateDocumentsByQuery(indexName string, query map[string]interface{}, esClient *elasticsearch.TypedClient) error {
+	queryJSON, err := json.Marshal(query)
+	if err != nil {
+		return err
+	}
+	for retry := 0; ; retry++ {
+		conflicts, err := updateByQueryOnce(indexName, queryJSON, esClient)
+		if err != nil || conflicts == 0 {
+			return err
+		}
+		if retry == UpdateRetryOnConflict {
+			return fmt.Errorf("update by query on %s: %d documents still changed meanwhile after %d retries", indexName, conflicts, retry)
+		}
+		log.Printf("Update by query on %s skipped %d documents changed meanwhile, retrying", indexName, conflicts)
+	}
+}
+
+// updateByQueryOnce sends one update-by-query request and returns how many
+// documents it skipped for version conflicts.
+func updateByQueryOnce(indexName string, queryJSON []byte, esClient *elasticsearch.TypedClient) (int, error) {
+	request := esapi.UpdateByQueryRequest{
+		Index:     []string{indexName},
+		Body:      bytes.NewReader(queryJSON),
+		Conflicts: "proceed",
+	}
+
+	start := time.Now()
+	response, err := request.Do(context.Background(), esClient)
+	failed := err
+	if err == nil && response.IsError() {
+		failed = errors.New(response.Status())
+	}
+	observeElasticsearch(RequestUpdateByQuery, start, failed)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	if response.IsError() {
+		return 0, newStatusError(response)
+	}
+
+	var result struct {
+		Updated          int               `json:"updated"`
+		VersionConflicts int               `json:"version_conflicts"`
+		Failures         []json.RawMessage `json:"failures"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return 0, err
+	}
+	if len(result.Failures) > 0 {
+		var failure struct {
+			Status int `json:"status"`
+		}
+		_ = json.Unmarshal(result.Failures[0], &failure)
+		return 0, &statusError{Status: failure.Status, Body: string(result.Failures[0])}
+	}
+	log.Printf("Updated %d documents in %s by query", result.Updated, indexName)
+	return result.VersionConflicts, nil
+}
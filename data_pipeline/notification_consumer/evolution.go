@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"github.com/elastic/go-elasticsearch/v8/typedapi/types/enums/optype"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const SchemaChangeAdded = "added"
+const SchemaChangeRemoved = "removed"
+
+// SchemaVersion is one set of columns seen in a table's change events,
+// numbered in the order the versions were first seen. Added and Removed
+// compare it with the columns the schema declares for the table.
+type SchemaVersion struct {
+	Table     string    `json:"table"`
+	Version   int       `json:"version"`
+	Columns   []string  `json:"columns"`
+	Added     []string  `json:"added,omitempty"`
+	Removed   []string  `json:"removed,omitempty"`
+	FirstSeen time.Time `json:"first_seen"`
+}
+
+// schemaTracker notices when the columns of a table's rows change, from the
+// row images change events carry, and records each new set of columns as a
+// schema version in Elasticsearch. A new version is logged, and alerted on
+// when the table's evolution rules say so. A nil tracker tracks nothing.
+type schemaTracker struct {
+	client *elasticsearch.TypedClient
+	index  string
+
+	mu       sync.RWMutex
+	versions map[string]map[string]*SchemaVersion // table -> column list -> version
+	latest   map[string]*SchemaVersion
+	current  map[string]map[string]bool // table -> columns of the last version observed
+}
+
+// newSchemaTracker loads the schema versions recorded in index.
+func newSchemaTracker(client *elasticsearch.TypedClient, index string) (*schemaTracker, error) {
+	tracker := &schemaTracker{
+		client:   client,
+		index:    index,
+		versions: make(map[string]map[string]*SchemaVersion),
+		latest:   make(map[string]*SchemaVersion),
+		current:  make(map[string]map[string]bool),
+	}
+	recorded, err := loadSchemaVersions(client, index)
+	if err != nil {
+		return nil, err
+	}
+	for _, version := range recorded {
+		tracker.remember(version)
+	}
+	return tracker, nil
+}
+
+// Observe checks the columns of a row image of table against the versions
+// seen so far and records a new version when they differ from all of them.
+// Almost every row has the columns of the last one observed, which is checked
+// under a read lock without sorting them.
+func (t *schemaTracker) Observe(table *TableConfig, row map[string]interface{}) {
+	if t == nil || len(row) == 0 {
+		return
+	}
+	t.mu.RLock()
+	unchanged := hasColumns(row, t.current[table.Name])
+	t.mu.RUnlock()
+	if unchanged {
+		return
+	}
+
+	columns := make([]string, 0, len(row))
+	for column := range row {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	key := strings.Join(columns, ",")
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if version, seen := t.versions[table.Name][key]; seen {
+		t.current[table.Name] = columnSet(version.Columns)
+		return
+	}
+	version := &SchemaVersion{
+		Table:     table.Name,
+		Columns:   columns,
+		FirstSeen: time.Now().UTC(),
+	}
+	version.Added, version.Removed = compareColumns(table, row)
+	version, previous, err := t.record(version)
+	if err != nil {
+		log.Printf("Error recording a schema version of %s: %v", table.Name, err)
+		return
+	}
+	t.current[table.Name] = columnSet(version.Columns)
+	t.report(table, version, previous)
+}
+
+// hasColumns reports whether row has exactly the given columns.
+func hasColumns(row map[string]interface{}, columns map[string]bool) bool {
+	if columns == nil || len(row) != len(columns) {
+		return false
+	}
+	for column := range row {
+		if !columns[column] {
+			return false
+		}
+	}
+	return true
+}
+
+func columnSet(columns []string) map[string]bool {
+	set := make(map[string]bool, len(columns))
+	for _, column := range columns {
+		set[column] = true
+	}
+	return set
+}
+
+func (t *schemaTracker) remember(version *SchemaVersion) {
+	if t.versions[version.Table] == nil {
+		t.versions[version.Table] = make(map[string]*SchemaVersion)
+	}
+	t.versions[version.Table][strings.Join(version.Columns, ",")] = version
+	if latest := t.latest[version.Table]; latest == nil || version.Version > latest.Version {
+		t.latest[version.Table] = version
+	}
+}
+
+// record stores a new set of columns as the version one past the latest this
+// consumer knows, under the id <table>:v<version>, and returns the version
+// stored for the columns and the one before it. Only one consumer can create
+// an id, so when another consumer stored that version first it is read back:
+// with the same columns it is the version, and otherwise the next version is
+// tried. Version numbers therefore come from the stored records, whichever
+// consumer sees a set of columns first.
+func (t *schemaTracker) record(version *SchemaVersion) (*SchemaVersion, *SchemaVersion, error) {
+	key := strings.Join(version.Columns, ",")
+	for {
+		previous := t.latest[version.Table]
+		version.Version = 1
+		if previous != nil {
+			version.Version = previous.Version + 1
+		}
+		id := fmt.Sprintf("%s:v%d", version.Table, version.Version)
+		_, err := t.client.Index(t.index).Id(id).Document(version).OpType(optype.Create).Do(context.Background())
+		if err == nil {
+			t.remember(version)
+			return version, previous, nil
+		}
+		if !isVersionConflict(err) {
+			return nil, nil, err
+		}
+		stored, err := t.fetch(id)
+		if err != nil {
+			return nil, nil, err
+		}
+		t.remember(stored)
+		if strings.Join(stored.Columns, ",") == key {
+			return stored, previous, nil
+		}
+	}
+}
+
+// fetch reads the version stored under id.
+func (t *schemaTracker) fetch(id string) (*SchemaVersion, error) {
+	response, err := t.client.Get(t.index, id).Do(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	if !response.Found {
+		return nil, fmt.Errorf("schema version %s disappeared", id)
+	}
+	var version SchemaVersion
+	if err := json.Unmarshal(response.Source_, &version); err != nil {
+		return nil, err
+	}
+	return &version, nil
+}
+
+// report logs a new version and counts the changes it brings, labelled with
+// the rule that applies to them. Two columns that disappeared and appeared
+// together since the previous version are reported as a possible rename.
+func (t *schemaTracker) report(table *TableConfig, version, previous *SchemaVersion) {
+	if len(version.Added) == 0 && len(version.Removed) == 0 {
+		log.Printf("Schema of %s is at version %d, matching the declared columns", table.Name, version.Version)
+		return
+	}
+	for _, change := range []struct {
+		kind, rule string
+		columns    []string
+	}{
+		{SchemaChangeAdded, table.Evolution.Added, version.Added},
+		{SchemaChangeRemoved, table.Evolution.Removed, version.Removed},
+	} {
+		if len(change.columns) == 0 {
+			continue
+		}
+		schemaChanges.WithLabelValues(table.Name, change.kind, change.rule).Add(float64(len(change.columns)))
+		message := "Schema of %s changed to version %d: %s columns %s (rule: %s)"
+		if change.rule == EvolutionAlert {
+			message = "ALERT: " + message
+		}
+		log.Printf(message, table.Name, version.Version, change.kind, strings.Join(change.columns, ", "), change.rule)
+	}
+	if previous != nil {
+		gone, appeared := diffColumns(previous.Columns, version.Columns)
+		if len(gone) == 1 && len(appeared) == 1 {
+			log.Printf("Column %s of %s may have been renamed to %s; map it with evolution.renames: {%s: %s}",
+				gone[0], table.Name, appeared[0], gone[0], appeared[0])
+		}
+	}
+}
+
+// compareColumns returns the columns of row that the schema does not declare
+// for table, and the declared columns row lacks, renamed ones included.
+func compareColumns(table *TableConfig, row map[string]interface{}) (added, removed []string) {
+	for column := range row {
+		if !table.knownColumns[column] {
+			added = append(added, column)
+		}
+	}
+	for _, column := range table.Columns {
+		if _, ok := row[table.sourceColumn(column.Name, row)]; !ok {
+			removed = append(removed, column.Name)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+// diffColumns returns the columns only in before and those only in after,
+// both sorted lists.
+func diffColumns(before, after []string) (gone, appeared []string) {
+	inAfter := make(map[string]bool, len(after))
+	for _, column := range after {
+		inAfter[column] = true
+	}
+	inBefore := make(map[string]bool, len(before))
+	for _, column := range before {
+		inBefore[column] = true
+		if !inAfter[column] {
+			gone = append(gone, column)
+		}
+	}
+	for _, column := range after {
+		if !inBefore[column] {
+			appeared = append(appeared, column)
+		}
+	}
+	return gone, appeared
+}
+
+// loadSchemaVersions reads every version recorded in index. A missing index
+// holds no versions.
+func loadSchemaVersions(esClient *elasticsearch.TypedClient, index string) ([]*SchemaVersion, error) {
+	query, err := json.Marshal(map[string]interface{}{
+		"size":  10000,
+		"query": map[string]interface{}{"match_all": map[string]interface{}{}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	response, err := esapi.SearchRequest{Index: []string{index}, Body: bytes.NewReader(query)}.Do(context.Background(), esClient)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if response.IsError() {
+		return nil, newStatusError(response)
+	}
+
+	var result struct {
+		Hits struct {
+			Hits []struct {
+				Source SchemaVersion `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	versions := make([]*SchemaVersion, len(result.Hits.Hits))
+	for i := range result.Hits.Hits {
+		versions[i] = &result.Hits.Hits[i].Source
+	}
+	return versions, nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"net/http"
+	"strings"
+)
+
+const HealthOK = "ok"
+const HealthDegraded = "degraded"
+const HealthUnavailable = "unavailable"
+
+// HealthCheck is the outcome of checking one dependency.
+type HealthCheck struct {
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Readiness is the overall status, the worst of its checks, together with
+// each check. A degraded consumer is still ready.
+type Readiness struct {
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks"`
+}
+
+func (r *Readiness) add(name, status, detail string) {
+	r.Checks[name] = HealthCheck{Status: status, Detail: detail}
+	if healthRank(status) > healthRank(r.Status) {
+		r.Status = status
+	}
+}
+
+func healthRank(status string) int {
+	switch status {
+	case HealthDegraded:
+		return 1
+	case HealthUnavailable:
+		return 2
+	default:
+		return 0
+	}
+}
+
+// HealthChecker checks the dependencies the consumer needs to make progress.
+type HealthChecker struct {
+	consumer *kafka.Consumer
+	db       *sql.DB
+	sources  map[string]*sql.DB
+	esClient *elasticsearch.TypedClient
+	indexes  []string
+}
+
+func newHealthChecker(consumer *kafka.Consumer, db *sql.DB, esClient *elasticsearch.TypedClient, schema *Schema) *HealthChecker {
+	checker := &HealthChecker{consumer: consumer, db: db, sources: schema.sourceDBs, esClient: esClient}
+	for _, table := range schema.Tables {
+		checker.indexes = append(checker.indexes, table.Index)
+		if schema.Sources != nil && schema.Sources.Routing == SourceRoutingIndex {
+			for _, source := range schema.SourceNames() {
+				checker.indexes = append(checker.indexes, sourceIndex(table.Index, source))
+			}
+		}
+	}
+	return checker
+}
+
+// Ready checks Postgres and the database of every source, the Kafka brokers,
+// the consumer's group membership and lag, and Elasticsearch's cluster health
+// and indexes.
+func (h *HealthChecker) Ready(ctx context.Context) *Readiness {
+	readiness := &Readiness{Status: HealthOK, Checks: make(map[string]HealthCheck)}
+
+	if err := h.db.PingContext(ctx); err != nil {
+		readiness.add("postgres", HealthUnavailable, err.Error())
+	} else {
+		readiness.add("postgres", HealthOK, "")
+	}
+	for source, db := range h.sources {
+		if err := db.PingContext(ctx); err != nil {
+			readiness.add("postgres:"+source, HealthUnavailable, err.Error())
+		} else {
+			readiness.add("postgres:"+source, HealthOK, "")
+		}
+	}
+
+	metadata, err := h.consumer.GetMetadata(nil, false, KafkaTimeoutMs)
+	switch {
+	case err != nil:
+		readiness.add("kafka", HealthUnavailable, err.Error())
+	case len(metadata.Brokers) == 0:
+		readiness.add("kafka", HealthUnavailable, "no brokers available")
+	default:
+		readiness.add("kafka", HealthOK, fmt.Sprintf("%d brokers", len(metadata.Brokers)))
+	}
+
+	h.checkGroup(readiness)
+	h.checkElasticsearch(ctx, readiness)
+	return readiness
+}
+
+// checkGroup reports whether the consumer holds any partitions of the group
+// and how far its committed offsets trail the end of those partitions.
+func (h *HealthChecker) checkGroup(readiness *Readiness) {
+	assignment, err := h.consumer.Assignment()
+	if err != nil {
+		readiness.add("consumer_group", HealthUnavailable, err.Error())
+		return
+	}
+	if len(assignment) == 0 {
+		readiness.add("consumer_group", HealthDegraded, "no partitions assigned")
+		return
+	}
+	readiness.add("consumer_group", HealthOK, fmt.Sprintf("%d partitions assigned", len(assignment)))
+
+	committed, err := h.consumer.Committed(assignment, KafkaTimeoutMs)
+	if err != nil {
+		readiness.add("lag", HealthDegraded, err.Error())
+		return
+	}
+	var lag int64
+	for _, position := range committed {
+		low, high, err := h.consumer.GetWatermarkOffsets(*position.Topic, position.Partition)
+		if err != nil || high < 0 {
+			continue
+		}
+		// Nothing committed yet counts from the start of the partition
+		from := int64(position.Offset)
+		if from < 0 {
+			from = low
+		}
+		lag += high - from
+	}
+	if lag > LagThreshold {
+		readiness.add("lag", HealthDegraded, fmt.Sprintf("%d messages behind, over the threshold of %d", lag, LagThreshold))
+		return
+	}
+	readiness.add("lag", HealthOK, fmt.Sprintf("%d messages behind", lag))
+}
+
+// checkElasticsearch fails on a red cluster or a missing index. A yellow
+// cluster, usual for single-node setups, is reported but not held against
+// readiness.
+func (h *HealthChecker) checkElasticsearch(ctx context.Context, readiness *Readiness) {
+	response, err := esapi.ClusterHealthRequest{}.Do(ctx, h.esClient)
+	if err != nil {
+		readiness.add("elasticsearch", HealthUnavailable, err.Error())
+		return
+	}
+	var health struct {
+		Status string `json:"status"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&health)
+	response.Body.Close()
+	switch {
+	case err != nil:
+		readiness.add("elasticsearch", HealthUnavailable, err.Error())
+		return
+	case health.Status == "red":
+		readiness.add("elasticsearch", HealthUnavailable, "cluster status red")
+	default:
+		readiness.add("elasticsearch", HealthOK, "cluster status "+health.Status)
+	}
+
+	var missing []string
+	for _, index := range h.indexes {
+		response, err := esapi.IndicesExistsRequest{Index: []string{index}}.Do(ctx, h.esClient)
+		if err != nil {
+			readiness.add("indexes", HealthUnavailable, err.Error())
+			return
+		}
+		response.Body.Close()
+		if response.StatusCode == http.StatusNotFound {
+			missing = append(missing, index)
+		}
+	}
+	if len(missing) > 0 {
+		readiness.add("indexes", HealthUnavailable, "missing "+strings.Join(missing, ", "))
+		return
+	}
+	readiness.add("indexes", HealthOK, "")
+}
+
+// handleLiveness answers as long as the process is serving requests.
+func handleLiveness(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, map[string]string{"status": HealthOK})
+}
+
+// handleReadiness answers 503 when any check is unavailable.
+func (h *HealthChecker) handleReadiness(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), HealthCheckTimeout)
+	defer cancel()
+	readiness := h.Ready(ctx)
+	status := http.StatusOK
+	if readiness.Status == HealthUnavailable {
+		status = http.StatusServiceUnavailable
+	}
+	writeHealth(w, status, readiness)
+}
+
+func writeHealth(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/lib/pq"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const JSONMappingObject = "object"
+const JSONMappingFlattened = "flattened"
+
+// textMapping returns the mapping inferred for text columns: full-text search
+// on the field and exact matches and sorting on field.keyword. Each call
+// returns a new map, so that changing one field's mapping leaves the others
+// alone.
+func textMapping() map[string]interface{} {
+	return map[string]interface{}{
+		"type": "text",
+		"fields": map[string]interface{}{
+			"keyword": map[string]interface{}{"type": "keyword", "ignore_above": 256},
+		},
+	}
+}
+
+// postgresTypeMappings maps Postgres types, by their udt_name in
+// information_schema.columns, to Elasticsearch field types. json and jsonb
+// columns, and text columns, are handled separately.
+var postgresTypeMappings = map[string]string{
+	"int2":        "integer",
+	"int4":        "integer",
+	"int8":        "long",
+	"float4":      "float",
+	"float8":      "double",
+	"numeric":     "double",
+	"bool":        "boolean",
+	"date":        "date",
+	"timestamp":   "date",
+	"timestamptz": "date",
+	"uuid":        "keyword",
+	"inet":        "ip",
+	"bytea":       "binary",
+}
+
+var postgresTextTypes = map[string]bool{"text": true, "varchar": true, "bpchar": true, "citext": true, "name": true}
+
+// runInferMappings generates index definitions for the schema's indexes from
+// the column types Postgres reports, and prints them, writes them to a
+// directory, or prints how they differ from the live index mappings.
+func runInferMappings(args []string) {
+	flags := flag.NewFlagSet(CommandInferMappings, flag.ExitOnError)
+	schemaPath := flags.String("schema", "", "path to a YAML or JSON table-to-index mapping (defaults to the embedded schema.yaml)")
+	tables := flags.String("tables", "", "comma-separated tables to infer mappings for (defaults to every table in the schema)")
+	jsonMode := flags.String("json", JSONMappingObject, "mapping for json and jsonb columns: object or flattened")
+	out := flags.String("out", "", "write each definition to <dir>/<index>.json instead of printing it")
+	diff := flags.Bool("diff", false, "print how the inferred mappings differ from the live index mappings")
+	flags.Parse(args)
+
+	if *jsonMode != JSONMappingObject && *jsonMode != JSONMappingFlattened {
+		log.Fatalf("Unknown -json mode %q, expected %s or %s", *jsonMode, JSONMappingObject, JSONMappingFlattened)
+	}
+	schema, err := loadSchema(*schemaPath)
+	if err != nil {
+		log.Fatalf("Error loading schema: %v", err)
+	}
+	db, err := sql.Open("postgres", PostgresURL)
+	if err != nil {
+		log.Fatalf("Error connecting to Postgres: %v", err)
+	}
+	defer db.Close()
+	current, err := loadIndexDefinitions()
+	if err != nil {
+		log.Fatalf("Error loading index mappings: %v", err)
+	}
+
+	columnTypes, err := loadColumnTypes(db, schema)
+	if err != nil {
+		log.Fatalf("Error reading column types: %v", err)
+	}
+	inferrer := &mappingInferrer{schema: schema, columnTypes: columnTypes, jsonMode: *jsonMode}
+
+	selected := make(map[string]bool)
+	for _, name := range strings.Split(*tables, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			selected[name] = true
+		}
+	}
+
+	var esClient *elasticsearch.TypedClient
+	if *diff {
+		esClient, err = elasticsearch.NewTypedClient(elasticsearch.Config{Addresses: []string{ElastisearchURL}})
+		if err != nil {
+			log.Fatalf("Error creating Elasticsearch client: %v", err)
+		}
+	}
+
+	for i := range schema.Tables {
+		table := &schema.Tables[i]
+		if len(selected) > 0 && !selected[table.Name] {
+			continue
+		}
+		definition := inferrer.Definition(table, current[table.Index])
+
+		switch {
+		case *diff:
+			differences, err := diffLiveMapping(esClient, table.Index, definition)
+			if err != nil {
+				log.Fatalf("Error comparing %s: %v", table.Index, err)
+			}
+			fmt.Printf("%s: %d differences\n", table.Index, len(differences))
+			for _, difference := range differences {
+				fmt.Printf("  %s\n", difference)
+			}
+		case *out != "":
+			data, err := json.MarshalIndent(definition, "", "  ")
+			if err != nil {
+				log.Fatalf("Error encoding mapping of %s: %v", table.Index, err)
+			}
+			path := filepath.Join(*out, table.Index+".json")
+			if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+				log.Fatalf("Error writing %s: %v", path, err)
+			}
+			log.Printf("Wrote %s (version %d)", path, definition.Version)
+		default:
+			data, err := json.MarshalIndent(map[string]*IndexDefinition{table.Index: definition}, "", "  ")
+			if err != nil {
+				log.Fatalf("Error encoding mapping of %s: %v", table.Index, err)
+			}
+			fmt.Println(string(data))
+		}
+	}
+}
+
+// columnType is a column's type as information_schema.columns reports it.
+// Arrays have the data type ARRAY and the element type's udt_name prefixed
+// with an underscore.
+type columnType struct {
+	DataType string
+	UDTName  string
+}
+
+// loadColumnTypes reads the types of every column of the schema's entity and
+// relationship tables, by table and column.
+func loadColumnTypes(db *sql.DB, schema *Schema) (map[string]map[string]columnType, error) {
+	var tables []string
+	for _, table := range schema.Tables {
+		tables = append(tables, table.Name)
+	}
+	for _, relationship := range schema.Relationships {
+		tables = append(tables, relationship.Table)
+	}
+
+	rows, err := db.Query(`SELECT table_name, column_name, data_type, udt_name
+		FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = ANY($1)`, pq.Array(tables))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	types := make(map[string]map[string]columnType)
+	for rows.Next() {
+		var table, column string
+		var found columnType
+		if err := rows.Scan(&table, &column, &found.DataType, &found.UDTName); err != nil {
+			return nil, err
+		}
+		if types[table] == nil {
+			types[table] = make(map[string]columnType)
+		}
+		types[table][column] = found
+	}
+	return types, rows.Err()
+}
+
+// mappingInferrer builds index definitions from Postgres column types.
+type mappingInferrer struct {
+	schema      *Schema
+	columnTypes map[string]map[string]columnType
+	jsonMode    string
+}
+
+// Definition returns the definition inferred for table's index. Settings,
+// such as analyzers, are kept from current, the definition the consumer
+// ships, whose version is bumped when the inferred mappings differ from it.
+func (m *mappingInferrer) Definition(table *TableConfig, current *IndexDefinition) *IndexDefinition {
+	definition := &IndexDefinition{
+		Version:  1,
+		Mappings: map[string]interface{}{"properties": m.properties(table)},
+	}
+	if current != nil {
+		definition.Settings = current.Settings
+		definition.Version = current.Version
+		if !reflect.DeepEqual(canonicalJSON(current.Mappings), canonicalJSON(definition.Mappings)) {
+			definition.Version++
+		}
+	}
+	return definition
+}
+
+// properties infers the fields of table's documents: its columns, the
+// soft-delete field, and the link arrays and embedded summaries that
+// relationships keep on its index. A column's mapping in the schema
+// overrides the inferred one.
+func (m *mappingInferrer) properties(table *TableConfig) map[string]interface{} {
+	properties := m.columnProperties(table)
+	if table.SoftDelete.Hides() {
+		properties[table.SoftDelete.Field] = map[string]interface{}{"type": "boolean"}
+	}
+	if len(m.schema.SourceNames()) > 0 && m.schema.Sources.Routing == SourceRoutingShared {
+		properties[SourceField] = map[string]interface{}{"type": "keyword"}
+	}
+
+	for i := range m.schema.Relationships {
+		relationship := &m.schema.Relationships[i]
+		for _, sides := range [][2]RelationshipSide{{relationship.Left, relationship.Right}, {relationship.Right, relationship.Left}} {
+			own, other := sides[0], sides[1]
+			if own.Index != table.Index || own.Field == "" {
+				continue
+			}
+			idMapping := m.columnMapping(relationship.Table, other.Column)
+			properties[own.Field] = idMapping
+			if own.Embed == nil {
+				continue
+			}
+			summary := map[string]interface{}{"id": idMapping}
+			if other.entity != nil {
+				otherProperties := m.columnProperties(other.entity)
+				for _, field := range own.Embed.Fields {
+					if mapping, ok := otherProperties[field]; ok {
+						summary[field] = mapping
+					}
+				}
+			}
+			properties[own.Embed.Field] = map[string]interface{}{"type": "nested", "properties": summary}
+		}
+	}
+	return properties
+}
+
+// columnProperties infers the fields table's columns are written to.
+func (m *mappingInferrer) columnProperties(table *TableConfig) map[string]interface{} {
+	properties := make(map[string]interface{}, len(table.Columns))
+	for _, column := range table.Columns {
+		if column.Mapping != nil {
+			properties[column.FieldName()] = column.Mapping
+			continue
+		}
+		properties[column.FieldName()] = m.columnMapping(table.Name, column.Name)
+	}
+	return properties
+}
+
+// columnMapping infers the mapping of a column from its Postgres type.
+// Arrays map to their element type, as Elasticsearch fields hold any number
+// of values. Columns Postgres does not report, and types without a mapping,
+// are mapped as keyword with a warning.
+func (m *mappingInferrer) columnMapping(tableName, columnName string) map[string]interface{} {
+	found, ok := m.columnTypes[tableName][columnName]
+	if !ok {
+		log.Printf("Column %s.%s not found in information_schema, mapping it as keyword", tableName, columnName)
+		return map[string]interface{}{"type": "keyword"}
+	}
+	udtName := found.UDTName
+	if found.DataType == "ARRAY" {
+		udtName = strings.TrimPrefix(udtName, "_")
+	}
+
+	switch {
+	case postgresTextTypes[udtName]:
+		return textMapping()
+	case udtName == "json" || udtName == "jsonb":
+		return map[string]interface{}{"type": m.jsonMode}
+	}
+	if fieldType, ok := postgresTypeMappings[udtName]; ok {
+		return map[string]interface{}{"type": fieldType}
+	}
+	log.Printf("Column %s.%s has type %s without a mapping, mapping it as keyword", tableName, columnName, udtName)
+	return map[string]interface{}{"type": "keyword"}
+}
+
+// diffLiveMapping lists how the live mapping of index differs from an
+// inferred definition, one line per field: "+" for fields only inferred,
+// "-" for fields only live, and "~" for fields mapped differently.
+func diffLiveMapping(esClient *elasticsearch.TypedClient, index string, definition *IndexDefinition) ([]string, error) {
+	current, err := getIndexes(esClient, index)
+	if err != nil {
+		return nil, err
+	}
+	live := map[string]interface{}{}
+	for _, state := range current {
+		live, _ = state.Mappings["properties"].(map[string]interface{})
+		break
+	}
+	inferred, _ := canonicalJSON(definition.Mappings).(map[string]interface{})
+	inferredProperties, _ := inferred["properties"].(map[string]interface{})
+	return propertyDiff("", live, inferredProperties), nil
+}
+
+func propertyDiff(prefix string, live, inferred map[string]interface{}) []string {
+	names := make(map[string]bool, len(live)+len(inferred))
+	for name := range live {
+		names[name] = true
+	}
+	for name := range inferred {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	var differences []string
+	for _, name := range sorted {
+		field := prefix + name
+		liveField, inLive := live[name].(map[string]interface{})
+		inferredField, inInferred := inferred[name].(map[string]interface{})
+		switch {
+		case !inLive:
+			differences = append(differences, fmt.Sprintf("+ %s %s", field, encodeMapping(inferredField)))
+		case !inInferred:
+			differences = append(differences, fmt.Sprintf("- %s %s", field, encodeMapping(liveField)))
+		default:
+			liveOwn, inferredOwn := ownParameters(liveField), ownParameters(inferredField)
+			if !reflect.DeepEqual(liveOwn, inferredOwn) {
+				differences = append(differences, fmt.Sprintf("~ %s %s -> %s", field, encodeMapping(liveOwn), encodeMapping(inferredOwn)))
+			}
+			for _, nested := range []string{"properties", "fields"} {
+				liveNested, _ := liveField[nested].(map[string]interface{})
+				inferredNested, _ := inferredField[nested].(map[string]interface{})
+				differences = append(differences, propertyDiff(field+".", liveNested, inferredNested)...)
+			}
+		}
+	}
+	return differences
+}
+
+// ownParameters returns a field's mapping without its sub-fields and
+// properties, which are compared on their own, and with the type
+// Elasticsearch leaves out for objects.
+func ownParameters(field map[string]interface{}) map[string]interface{} {
+	own := make(map[string]interface{}, len(field))
+	for key, value := range field {
+		if key != "properties" && key != "fields" {
+			own[key] = value
+		}
+	}
+	own["type"] = fieldType(field)
+	return own
+}
+
+// canonicalJSON renders a value the way it decodes from JSON, so that
+// mappings and documents built in Go compare equal to those read from files
+// or from Elasticsearch.
+func canonicalJSON(value interface{}) interface{} {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return value
+	}
+	var canonical interface{}
+	if err := json.Unmarshal(data, &canonical); err != nil {
+		return value
+	}
+	return canonical
+}
+
+func encodeMapping(mapping map[string]interface{}) string {
+	data, err := json.Marshal(mapping)
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"time"
+)
+
+// unrecoverableKafkaErrors are errors librdkafka keeps retrying but that no
+// retry can fix, such as missing credentials or permissions. The consumer
+// stops on them, as it does on errors librdkafka reports as fatal.
+var unrecoverableKafkaErrors = map[kafka.ErrorCode]bool{
+	kafka.ErrAuthentication:             true,
+	kafka.ErrSaslAuthenticationFailed:   true,
+	kafka.ErrUnsupportedSaslMechanism:   true,
+	kafka.ErrTopicAuthorizationFailed:   true,
+	kafka.ErrGroupAuthorizationFailed:   true,
+	kafka.ErrClusterAuthorizationFailed: true,
+}
+
+// isFatalKafkaError reports whether the consumer must stop on err. Any other
+// error, such as a transport failure or all brokers being down, is transient:
+// librdkafka reconnects by itself and the consumer keeps polling.
+func isFatalKafkaError(err kafka.Error) bool {
+	return err.IsFatal() || unrecoverableKafkaErrors[err.Code()]
+}
+
+// kafkaBackoff spaces out polls while Kafka keeps returning transient
+// errors, doubling the wait after each error up to MaxKafkaErrorBackoff.
+type kafkaBackoff struct {
+	failures int
+}
+
+// Next returns how long to wait after another error.
+func (b *kafkaBackoff) Next() time.Duration {
+	wait := KafkaErrorBackoff << b.failures
+	if wait > MaxKafkaErrorBackoff || wait <= 0 {
+		wait = MaxKafkaErrorBackoff
+	} else {
+		b.failures++
+	}
+	return wait
+}
+
+// Reset starts over once Kafka delivers messages again.
+func (b *kafkaBackoff) Reset() {
+	b.failures = 0
+}
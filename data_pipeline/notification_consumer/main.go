@@ -12,64 +12,129 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"github.com/confluentinc/confluent-kafka-go/kafka"
 	"github.com/elastic/go-elasticsearch/v8"
 	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"github.com/elastic/go-elasticsearch/v8/typedapi/types"
+	"github.com/elastic/go-elasticsearch/v8/typedapi/types/enums/versiontype"
 	_ "github.com/lib/pq"
+	"io"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"reflect"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 )
 
 type Notification struct {
+	Source    string                 `json:"source,omitempty"` // database it comes from, when not PostgresURL
 	Table     string                 `json:"table"`
 	Operation string                 `json:"operation"`
-	Data      map[string]interface{} `json:"data"`
+	Version   int64                  `json:"version,omitempty"`
+	TxID      int64                  `json:"txid,omitempty"`
+	Count     int                    `json:"count,omitempty"` // changes in the transaction, on COMMIT markers
+	Data      map[string]interface{} `json:"data,omitempty"`
+	Old       map[string]interface{} `json:"old,omitempty"` // previous row image, on updates
 }
 
-type UserProject struct {
-	ProjectID int `json:"project_id"`
-	UserID    int `json:"user_id"`
+// UnmarshalJSON decodes a notification and completes its previous row image.
+// The triggers only send the previous values of the columns an update
+// changed; every other column has the value it has in Data.
+func (n *Notification) UnmarshalJSON(data []byte) error {
+	type notification Notification
+	if err := json.Unmarshal(data, (*notification)(n)); err != nil {
+		return err
+	}
+	if n.Old != nil {
+		old := make(map[string]interface{}, len(n.Data))
+		for column, value := range n.Data {
+			old[column] = value
+		}
+		for column, value := range n.Old {
+			old[column] = value
+		}
+		n.Old = old
+	}
+	return nil
 }
 
-type ProjectHashtag struct {
-	HashtagID int `json:"hashtag_id"`
-	ProjectID int `json:"project_id"`
-}
+const CommandConsume = "consume"
+const CommandReindex = "reindex"
+const CommandVerify = "verify"
+const CommandMigrate = "migrate"
+const CommandReplay = "replay"
+const CommandRebuild = "rebuild"
+const CommandInferMappings = "infer-mappings"
 
-type User struct {
-	ID         int    `json:"id"`
-	Name       string `json:"name"`
-	CreatedAt  string `json:"created_at"`
-	ProjectIds []int  `json:"project_ids"`
-}
+func main() {
+	// The first argument selects a command; without one the consumer runs
+	command := CommandConsume
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
 
-// Hashtag represents a hashtag entity.
-type Hashtag struct {
-	ID         int    `json:"id"`
-	Name       string `json:"name"`
-	CreatedAt  string `json:"created_at"`
-	ProjectIds []int  `json:"project_ids"`
+	switch command {
+	case CommandConsume:
+		runConsumer(args)
+	case CommandReindex:
+		runReindex(args)
+	case CommandVerify:
+		runVerify(args)
+	case CommandMigrate:
+		runMigrate(args)
+	case CommandReplay:
+		runReplay(args)
+	case CommandRebuild:
+		runRebuild(args)
+	case CommandInferMappings:
+		runInferMappings(args)
+	default:
+		log.Fatalf("Unknown command %q, expected one of: %s, %s, %s, %s, %s, %s, %s", command, CommandConsume, CommandReindex, CommandVerify, CommandMigrate, CommandReplay, CommandRebuild, CommandInferMappings)
+	}
 }
 
-type Project struct {
-	ID          int    `json:"id"`
-	Name        string `json:"name"`
-	Slug        string `json:"slug"`
-	Description string `json:"description"`
-	CreatedAt   string `json:"created_at"`
-	HashtagIds  []int  `json:"hashtag_ids"`
-	UserIds     []int  `json:"user_ids"`
-}
+func runConsumer(args []string) {
+	flags := flag.NewFlagSet(CommandConsume, flag.ExitOnError)
+	schemaPath := flags.String("schema", "", "path to a YAML or JSON table-to-index mapping (defaults to the embedded schema.yaml)")
+	maxTransactionChanges := flags.Int("max-transaction-changes", TransactionMaxChanges, "changes buffered per transaction before it is applied in chunks of this size (0 for no limit)")
+	stateTopic := flags.String("state-topic", "", "also publish the latest state of every row to this log-compacted topic, for rebuild")
+	shadowMappings := flags.String("shadow-mappings", "", "directory of <index>.json definitions; each index with one is also written to a shadow index named <index>"+ShadowIndexSuffix)
+	dryRun := flags.Bool("dry-run", false, "write nothing: consume as group "+ConsumerGroup+DryRunGroupSuffix+" and print the field-level diff each write would cause")
+	diffOut := flags.String("diff-out", "", "with -dry-run, record the diffs in this file as JSON lines instead of printing them")
+	flags.Parse(args)
+	if *dryRun && (*stateTopic != "" || *shadowMappings != "") {
+		log.Fatalf("-state-topic and -shadow-mappings write, and cannot be used with -dry-run")
+	}
+
+	schema, err := loadSchema(*schemaPath)
+	if err == nil && *stateTopic != "" {
+		err = schema.singleSource("-state-topic")
+	}
+	if err != nil {
+		log.Fatalf("Error loading schema: %v", err)
+	}
+
+	// A dry run reads with a group of its own, leaving the live consumer's
+	// offsets alone
+	group := ConsumerGroup
+	if *dryRun {
+		group += DryRunGroupSuffix
+	}
 
-func main() {
 	// Set up Kafka consumer configuration
 	consumerConfig := kafka.ConfigMap{
 		"bootstrap.servers": BootstrapServer,
-		"group.id":          ConsumerGroup, //TODO: fetch it from config
+		"group.id":          group, //TODO: fetch it from config
 		"auto.offset.reset": "earliest",
+		// Offsets are committed by the worker pool once messages are processed
+		"enable.auto.commit": false,
 	}
 
 	// Set up Elasticsearch client configuration
@@ -89,12 +154,30 @@ func main() {
 		panic(err)
 	}
 	defer db.Close()
+	if err := schema.OpenSources(); err != nil {
+		log.Fatalf("Error connecting to Postgres: %v", err)
+	}
+	defer schema.CloseSources()
 
-	// Subscribe to Kafka topic
-	log.Println("topic subscribed")
-	err = consumer.SubscribeTopics([]string{KafkaTopic}, nil)
-	if err != nil {
-		log.Fatalf("Error subscribing to Kafka topic: %v", err)
+	// Create dead-letter producer for rows that cannot be processed; a dry run
+	// only logs them
+	var deadLetters *DeadLetterQueue
+	if !*dryRun {
+		deadLetters, err = newDeadLetterQueue(BootstrapServer, DeadLetterTopic)
+		if err != nil {
+			log.Fatalf("Error creating dead-letter producer: %v", err)
+		}
+		defer deadLetters.Close()
+	}
+
+	// Optionally keep the latest state of every row in a compacted topic
+	var stateLog *StateLog
+	if *stateTopic != "" {
+		stateLog, err = newStateLog(BootstrapServer, *stateTopic)
+		if err != nil {
+			log.Fatalf("Error creating state producer: %v", err)
+		}
+		defer stateLog.Close()
 	}
 
 	// Create Elasticsearch client
@@ -102,10 +185,72 @@ func main() {
 	if err != nil {
 		log.Fatalf("Error creating Elasticsearch client: %v", err)
 	}
+
+	// Record the columns change events carry, to notice schema changes
+	if !*dryRun {
+		schema.tracker, err = newSchemaTracker(esClient, SchemaVersionIndex)
+		if err != nil {
+			log.Fatalf("Error loading schema versions: %v", err)
+		}
+	}
+
+	// Serve metrics and health from the start, so a long index migration does
+	// not fail the liveness probe
+	go serveMetrics(MetricsAddr, newHealthChecker(consumer, db, esClient, schema))
+
+	// Create missing indexes and migrate outdated mappings before consuming
+	if !*dryRun {
+		if err := ensureIndexes(schema, db, esClient); err != nil {
+			log.Fatalf("Error preparing Elasticsearch indexes: %v", err)
+		}
+	}
+	// Optionally dual-write to shadow indexes with experimental mappings
+	var shadowed map[string]bool
+	if *shadowMappings != "" {
+		shadowed, err = ensureShadowIndexes(schema, esClient, *shadowMappings)
+		if err != nil {
+			log.Fatalf("Error preparing shadow indexes: %v", err)
+		}
+	}
 	// Create signal channel for graceful shutdown
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
+	// Process messages on a worker pool, keyed by the document they change
+	pool := newWorkerPool(WorkerCount, WorkerQueueSize)
+
+	transactions := newTransactionBuffer(*maxTransactionChanges)
+	// Subscribe to Kafka topic, committing what was processed whenever
+	// partitions are taken away
+	log.Println("topic subscribed")
+	err = consumer.SubscribeTopics([]string{KafkaTopic}, rebalanceHandler(pool, transactions))
+	if err != nil {
+		log.Fatalf("Error subscribing to Kafka topic: %v", err)
+	}
+	// Elasticsearch writes adapt to rejections; while they are being rejected
+	// the partitions are paused
+	throttle := newThrottle(WorkerCount, MinBulkActions, MaxBulkActions)
+	primary := newElasticsearchWriter(esClient, throttle)
+	var writer LiveWriter = primary
+	if len(shadowed) > 0 {
+		writer = newShadowWriter(primary, esClient, shadowed)
+	}
+	if *dryRun {
+		var out io.Writer = os.Stdout
+		if *diffOut != "" {
+			file, err := os.Create(*diffOut)
+			if err != nil {
+				log.Fatalf("Error creating diff file: %v", err)
+			}
+			defer file.Close()
+			out = file
+		}
+		writer = newDiffWriter(esClient, out, *diffOut != "")
+	}
+	paused := false
+	lastCommit := time.Now()
+	var backoff kafkaBackoff
+
 	// Consume Kafka messages
 	run := true
 	for run {
@@ -114,142 +259,361 @@ func main() {
 			fmt.Printf("Caught signal %v: terminating\n", sig)
 			run = false
 		default:
-			ev := consumer.Poll(10000)
+			paused = pauseWhileThrottled(consumer, throttle, paused)
+			pollTimeout := 10000
+			if paused {
+				// Wake up often enough to resume soon after the cooldown
+				pollTimeout = 1000
+			}
+			ev := consumer.Poll(pollTimeout)
+			if time.Since(lastCommit) >= CommitInterval {
+				for _, transaction := range transactions.Expired(TransactionTimeout) {
+					log.Printf("Transaction %d is still incomplete after %v, applying the %d changes received", transaction.TxID, TransactionTimeout, len(transaction.Changes))
+					submitTransaction(pool, transaction, schema, db, writer, deadLetters, stateLog)
+				}
+				commitProcessedOffsets(consumer, pool)
+				lastCommit = time.Now()
+			}
 			if ev == nil {
 				continue
 			}
 			switch e := ev.(type) {
 			case *kafka.Message:
 				log.Println("kafka_message_received", string(e.Value))
-				var notification Notification
-				err = json.Unmarshal(e.Value, &notification)
-				if err != nil {
-					log.Printf("Error decoding JSON: %v", err)
-					continue
-				}
-				processNotification(notification, db, esClient)
+				backoff.Reset()
+				submitMessage(pool, transactions, e, schema, db, writer, deadLetters, stateLog)
 			case kafka.Error:
-				// Handle Kafka error
-				log.Println("kafka_error")
-				run = false
-				break
+				fatal := isFatalKafkaError(e)
+				kafkaErrors.WithLabelValues(e.Code().String(), strconv.FormatBool(fatal)).Inc()
+				if fatal {
+					log.Printf("kafka_error: fatal %v, terminating", e)
+					run = false
+					break
+				}
+				// librdkafka reconnects by itself; poll less often meanwhile
+				wait := backoff.Next()
+				log.Printf("kafka_error: %v (%s), polling again in %v", e, e.Code(), wait)
+				select {
+				case sig := <-sigChan:
+					fmt.Printf("Caught signal %v: terminating\n", sig)
+					run = false
+				case <-time.After(wait):
+				}
 			default:
 				// Ignore other event types
 				log.Printf("Ignored event: %v\n", e)
 			}
 		}
 	}
+
+	// Let in-flight messages finish before committing for the last time.
+	// Incomplete transactions stay uncommitted and are read again on restart.
+	pool.Close()
+	commitProcessedOffsets(consumer, pool)
 }
 
-func processNotification(notification Notification, db *sql.DB, client *elasticsearch.TypedClient) {
-	switch notification.Table {
-	case TableUserProjects:
-		processUserProjectNotification(notification, client)
-	case TableProjectHashtags:
-		processProjectHashtagNotification(notification, client)
-	case TableUsers:
-		processUserNotification(notification, client)
-	case TableHashtags:
-		processHashtagNotification(notification, client)
-	case TableProjects:
-		processProjectNotification(notification, client)
-	default:
-		log.Printf("Unhandled table: %s", notification.Table)
+// submitMessage decodes a Kafka message and queues its processing on the
+// worker that owns the document it changes. Changes that belong to a
+// transaction are held until the whole transaction has arrived.
+func submitMessage(pool *WorkerPool, transactions *transactionBuffer, message *kafka.Message, schema *Schema, db *sql.DB, writer LiveWriter, deadLetters *DeadLetterQueue, stateLog *StateLog) {
+	var notification Notification
+	if err := json.Unmarshal(message.Value, &notification); err != nil {
+		log.Printf("Error decoding JSON: %v", err)
+		pool.Submit(string(message.Key), message.TopicPartition, func() bool {
+			return sendDeadLetter(deadLetters, message, "", err)
+		})
+		return
 	}
+	if notification.TxID != 0 {
+		pool.Hold(message.TopicPartition)
+		if transaction := transactions.Add(message, notification); transaction != nil {
+			submitTransaction(pool, transaction, schema, db, writer, deadLetters, stateLog)
+		}
+		return
+	}
+	// Changes from triggers that predate transaction markers
+	pool.Submit(orderingKey(notification, schema), message.TopicPartition, func() bool {
+		result := ResultProcessed
+		if err := processNotification(notification, schema, db, writer); err != nil {
+			log.Printf("Error processing notification: %v", err)
+			if !sendDeadLetter(deadLetters, message, notification.Table, err) {
+				return false
+			}
+			result = ResultDeadLettered
+		} else {
+			stateLog.Record(notification, schema)
+		}
+		messagesProcessed.WithLabelValues(notification.Table, notification.Operation, result).Inc()
+		return true
+	})
 }
 
-func processUserNotification(notification Notification, client *elasticsearch.TypedClient) {
-	var user User
-	user.ID = int(notification.Data["id"].(float64))
-	user.Name = notification.Data["name"].(string)
-	user.CreatedAt = notification.Data["created_at"].(string)
-	// Update Elasticsearch index
-	updateElasticsearchIndex(notification.Operation, client, IndexUsers, fmt.Sprintf("%v", user.ID), user)
+// sendDeadLetter dead-letters a message that failed with reason and reports
+// whether it was delivered. When it was not, the message's task returns
+// false so that its offset stays uncommitted.
+func sendDeadLetter(deadLetters *DeadLetterQueue, message *kafka.Message, table string, reason error) bool {
+	if err := deadLetters.Send(message, reason); err != nil {
+		log.Printf("Error dead-lettering message, holding its offset: %v", err)
+		return false
+	}
+	deadLettered.WithLabelValues(table).Inc()
+	return true
 }
 
-func processHashtagNotification(notification Notification, client *elasticsearch.TypedClient) {
-	var hashtag Hashtag
-	hashtag.ID = int(notification.Data["id"].(float64))
-	hashtag.Name = notification.Data["name"].(string)
-	hashtag.CreatedAt = notification.Data["created_at"].(string)
+// orderingKey names the document a change event writes to. Events with the
+// same key are applied in order.
+func orderingKey(notification Notification, schema *Schema) string {
+	return sourceKey(notification.Source, rowOrderingKey(notification.Table, notification.Data, schema))
+}
 
-	// Update Elasticsearch index
-	updateElasticsearchIndex(notification.Operation, client, IndexHashtags, fmt.Sprintf("%v", hashtag.ID), hashtag)
+// orderingKeys returns the ordering key of a change event and, for an update
+// that moved a row to another key, the key of the old row image, so that the
+// move is ordered with the changes under both.
+func orderingKeys(notification Notification, schema *Schema) []string {
+	keys := []string{orderingKey(notification, schema)}
+	if notification.Old != nil {
+		if oldKey := sourceKey(notification.Source, rowOrderingKey(notification.Table, notification.Old, schema)); oldKey != keys[0] {
+			keys = append(keys, oldKey)
+		}
+	}
+	return keys
 }
 
-func processProjectNotification(notification Notification, client *elasticsearch.TypedClient) {
-	var project Project
-	project.ID = int(notification.Data["id"].(float64))
-	project.Name = notification.Data["name"].(string)
-	project.Slug = notification.Data["slug"].(string)
-	project.Description = notification.Data["description"].(string)
-	project.CreatedAt = notification.Data["created_at"].(string)
+func rowOrderingKey(tableName string, row map[string]interface{}, schema *Schema) string {
+	if table, ok := schema.Table(tableName); ok {
+		if id, ok := documentIDFromValue(row[table.PrimaryKey]); ok {
+			return table.Index + ":" + id
+		}
+	}
+	for _, relationship := range schema.RelationshipsFor(tableName) {
+		leftID, _ := documentIDFromValue(row[relationship.Left.Column])
+		rightID, _ := documentIDFromValue(row[relationship.Right.Column])
+		return relationship.Table + ":" + leftID + ":" + rightID
+	}
+	return tableName
+}
 
-	// Update Elasticsearch index
-	updateElasticsearchIndex(notification.Operation, client, IndexProjects, fmt.Sprintf("%v", project.ID), project)
+// pauseWhileThrottled pauses every assigned partition while Elasticsearch is
+// rejecting writes and resumes them once it has accepted writes for the
+// cooldown, returning whether consumption is now paused. Partitions are
+// paused again on every call, so partitions assigned meanwhile are paused
+// too.
+func pauseWhileThrottled(consumer *kafka.Consumer, throttle *Throttle, paused bool) bool {
+	throttled := throttle.Throttled()
+	if !throttled && !paused {
+		return false
+	}
+	assignment, err := consumer.Assignment()
+	if err != nil {
+		log.Printf("Error reading partition assignment: %v", err)
+		return paused
+	}
+	if throttled {
+		if err := consumer.Pause(assignment); err != nil {
+			log.Printf("Error pausing partitions: %v", err)
+			return paused
+		}
+		if !paused {
+			log.Printf("Elasticsearch is rejecting writes, pausing %d partitions", len(assignment))
+			consumptionPaused.Set(1)
+		}
+		return true
+	}
+	if err := consumer.Resume(assignment); err != nil {
+		log.Printf("Error resuming partitions: %v", err)
+		return paused
+	}
+	log.Printf("Elasticsearch is accepting writes again, resuming %d partitions", len(assignment))
+	consumptionPaused.Set(0)
+	return false
 }
 
-func processUserProjectNotification(notification Notification, client *elasticsearch.TypedClient) {
-	var userProject UserProject
-	userProject.UserID = int(notification.Data["user_id"].(float64))
-	userProject.ProjectID = int(notification.Data["project_id"].(float64))
+// commitProcessedOffsets commits, per partition, the offset below which every
+// message has been processed, and records how far behind that is.
+func commitProcessedOffsets(consumer *kafka.Consumer, pool *WorkerPool) {
+	offsets := pool.Committable()
+	if len(offsets) == 0 {
+		return
+	}
+	if _, err := consumer.CommitOffsets(offsets); err != nil {
+		log.Printf("Error committing offsets: %v", err)
+	}
+	for _, offset := range offsets {
+		// Watermarks are cached from fetch responses, so this does not block
+		_, high, err := consumer.GetWatermarkOffsets(*offset.Topic, offset.Partition)
+		if err == nil && high >= 0 {
+			recordLag(*offset.Topic, offset.Partition, high-int64(offset.Offset))
+		}
+	}
+}
 
-	operation := notification.Operation
-	// Update or delete the Elasticsearch User Index based on the operation
-	updateUserProjectIndex(userProject, operation, client)
+// processNotification applies a change event to every index the schema maps
+// its table to. Rows that cannot be decoded are returned as an error without
+// touching Elasticsearch, so that the caller can dead-letter them, and so are
+// failed document and link writes.
+func processNotification(notification Notification, schema *Schema, db *sql.DB, writer DocumentWriter) error {
+	// COMMIT markers only delimit transactions
+	if notification.Operation == OperationCommit {
+		return nil
+	}
+	table, isEntity := schema.Table(notification.Table)
+	relationships := schema.RelationshipsFor(notification.Table)
+	if !isEntity && len(relationships) == 0 {
+		log.Printf("Unhandled table: %s", notification.Table)
+		return nil
+	}
+	db, writer, err := schema.routeSource(notification.Source, db, writer)
+	if err != nil {
+		return err
+	}
+	if isNoopUpdate(notification, schema) {
+		skippedUpdates.WithLabelValues(notification.Table).Inc()
+		return nil
+	}
+	if isEntity {
+		schema.tracker.Observe(table, notification.Data)
+	}
+
+	// Decode everything up front so a bad row is not half applied
+	var document map[string]interface{}
+	var documentID string
+	if isEntity {
+		var err error
+		document, documentID, err = decodeDocument(table, notification.Data)
+		if err != nil {
+			return err
+		}
+		if notification.Operation != OperationDelete {
+			keep, err := applyTransformers(table, notification.Operation, notification.Data, document)
+			if err != nil {
+				return err
+			}
+			if !keep {
+				log.Printf("Skipped %s of %s %s: dropped by a transformer", notification.Operation, notification.Table, documentID)
+				return nil
+			}
+		}
+	}
+	links := make([][2]interface{}, len(relationships))
+	oldLinks := make([]*[2]interface{}, len(relationships))
+	for i, relationship := range relationships {
+		leftID, rightID, err := decodeRelationshipIDs(relationship, notification.Data)
+		if err != nil {
+			return err
+		}
+		links[i] = [2]interface{}{leftID, rightID}
+		if notification.Operation == OperationUpdate && notification.Old != nil {
+			oldLeftID, oldRightID, err := decodeRelationshipIDs(relationship, notification.Old)
+			if err != nil {
+				return err
+			}
+			oldLinks[i] = &[2]interface{}{oldLeftID, oldRightID}
+		}
+	}
+
+	if isEntity {
+		// A soft-deleted row is written as a delete, or as a hidden document
+		operation := notification.Operation
+		deleted := operation != OperationDelete && table.SoftDelete.IsDeleted(notification.Data)
+		if deleted && !table.SoftDelete.Hides() {
+			operation = OperationDelete
+		}
+		if operation != OperationDelete {
+			markSoftDeleted(table, notification.Data, document)
+			// Indexing replaces the whole document, so carry the relationship
+			// arrays over from Postgres rather than wiping them
+			documents := map[string]map[string]interface{}{documentID: document}
+			if err := attachRelationshipArrays(db, schema, table, documents, documentID, documentID); err != nil {
+				log.Printf("Error loading relationships of %s %s: %v", table.Name, documentID, err)
+			}
+		}
+		// An update that changed the primary key moves the document
+		if oldID, moved := movedDocumentID(table, notification, documentID); moved {
+			if err := writer.Apply(OperationDelete, table.Index, oldID, nil, notification.Version); err != nil {
+				return err
+			}
+		}
+		// Update Elasticsearch index
+		if err := writer.Apply(operation, table.Index, documentID, document, notification.Version); err != nil {
+			return err
+		}
+		if notification.Operation == OperationUpdate && operation != OperationDelete {
+			fanOutSummaries(schema, table, notification, document, writer)
+		}
+
+		// Links are brought in line when the row was just deleted or
+		// restored. Without the previous row image that cannot be told, so
+		// it is done on every update; adding and removing links are both
+		// idempotent.
+		softDeleteChanged := notification.Old == nil || table.SoftDelete.IsDeleted(notification.Old) != deleted
+		if table.SoftDelete != nil && notification.Operation == OperationUpdate && softDeleteChanged {
+			if err := syncSoftDeletedLinks(db, schema, table, documentID, deleted, notification.Version, writer); err != nil {
+				return fmt.Errorf("updating links of %s %s: %w", table.Name, documentID, err)
+			}
+		}
+	}
+	for i, relationship := range relationships {
+		if notification.Operation == OperationDelete {
+			if err := updateRelationshipIndexes(relationship, OperationDelete, links[i][0], links[i][1], notification.Version, db, writer); err != nil {
+				return err
+			}
+			continue
+		}
+		// An update first removes the link the old row made, if it moved to
+		// other documents or was soft-deleted
+		live := !relationship.SoftDelete.IsDeleted(notification.Data)
+		if oldLinks[i] != nil && !relationship.SoftDelete.IsDeleted(notification.Old) {
+			moved := !reflect.DeepEqual(*oldLinks[i], links[i])
+			if moved || !live {
+				if err := updateRelationshipIndexes(relationship, OperationDelete, oldLinks[i][0], oldLinks[i][1], notification.Version, db, writer); err != nil {
+					return err
+				}
+			}
+		}
+		// A soft-deleted link row counts as removed, and a live one as added
+		operation := OperationInsert
+		if !live {
+			operation = OperationDelete
+		}
+		if err := updateRelationshipIndexes(relationship, operation, links[i][0], links[i][1], notification.Version, db, writer); err != nil {
+			return err
+		}
+	}
+	return nil
 }
-func updateUserProjectIndex(userProject UserProject, operation string, esClient *elasticsearch.TypedClient) {
-	indexNameUsers := IndexUsers
-	indexNameProjects := IndexProjects
-	// Define the update query based on the operation
-	var sourceScriptUsers string
-	var sourceScriptProjects string
-	switch operation {
-	case "INSERT":
-		sourceScriptUsers = "if (ctx._source.project_ids == null) { ctx._source.project_ids = [] } ctx._source.project_ids.add(params.project_id)"
-		sourceScriptProjects = "if (ctx._source.user_ids == null) { ctx._source.user_ids = [] } ctx._source.user_ids.add(params.user_id)"
 
-	case "DELETE":
-		sourceScriptUsers = "if (ctx._source.containsKey('project_ids')) { ctx._source.project_ids.remove(ctx._source.project_ids.indexOf(params.project_id)) }"
-		sourceScriptProjects = "if (ctx._source.containsKey('user_ids')) { ctx._source.user_ids.remove(ctx._source.user_ids.indexOf(params.user_id)) }"
+// movedDocumentID returns the id an updated row's document had before the
+// update, and whether the update changed it.
+func movedDocumentID(table *TableConfig, notification Notification, documentID string) (string, bool) {
+	if notification.Operation != OperationUpdate || notification.Old == nil {
+		return "", false
+	}
+	oldID, ok := documentIDFromValue(notification.Old[table.PrimaryKey])
+	return oldID, ok && oldID != documentID
+}
 
+// documentIDFromValue formats a primary key decoded from JSON as a document id.
+// JSON numbers decode to float64, which %v would print in exponent form.
+func documentIDFromValue(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case string:
+		return v, v != ""
+	case nil:
+		return "", false
 	default:
-		log.Printf("Unsupported operation: %s", operation)
-		return
+		return fmt.Sprintf("%v", v), true
 	}
+}
 
-	// Define the update query
-	queryProjects := map[string]interface{}{
-		"script": map[string]interface{}{
-			"source": sourceScriptProjects,
-			"lang":   "painless",
-			"params": map[string]int{
-				"user_id": userProject.UserID,
-			},
-		},
-	}
-
-	// Define the update query
-	queryUsers := map[string]interface{}{
-		"script": map[string]interface{}{
-			"source": sourceScriptUsers,
-			"lang":   "painless",
-			"params": map[string]int{
-				"project_id": userProject.ProjectID,
-			},
-		},
-	}
-	// Update the document in Elasticsearch
-	err := updateDocumentInElasticsearch(indexNameUsers, fmt.Sprintf("%d", userProject.UserID), queryUsers, esClient)
-	if err != nil {
-		// Handle the error as needed
-		log.Printf("Error updating document in Elasticsearch: %v", err)
-	}
-	err = updateDocumentInElasticsearch(indexNameProjects, fmt.Sprintf("%d", userProject.ProjectID), queryProjects, esClient)
-	if err != nil {
-		// Handle the error as needed
-		log.Printf("Error updating document in Elasticsearch: %v", err)
+// linkValue converts integral JSON numbers back to integers so that link
+// arrays hold the same values as the id fields of the linked documents.
+func linkValue(value interface{}) interface{} {
+	if v, ok := value.(float64); ok && v == float64(int64(v)) {
+		return int64(v)
 	}
+	return value
 }
 
 func updateDocumentInElasticsearch(indexName string, documentID string, query map[string]interface{}, esClient *elasticsearch.TypedClient) error {
@@ -260,15 +624,24 @@ func updateDocumentInElasticsearch(indexName string, documentID string, query ma
 		return err
 	}
 
-	// Define the UpdateRequest
+	// Define the UpdateRequest. Links to the same document can be updated
+	// from several workers at once, so retry on version conflicts.
+	retryOnConflict := UpdateRetryOnConflict
 	request := esapi.UpdateRequest{
-		Index:      indexName,
-		DocumentID: documentID,
-		Body:       bytes.NewReader(queryJSON),
+		Index:           indexName,
+		DocumentID:      documentID,
+		Body:            bytes.NewReader(queryJSON),
+		RetryOnConflict: &retryOnConflict,
 	}
 
 	// Perform the update request
+	start := time.Now()
 	response, err := request.Do(context.Background(), esClient)
+	failed := err
+	if err == nil && response.IsError() {
+		failed = errors.New(response.Status())
+	}
+	observeElasticsearch(RequestUpdate, start, failed)
 	if err != nil {
 		log.Printf("Error updating document. Error: %v", err)
 		return err
@@ -276,99 +649,76 @@ func updateDocumentInElasticsearch(indexName string, documentID string, query ma
 
 	defer response.Body.Close()
 
-	log.Printf("Document updated successfully. Result: %v", response)
 	if response.IsError() {
-		var b map[string]interface{}
-		if err := json.NewDecoder(response.Body).Decode(&b); err != nil {
-			log.Printf("Error parsing the response body: %v", err)
-			return err
-		}
-
-		log.Printf("Elasticsearch error: %s", b["error"].(map[string]interface{})["reason"].(string))
-		return errors.New("Elasticsearch update error")
+		statusErr := newStatusError(response)
+		log.Printf("Elasticsearch error: %v", statusErr)
+		return statusErr
 	}
 
+	log.Printf("Document updated successfully. Result: %v", response)
 	return nil
 }
 
-func processProjectHashtagNotification(notification Notification, client *elasticsearch.TypedClient) {
-	var projectHashtag ProjectHashtag
-	projectHashtag.HashtagID = int(notification.Data["hashtag_id"].(float64))
-	projectHashtag.ProjectID = int(notification.Data["project_id"].(float64))
-	operation := notification.Operation
-
-	// Update or delete the Elasticsearch Project Index based on the operation
-	updateProjectHashtagIndex(projectHashtag, operation, client)
-}
-
-func updateProjectHashtagIndex(projectHashtag ProjectHashtag, operation string, esClient *elasticsearch.TypedClient) {
-	indexNameProjects := IndexProjects
-	indexNameHashtags := IndexHashtags
-	// Define the update query based on the operation
-	var sourceScript, sourceScriptHashtags string
-	switch operation {
-	case "INSERT":
-		sourceScript = "if (ctx._source.hashtag_ids == null){ ctx._source.hashtag_ids = []} ctx._source.hashtag_ids.add(params.hashtag_id)"
-		sourceScriptHashtags = "if (ctx._source.project_ids == null){ ctx._source.project_ids = []} ctx._source.project_ids.add(params.project_id)"
-
-	case "DELETE":
-		sourceScript = "if (ctx._source.containsKey('hashtag_ids')) { ctx._source.hashtag_ids.remove(ctx._source.hashtag_ids.indexOf(params.hashtag_id)) }"
-		sourceScriptHashtags = "if (ctx._source.containsKey('project_ids')) { ctx._source.project_ids.remove(ctx._source.project_ids.indexOf(params.project_id)) }"
-
-	default:
-		log.Printf("Unsupported operation: %s", operation)
-		return
-	}
-
-	// Define the update query
-	queryProjects := map[string]interface{}{
-		"script": map[string]interface{}{
-			"source": sourceScript,
-			"lang":   "painless",
-			"params": map[string]int{
-				"hashtag_id": projectHashtag.HashtagID,
-			},
-		},
-	}
-	queryHashtags := map[string]interface{}{
-		"script": map[string]interface{}{
-			"source": sourceScriptHashtags,
-			"lang":   "painless",
-			"params": map[string]int{
-				"project_id": projectHashtag.ProjectID,
-			},
-		},
-	}
-
-	err := updateDocumentInElasticsearch(indexNameProjects, fmt.Sprintf("%d", projectHashtag.ProjectID), queryProjects, esClient)
-	if err != nil {
-		// Handle the error as needed
-		log.Printf("Error updating document in Elasticsearch: %v", err)
-	}
-	err = updateDocumentInElasticsearch(indexNameHashtags, fmt.Sprintf("%d", projectHashtag.HashtagID), queryHashtags, esClient)
-	if err != nil {
-		// Handle the error as needed
-		log.Printf("Error updating document in Elasticsearch: %v", err)
-	}
-}
-
-func updateElasticsearchIndex(operation string, client *elasticsearch.TypedClient, indexName, documentID string, data interface{}) {
+// updateElasticsearchIndex indexes or deletes a document. When the change event
+// carries a version the write uses external versioning of versionType, so
+// Elasticsearch rejects it if a newer change to the document has already been
+// applied. Version conflicts are not returned as errors.
+func updateElasticsearchIndex(operation string, client *elasticsearch.TypedClient, indexName, documentID string, data interface{}, version int64, versionType versiontype.VersionType) error {
 	switch operation {
 	case OperationInsert, OperationUpdate:
-		_, err := client.Index(indexName).Id(documentID).Document(data).Do(context.TODO())
-		if err != nil {
+		request := client.Index(indexName).Id(documentID).Document(data)
+		if version > 0 {
+			request.Version(strconv.FormatInt(version, 10)).VersionType(versionType)
+		}
+		start := time.Now()
+		_, err := request.Do(context.TODO())
+		observeElasticsearch(RequestIndex, start, ignoreVersionConflict(err))
+		if isVersionConflict(err) {
+			recordVersionConflict(indexName, documentID, version)
+			return nil
+		} else if err != nil {
 			log.Printf("Error indexing data into Elasticsearch: %v", err)
-		} else {
-			log.Printf("Success: Document %s indexed/updated", documentID)
+			return err
 		}
+		log.Printf("Success: Document %s indexed/updated", documentID)
 	case OperationDelete:
-		_, err := client.Delete(IndexProjects, documentID).Do(context.Background())
-		if err != nil {
+		request := client.Delete(indexName, documentID)
+		if version > 0 {
+			request.Version(strconv.FormatInt(version, 10)).VersionType(versionType)
+		}
+		start := time.Now()
+		_, err := request.Do(context.Background())
+		observeElasticsearch(RequestDelete, start, ignoreVersionConflict(err))
+		if isVersionConflict(err) {
+			recordVersionConflict(indexName, documentID, version)
+			return nil
+		} else if err != nil {
 			log.Printf("Error deleting data from Elasticsearch: %v", err)
-		} else {
-			log.Printf("Success: Document %s deleted", documentID)
+			return err
 		}
+		log.Printf("Success: Document %s deleted", documentID)
 	default:
 		log.Printf("Unhandled operation: %s", operation)
 	}
+	return nil
+}
+
+// isVersionConflict reports whether a write was rejected because the document
+// already holds a newer version. Such writes are stale redeliveries and are
+// treated as successful no-ops.
+func isVersionConflict(err error) bool {
+	var esErr *types.ElasticsearchError
+	return errors.As(err, &esErr) && esErr.Status == http.StatusConflict
+}
+
+func ignoreVersionConflict(err error) error {
+	if isVersionConflict(err) {
+		return nil
+	}
+	return err
+}
+
+func recordVersionConflict(indexName, documentID string, version int64) {
+	versionConflicts.Inc()
+	log.Printf("Skipped stale write to %s/%s: version %d is not newer than the indexed version", indexName, documentID, version)
 }
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"io/fs"
+	"log"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// mappingFiles holds one index definition per alias, named <alias>.json.
+//
+//go:embed mappings/*.json
+var mappingFiles embed.FS
+
+// IndexDefinition is the settings and mappings an index should have. Version
+// is bumped whenever the definition changes; it is stored in the index's
+// _meta so the consumer can tell which definition an index was built from.
+//
+// BackfillVersion, when set, is the oldest version whose documents already
+// hold every field the definition fills, such as embedded summaries. An index
+// built from an older version is rebuilt rather than updated in place, so
+// that existing documents get those fields too.
+type IndexDefinition struct {
+	Version         int                    `json:"version"`
+	BackfillVersion int                    `json:"backfill_version,omitempty"`
+	Settings        map[string]interface{} `json:"settings,omitempty"`
+	Mappings        map[string]interface{} `json:"mappings"`
+}
+
+func loadIndexDefinitions() (map[string]*IndexDefinition, error) {
+	return readIndexDefinitions(mappingFiles, "mappings")
+}
+
+// readIndexDefinitions reads every <alias>.json definition in dir of fsys.
+func readIndexDefinitions(fsys fs.FS, dir string) (map[string]*IndexDefinition, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	definitions := make(map[string]*IndexDefinition, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || path.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		data, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var definition IndexDefinition
+		if err := json.Unmarshal(data, &definition); err != nil {
+			return nil, fmt.Errorf("parsing mapping %s: %w", entry.Name(), err)
+		}
+		if definition.Version <= 0 {
+			return nil, fmt.Errorf("mapping %s needs a positive version", entry.Name())
+		}
+		definitions[strings.TrimSuffix(entry.Name(), ".json")] = &definition
+	}
+	return definitions, nil
+}
+
+// body returns the create-index request body, with the version recorded in
+// the mapping's _meta and, when alias is set, the alias attached.
+func (d *IndexDefinition) body(alias string) map[string]interface{} {
+	mappings := make(map[string]interface{}, len(d.Mappings)+1)
+	for key, value := range d.Mappings {
+		mappings[key] = value
+	}
+	mappings["_meta"] = map[string]interface{}{"mapping_version": d.Version}
+
+	body := map[string]interface{}{"mappings": mappings}
+	if d.Settings != nil {
+		body["settings"] = d.Settings
+	}
+	if alias != "" {
+		body["aliases"] = map[string]interface{}{alias: map[string]interface{}{}}
+	}
+	return body
+}
+
+func createIndex(esClient *elasticsearch.TypedClient, indexName string, definition *IndexDefinition, alias string) error {
+	bodyJSON, err := json.Marshal(definition.body(alias))
+	if err != nil {
+		return err
+	}
+	response, err := esapi.IndicesCreateRequest{Index: indexName, Body: bytes.NewReader(bodyJSON)}.Do(context.Background(), esClient)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.IsError() {
+		return fmt.Errorf("creating index %s: %s", indexName, response.String())
+	}
+	return nil
+}
+
+// putMapping applies an additive mapping change in place.
+func putMapping(esClient *elasticsearch.TypedClient, indexName string, definition *IndexDefinition) error {
+	bodyJSON, err := json.Marshal(definition.body("")["mappings"])
+	if err != nil {
+		return err
+	}
+	response, err := esapi.IndicesPutMappingRequest{Index: []string{indexName}, Body: bytes.NewReader(bodyJSON)}.Do(context.Background(), esClient)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.IsError() {
+		return fmt.Errorf("updating mapping of %s: %s", indexName, response.String())
+	}
+	return nil
+}
+
+// runMigrate brings every index in the schema up to its current definition.
+func runMigrate(args []string) {
+	flags := flag.NewFlagSet(CommandMigrate, flag.ExitOnError)
+	schemaPath := flags.String("schema", "", "path to a YAML or JSON table-to-index mapping (defaults to the embedded schema.yaml)")
+	flags.Parse(args)
+
+	schema, err := loadSchema(*schemaPath)
+	if err != nil {
+		log.Fatalf("Error loading schema: %v", err)
+	}
+	db, err := sql.Open("postgres", PostgresURL)
+	if err != nil {
+		log.Fatalf("Error connecting to Postgres: %v", err)
+	}
+	defer db.Close()
+	esClient, err := elasticsearch.NewTypedClient(elasticsearch.Config{Addresses: []string{ElastisearchURL}})
+	if err != nil {
+		log.Fatalf("Error creating Elasticsearch client: %v", err)
+	}
+
+	if err := ensureIndexes(schema, db, esClient); err != nil {
+		log.Fatalf("Error migrating indexes: %v", err)
+	}
+}
+
+// ensureIndexes creates missing indexes, applies additive mapping changes in
+// place, and rebuilds through reindex-and-alias any index whose definition
+// changed in a way Elasticsearch cannot apply to existing data, or whose
+// documents lack fields the definition needs backfilled. The indexes
+// of the schema's sources are prepared alike, but not rebuilt.
+func ensureIndexes(schema *Schema, db *sql.DB, esClient *elasticsearch.TypedClient) error {
+	definitions, err := loadIndexDefinitions()
+	if err != nil {
+		return err
+	}
+
+	var rebuild []*TableConfig
+	for i := range schema.Tables {
+		table := &schema.Tables[i]
+		definition, ok := definitions[table.Index]
+		if !ok {
+			log.Printf("No mapping declared for index %s, leaving it to dynamic mapping", table.Index)
+			continue
+		}
+		stale, err := ensureIndex(esClient, table.Index, definition)
+		if err != nil {
+			return err
+		}
+		if stale {
+			rebuild = append(rebuild, table)
+		}
+		if err := ensureSourceIndexes(schema, esClient, table.Index, definition); err != nil {
+			return err
+		}
+	}
+
+	if len(rebuild) == 0 {
+		return nil
+	}
+	if err := schema.singleSource("rebuilding an index"); err != nil {
+		return err
+	}
+	return rebuildIndexes(schema, rebuild, definitions, db, esClient, ReindexBatchSize, false, nil)
+}
+
+// ensureIndex creates the index behind alias when there is none, or brings
+// its mapping up to definition in place, and reports whether it has to be
+// rebuilt instead.
+func ensureIndex(esClient *elasticsearch.TypedClient, alias string, definition *IndexDefinition) (bool, error) {
+	current, err := getIndexes(esClient, alias)
+	if err != nil {
+		return false, err
+	}
+	if len(current) == 0 {
+		indexName := fmt.Sprintf("%s_v%s", alias, time.Now().UTC().Format("20060102150405"))
+		if err := createIndex(esClient, indexName, definition, alias); err != nil {
+			return false, err
+		}
+		log.Printf("Created index %s (mapping version %d) behind alias %s", indexName, definition.Version, alias)
+		return false, nil
+	}
+
+	for indexName, state := range current {
+		version := mappingVersion(state)
+		switch {
+		case version == definition.Version:
+			continue
+		case version > definition.Version:
+			log.Printf("Index %s has mapping version %d, newer than this build's %d; leaving it alone", indexName, version, definition.Version)
+			continue
+		}
+
+		conflicts, undeclared := mappingConflicts(state, definition)
+		if len(undeclared) > 0 {
+			log.Printf("Index %s has fields its definition does not declare, keeping them: %s", indexName, strings.Join(undeclared, ", "))
+		}
+		if version < definition.BackfillVersion {
+			conflicts = append(conflicts, fmt.Sprintf("documents built before version %d lack fields it fills", definition.BackfillVersion))
+		}
+		if len(conflicts) == 0 {
+			if err := putMapping(esClient, indexName, definition); err != nil {
+				return false, err
+			}
+			log.Printf("Updated mapping of %s from version %d to %d in place", indexName, version, definition.Version)
+			continue
+		}
+		log.Printf("Mapping of %s cannot move from version %d to %d in place (%s); rebuilding",
+			indexName, version, definition.Version, strings.Join(conflicts, "; "))
+		return true, nil
+	}
+	return false, nil
+}
+
+// ensureSourceIndexes prepares index for the schema's sources: with shared
+// routing it maps the source field, with index routing it prepares each
+// source's own index from the same definition.
+func ensureSourceIndexes(schema *Schema, esClient *elasticsearch.TypedClient, index string, definition *IndexDefinition) error {
+	if len(schema.SourceNames()) == 0 {
+		return nil
+	}
+	if schema.Sources.Routing == SourceRoutingShared {
+		return putSourceField(esClient, index)
+	}
+	for _, source := range schema.SourceNames() {
+		name := sourceIndex(index, source)
+		stale, err := ensureIndex(esClient, name, definition)
+		if err != nil {
+			return err
+		}
+		if stale {
+			return fmt.Errorf("index %s has to be rebuilt, which is not supported for source indexes", name)
+		}
+	}
+	return nil
+}
+
+// putSourceField maps the source field of shared indexes as a keyword, so
+// updates by query can filter on it exactly. Mapping it again is a no-op.
+func putSourceField(esClient *elasticsearch.TypedClient, indexName string) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"properties": map[string]interface{}{SourceField: map[string]interface{}{"type": "keyword"}},
+	})
+	if err != nil {
+		return err
+	}
+	response, err := esapi.IndicesPutMappingRequest{Index: []string{indexName}, Body: bytes.NewReader(body)}.Do(context.Background(), esClient)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.IsError() {
+		return fmt.Errorf("mapping the source field of %s: %s", indexName, response.String())
+	}
+	return nil
+}
+
+func mappingVersion(state indexState) int {
+	meta, _ := state.Mappings["_meta"].(map[string]interface{})
+	version, _ := meta["mapping_version"].(float64)
+	return int(version)
+}
+
+// mappingConflicts lists the differences between an existing index and a
+// definition that cannot be applied without reindexing: changed field types
+// or analyzers, and changed analysis settings. It also returns the fields of
+// the index the definition does not declare. Those are not conflicts: the
+// consumer maps fields dynamically, such as the soft-delete flag, transform
+// targets, columns added by schema evolution and the source field, and an
+// in-place update leaves them as they are.
+func mappingConflicts(state indexState, definition *IndexDefinition) ([]string, []string) {
+	var conflicts []string
+
+	currentAnalysis := state.Settings["index"]["analysis"]
+	var desiredAnalysis interface{}
+	if index, ok := definition.Settings["index"].(map[string]interface{}); ok {
+		desiredAnalysis = index["analysis"]
+	}
+	if !reflect.DeepEqual(canonicalSettings(currentAnalysis), canonicalSettings(desiredAnalysis)) {
+		conflicts = append(conflicts, "analysis settings changed")
+	}
+
+	currentProperties, _ := state.Mappings["properties"].(map[string]interface{})
+	desiredProperties, _ := definition.Mappings["properties"].(map[string]interface{})
+	var undeclared []string
+	conflicts = append(conflicts, propertyConflicts("", currentProperties, desiredProperties, &undeclared)...)
+	return conflicts, undeclared
+}
+
+// conflictingMappingKeys are the field parameters that cannot change on an
+// existing field.
+var conflictingMappingKeys = []string{"type", "analyzer", "search_analyzer", "normalizer", "format"}
+
+func propertyConflicts(prefix string, current, desired map[string]interface{}, undeclared *[]string) []string {
+	var conflicts []string
+	names := make([]string, 0, len(current))
+	for name := range current {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		field := prefix + name
+		currentField, _ := current[name].(map[string]interface{})
+		desiredField, ok := desired[name].(map[string]interface{})
+		if !ok {
+			*undeclared = append(*undeclared, field)
+			continue
+		}
+		for _, key := range conflictingMappingKeys {
+			currentValue, desiredValue := currentField[key], desiredField[key]
+			if key == "type" {
+				currentValue, desiredValue = fieldType(currentField), fieldType(desiredField)
+			}
+			if !reflect.DeepEqual(currentValue, desiredValue) {
+				conflicts = append(conflicts, fmt.Sprintf("field %s changed %s from %v to %v", field, key, currentValue, desiredValue))
+			}
+		}
+		for _, nested := range []string{"properties", "fields"} {
+			currentNested, _ := currentField[nested].(map[string]interface{})
+			desiredNested, _ := desiredField[nested].(map[string]interface{})
+			conflicts = append(conflicts, propertyConflicts(field+".", currentNested, desiredNested, undeclared)...)
+		}
+	}
+	return conflicts
+}
+
+// fieldType returns a field's type, which Elasticsearch leaves out for
+// objects.
+func fieldType(field map[string]interface{}) interface{} {
+	if fieldType, ok := field["type"]; ok {
+		return fieldType
+	}
+	if _, ok := field["properties"]; ok {
+		return "object"
+	}
+	return nil
+}
+
+// canonicalSettings renders settings the way Elasticsearch returns them, with
+// every scalar as a string.
+func canonicalSettings(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		canonical := make(map[string]interface{}, len(v))
+		for key, nested := range v {
+			canonical[key] = canonicalSettings(nested)
+		}
+		return canonical
+	case []interface{}:
+		canonical := make([]interface{}, len(v))
+		for i, nested := range v {
+			canonical[i] = canonicalSettings(nested)
+		}
+		return canonical
+	case nil:
+		return nil
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const ResultProcessed = "processed"
+const ResultDeadLettered = "dead_lettered"
+
+const RequestIndex = "index"
+const RequestDelete = "delete"
+const RequestUpdate = "update"
+const RequestBulk = "bulk"
+const RequestUpdateByQuery = "update_by_query"
+
+const RebalanceAssigned = "assigned"
+const RebalanceRevoked = "revoked"
+
+var (
+	messagesProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pgsync_consumer_messages_total",
+		Help: "Change events handled by the consumer, by table, operation and result.",
+	}, []string{"table", "operation", "result"})
+
+	elasticsearchDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "pgsync_consumer_elasticsearch_request_duration_seconds",
+		Help:    "Latency of Elasticsearch write requests, by request type.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"request"})
+
+	elasticsearchErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pgsync_consumer_elasticsearch_errors_total",
+		Help: "Elasticsearch write requests that failed, by request type.",
+	}, []string{"request"})
+
+	versionConflicts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pgsync_consumer_version_conflicts_total",
+		Help: "Index and delete calls skipped because the document already held a newer external version.",
+	})
+
+	consumerLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pgsync_consumer_lag",
+		Help: "Messages between the end of a partition and the consumer's processed offset.",
+	}, []string{"topic", "partition"})
+
+	writeRejections = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pgsync_consumer_write_rejections_total",
+		Help: "Elasticsearch writes rejected with 429 or a circuit breaker and retried.",
+	})
+
+	writeConcurrency = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "pgsync_consumer_write_concurrency",
+		Help: "Concurrent Elasticsearch writes currently allowed by the adaptive throttle.",
+	})
+
+	bulkSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "pgsync_consumer_bulk_size",
+		Help: "Actions per bulk request currently allowed by the adaptive throttle.",
+	})
+
+	consumptionPaused = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "pgsync_consumer_paused",
+		Help: "1 while partition consumption is paused because Elasticsearch is rejecting writes.",
+	})
+
+	skippedUpdates = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pgsync_consumer_skipped_updates_total",
+		Help: "Updates dropped without writing because no indexed column changed, by table.",
+	}, []string{"table"})
+
+	shadowWriteMismatches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pgsync_consumer_shadow_write_mismatches_total",
+		Help: "Writes that failed on only one of an index and its shadow, by index, request and the side that failed.",
+	}, []string{"index", "request", "failed"})
+
+	kafkaErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pgsync_consumer_kafka_errors_total",
+		Help: "Errors reported by the Kafka client, by error code and whether the consumer stopped on them.",
+	}, []string{"code", "fatal"})
+
+	rebalances = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pgsync_consumer_rebalances_total",
+		Help: "Partition rebalances, by whether partitions were assigned or revoked.",
+	}, []string{"event"})
+
+	schemaChanges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pgsync_consumer_schema_changes_total",
+		Help: "Columns added to or removed from source tables, by table, change and the evolution rule applied.",
+	}, []string{"table", "change", "rule"})
+
+	deadLettered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pgsync_consumer_dead_letters_total",
+		Help: "Messages published to the dead-letter topic, by source table.",
+	}, []string{"table"})
+)
+
+// observeElasticsearch records the latency and outcome of one Elasticsearch
+// request started at start.
+func observeElasticsearch(request string, start time.Time, err error) {
+	elasticsearchDuration.WithLabelValues(request).Observe(time.Since(start).Seconds())
+	if err != nil {
+		elasticsearchErrors.WithLabelValues(request).Inc()
+	}
+}
+
+func recordLag(topic string, partition int32, lag int64) {
+	consumerLag.WithLabelValues(topic, strconv.Itoa(int(partition))).Set(float64(lag))
+}
+
+// serveMetrics exposes the Prometheus registry on addr, next to the liveness
+// and readiness endpoints.
+func serveMetrics(addr string, health *HealthChecker) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/health/live", handleLiveness)
+	mux.HandleFunc("/health/ready", health.handleReadiness)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Printf("Error serving metrics on %s: %v", addr, err)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"log"
+	"strconv"
+)
+
+// rebalanceHandler returns the rebalance callback of the consumer. When
+// partitions are revoked it waits for the messages already handed to the
+// workers, commits how far they got and stops tracking the partitions, so
+// that the next owner starts where this consumer stopped: nothing processed
+// is read again and nothing unprocessed is skipped. Changes held for an
+// incomplete transaction stay uncommitted and are dropped from the buffer, to
+// be read again by the next owner. When the assignment was lost instead,
+// nothing can be committed and the partitions are only forgotten.
+func rebalanceHandler(pool *WorkerPool, transactions *transactionBuffer) kafka.RebalanceCb {
+	return func(consumer *kafka.Consumer, event kafka.Event) error {
+		switch e := event.(type) {
+		case kafka.AssignedPartitions:
+			log.Printf("Assigned %d partitions: %v", len(e.Partitions), e.Partitions)
+			rebalances.WithLabelValues(RebalanceAssigned).Inc()
+		case kafka.RevokedPartitions:
+			log.Printf("Revoking %d partitions: %v", len(e.Partitions), e.Partitions)
+			rebalances.WithLabelValues(RebalanceRevoked).Inc()
+			pool.Drain()
+			if consumer.AssignmentLost() {
+				log.Printf("Partition assignment was lost, not committing revoked partitions")
+			} else {
+				commitProcessedOffsets(consumer, pool)
+			}
+			pool.Forget(e.Partitions)
+			transactions.Forget(e.Partitions)
+			for _, partition := range e.Partitions {
+				consumerLag.DeleteLabelValues(*partition.Topic, strconv.Itoa(int(partition.Partition)))
+			}
+		}
+		return nil
+	}
+}
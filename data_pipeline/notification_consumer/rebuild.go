@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/elastic/go-elasticsearch/v8"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// runRebuild recreates every index in the schema from the state topic, without
+// reading anything from Postgres, and swaps the aliases over to the new
+// indexes. Changes the consumer had not yet published when the state was
+// read, and those it applies to the old indexes meanwhile, are caught up from
+// the change topic into the same in-memory state.
+func runRebuild(args []string) {
+	flags := flag.NewFlagSet(CommandRebuild, flag.ExitOnError)
+	schemaPath := flags.String("schema", "", "path to a YAML or JSON table-to-index mapping (defaults to the embedded schema.yaml)")
+	topic := flags.String("topic", StateTopic, "log-compacted topic the consumer publishes row state to with -state-topic")
+	batchSize := flags.Int("batch-size", ReindexBatchSize, "documents written to Elasticsearch per bulk request")
+	deleteOld := flags.Bool("delete-old", false, "delete the indexes the aliases pointed to before the swap")
+	flags.Parse(args)
+
+	schema, err := loadSchema(*schemaPath)
+	if err == nil {
+		err = schema.singleSource(CommandRebuild)
+	}
+	if err != nil {
+		log.Fatalf("Error loading schema: %v", err)
+	}
+	esClient, err := elasticsearch.NewTypedClient(elasticsearch.Config{Addresses: []string{ElastisearchURL}})
+	if err != nil {
+		log.Fatalf("Error creating Elasticsearch client: %v", err)
+	}
+	definitions, err := loadIndexDefinitions()
+	if err != nil {
+		log.Fatalf("Error loading index mappings: %v", err)
+	}
+
+	// Changes before the consumer group's committed offsets are in the state
+	// topic; catch up from there
+	catchUp, startOffsets, err := newRebuildCatchUp()
+	if err != nil {
+		log.Fatalf("Error reading the consumer's offsets: %v", err)
+	}
+	defer catchUp.Close()
+
+	state, err := readState(*topic)
+	if err != nil {
+		log.Fatalf("Error reading %s: %v", *topic, err)
+	}
+	swapOffsets, err := catchUpState(catchUp, startOffsets, state, schema)
+	if err != nil {
+		log.Fatalf("Error catching up from Kafka: %v", err)
+	}
+	documents := buildStateDocuments(schema, state)
+
+	tables := make([]*TableConfig, len(schema.Tables))
+	for i := range schema.Tables {
+		tables[i] = &schema.Tables[i]
+	}
+	newIndexes, err := createVersionedIndexes(esClient, tables, definitions)
+	if err != nil {
+		log.Fatalf("Error creating indexes: %v", err)
+	}
+	for _, table := range tables {
+		count, err := indexStateDocuments(esClient, newIndexes[table.Index], table, documents[table.Index], state, *batchSize)
+		if err != nil {
+			log.Fatalf("Error indexing %s: %v", table.Name, err)
+		}
+		log.Printf("Rebuilt %d documents of %s into %s", count, table.Name, newIndexes[table.Index])
+	}
+
+	oldIndexes, err := swapAliases(esClient, newIndexes, *deleteOld)
+	if err != nil {
+		log.Fatalf("Error swapping aliases: %v", err)
+	}
+	// Changes the live consumer wrote to the old indexes before the swap are
+	// applied to the state, and the documents they changed written again
+	if _, err := catchUpState(catchUp, swapOffsets, state, schema); err != nil {
+		log.Fatalf("Error catching up from Kafka after the alias swap: %v", err)
+	}
+	caughtUp := buildStateDocuments(schema, state)
+	for _, table := range tables {
+		changed := changedStateDocuments(documents[table.Index], caughtUp[table.Index])
+		count, err := indexStateDocuments(esClient, newIndexes[table.Index], table, changed, state, *batchSize)
+		if err != nil {
+			log.Fatalf("Error catching up %s: %v", table.Name, err)
+		}
+		log.Printf("Caught up %d documents of %s", count, table.Name)
+	}
+
+	for alias, index := range newIndexes {
+		log.Printf("Alias %s now points to %s (previously %s)", alias, index, strings.Join(oldIndexes[alias], ", "))
+	}
+}
+
+// catchUpState applies the changes on the change topic from the given offsets
+// to state and returns the offsets it stopped at.
+func catchUpState(catchUp *catchUpConsumer, from []kafka.TopicPartition, state stateStore, schema *Schema) ([]kafka.TopicPartition, error) {
+	return catchUp.Replay(from, func(message *kafka.Message) {
+		var notification Notification
+		if err := json.Unmarshal(message.Value, &notification); err != nil {
+			log.Printf("Skipping undecodable message at %v: %v", message.TopicPartition, err)
+			return
+		}
+		state.Apply(notification, schema)
+	})
+}
+
+// newRebuildCatchUp returns a consumer for catching up on the change topic,
+// and the offsets the live consumer group has committed on it. The consumer
+// publishes a change's state before committing past it, so every change
+// before those offsets is in the state topic.
+func newRebuildCatchUp() (*catchUpConsumer, []kafka.TopicPartition, error) {
+	group, err := newCatchUpConsumer(BootstrapServer, KafkaTopic, ConsumerGroup)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer group.Close()
+	ends, err := group.EndOffsets()
+	if err != nil {
+		return nil, nil, err
+	}
+	startOffsets, err := group.CommittedOffsets(ends)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	catchUp, err := newCatchUpConsumer(BootstrapServer, KafkaTopic, temporaryGroup("catch-up"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return catchUp, startOffsets, nil
+}
+
+// readState reads the state topic from the beginning to its current end and
+// returns the newest state of every row, by table and state key. A record
+// only replaces one of the same or an older version, whichever was written
+// last, and tombstones delete the rows they are newer than.
+func readState(topic string) (stateStore, error) {
+	reader, err := newCatchUpConsumer(BootstrapServer, topic, temporaryGroup("rebuild"))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	ends, err := reader.EndOffsets()
+	if err != nil {
+		return nil, err
+	}
+	from := make([]kafka.TopicPartition, len(ends))
+	for i, end := range ends {
+		from[i] = kafka.TopicPartition{Topic: end.Topic, Partition: end.Partition, Offset: kafka.OffsetBeginning}
+	}
+
+	state := make(stateStore)
+	_, err = reader.Replay(from, func(message *kafka.Message) {
+		key := string(message.Key)
+		if message.Value == nil {
+			tableName, _, _ := strings.Cut(key, ":")
+			state.set(tableName, key, stateRecordVersion(message), nil)
+			return
+		}
+		var record Notification
+		if err := json.Unmarshal(message.Value, &record); err != nil {
+			log.Printf("Skipping undecodable state of %s: %v", key, err)
+			return
+		}
+		state.set(record.Table, key, record.Version, record.Data)
+	})
+	return state, err
+}
+
+// stateRecordVersion returns the version in a state record's header, or 0
+// for records published before it was added.
+func stateRecordVersion(message *kafka.Message) int64 {
+	for _, header := range message.Headers {
+		if header.Key == stateVersionHeader {
+			version, _ := strconv.ParseInt(string(header.Value), 10, 64)
+			return version
+		}
+	}
+	return 0
+}
+
+// buildStateDocuments builds the documents of every index from row state the
+// way reindex builds them from Postgres: rows are decoded and transformed,
+// soft-delete rules are applied and relationship arrays and summaries are
+// filled from the relationship rows. Documents are returned by index and id.
+func buildStateDocuments(schema *Schema, state stateStore) map[string]map[string]map[string]interface{} {
+	documents := make(map[string]map[string]map[string]interface{})
+	// live holds the ids of rows that are not soft-deleted, by table
+	live := make(map[string]map[string]bool)
+	for i := range schema.Tables {
+		table := &schema.Tables[i]
+		documents[table.Index] = make(map[string]map[string]interface{})
+		live[table.Name] = make(map[string]bool)
+		for _, entry := range state[table.Name] {
+			row := entry.Data
+			if row == nil {
+				continue
+			}
+			document, documentID, err := decodeDocument(table, row)
+			if err != nil {
+				log.Printf("Skipping %s row: %v", table.Name, err)
+				continue
+			}
+			if keep, err := applyTransformers(table, OperationInsert, row, document); err != nil || !keep {
+				continue
+			}
+			deleted := table.SoftDelete.IsDeleted(row)
+			if deleted && !table.SoftDelete.Hides() {
+				continue
+			}
+			live[table.Name][documentID] = !deleted
+			markSoftDeleted(table, row, document)
+			documents[table.Index][documentID] = document
+		}
+	}
+
+	for i := range schema.Relationships {
+		relationship := &schema.Relationships[i]
+		for _, own := range []RelationshipSide{relationship.Left, relationship.Right} {
+			if own.Field == "" {
+				continue
+			}
+			for _, document := range documents[own.Index] {
+				document[own.Field] = []interface{}{}
+				if own.Embed != nil {
+					document[own.Embed.Field] = []interface{}{}
+				}
+			}
+		}
+		for _, entry := range state[relationship.Table] {
+			row := entry.Data
+			if row == nil || relationship.SoftDelete.IsDeleted(row) {
+				continue
+			}
+			leftID, rightID, err := decodeRelationshipIDs(relationship, row)
+			if err != nil {
+				log.Printf("Skipping %s row: %v", relationship.Table, err)
+				continue
+			}
+			attachStateLink(documents, live, relationship.Left, relationship.Right, leftID, rightID)
+			attachStateLink(documents, live, relationship.Right, relationship.Left, rightID, leftID)
+		}
+	}
+	return documents
+}
+
+// attachStateLink adds otherID, and its summary, to the document of ownID on
+// own, unless the entity on the other side is soft-deleted.
+func attachStateLink(documents map[string]map[string]map[string]interface{}, live map[string]map[string]bool, own, other RelationshipSide, ownID, otherID interface{}) {
+	if own.Field == "" {
+		return
+	}
+	ownDocumentID, _ := documentIDFromValue(ownID)
+	otherDocumentID, _ := documentIDFromValue(otherID)
+	document, ok := documents[own.Index][ownDocumentID]
+	if !ok {
+		return
+	}
+	if other.entity != nil && other.entity.SoftDelete != nil && !live[other.entity.Name][otherDocumentID] {
+		return
+	}
+	document[own.Field] = append(document[own.Field].([]interface{}), otherID)
+	if own.Embed != nil {
+		if otherDocument, ok := documents[other.Index][otherDocumentID]; ok {
+			document[own.Embed.Field] = append(document[own.Embed.Field].([]interface{}), summarize(own.Embed, otherID, otherDocument))
+		}
+	}
+}
+
+// changedStateDocuments returns the documents of after that differ from
+// those of before, and nil for the ids only before has, which are deleted.
+func changedStateDocuments(before, after map[string]map[string]interface{}) map[string]map[string]interface{} {
+	changed := make(map[string]map[string]interface{})
+	for id, document := range after {
+		if !reflect.DeepEqual(before[id], document) {
+			changed[id] = document
+		}
+	}
+	for id := range before {
+		if _, ok := after[id]; !ok {
+			changed[id] = nil
+		}
+	}
+	return changed
+}
+
+// indexStateDocuments writes the documents of table to indexName in batches,
+// in id order, deleting the ids whose document is nil, and returns how many
+// were written.
+func indexStateDocuments(esClient *elasticsearch.TypedClient, indexName string, table *TableConfig, documents map[string]map[string]interface{}, state stateStore, batchSize int) (int, error) {
+	if batchSize <= 0 {
+		return 0, fmt.Errorf("batch size must be positive, got %d", batchSize)
+	}
+	ids := make([]string, 0, len(documents))
+	for id := range documents {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for start := 0; start < len(ids); start += batchSize {
+		end := start + batchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		if err := bulkWriteStateDocuments(esClient, indexName, table, ids[start:end], documents, state); err != nil {
+			return start, err
+		}
+	}
+	return len(ids), nil
+}
+
+// bulkWriteStateDocuments writes documents to indexName in one bulk request.
+// Each write carries the version of its row with external_gte versioning, so
+// that a document can be written again from the same row while a newer change
+// the live consumer has written since the swap is kept. Writes rejected for
+// that reason are not errors.
+func bulkWriteStateDocuments(esClient *elasticsearch.TypedClient, indexName string, table *TableConfig, ids []string, documents map[string]map[string]interface{}, state stateStore) error {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, id := range ids {
+		metadata := map[string]interface{}{"_index": indexName, "_id": id}
+		if version := state[table.Name][entityStateKey(table.Name, id)].Version; version > 0 {
+			metadata["version"] = version
+			metadata["version_type"] = "external_gte"
+		}
+		document := documents[id]
+		action := "index"
+		if document == nil {
+			action = "delete"
+		}
+		if err := encoder.Encode(map[string]interface{}{action: metadata}); err != nil {
+			return err
+		}
+		if document != nil {
+			if err := encoder.Encode(document); err != nil {
+				return err
+			}
+		}
+	}
+
+	items, err := sendBulkItems(esClient, &body)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if len(item.Error) > 0 && item.Status != http.StatusConflict {
+			return fmt.Errorf("bulk %s of document %s: %s", item.Action, item.ID, item.Error)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,703 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// runReindex rebuilds every index in the schema from Postgres. Documents are
+// written to new versioned indexes while the live consumer keeps serving the
+// old ones; changes made during the build are caught up from Kafka, and the
+// aliases the server reads from are then swapped over in one request.
+func runReindex(args []string) {
+	flags := flag.NewFlagSet(CommandReindex, flag.ExitOnError)
+	schemaPath := flags.String("schema", "", "path to a YAML or JSON table-to-index mapping (defaults to the embedded schema.yaml)")
+	batchSize := flags.Int("batch-size", ReindexBatchSize, "rows read from Postgres and written to Elasticsearch per batch")
+	deleteOld := flags.Bool("delete-old", false, "delete the indexes the aliases pointed to before the swap")
+	stateTopic := flags.String("state-topic", "", "also publish the current state of every row to this log-compacted topic, seeding it for rebuild")
+	flags.Parse(args)
+
+	schema, err := loadSchema(*schemaPath)
+	if err == nil {
+		err = schema.singleSource(CommandReindex)
+	}
+	if err != nil {
+		log.Fatalf("Error loading schema: %v", err)
+	}
+
+	db, err := sql.Open("postgres", PostgresURL)
+	if err != nil {
+		log.Fatalf("Error connecting to Postgres: %v", err)
+	}
+	defer db.Close()
+
+	esClient, err := elasticsearch.NewTypedClient(elasticsearch.Config{Addresses: []string{ElastisearchURL}})
+	if err != nil {
+		log.Fatalf("Error creating Elasticsearch client: %v", err)
+	}
+
+	definitions, err := loadIndexDefinitions()
+	if err != nil {
+		log.Fatalf("Error loading index mappings: %v", err)
+	}
+
+	var stateLog *StateLog
+	if *stateTopic != "" {
+		stateLog, err = newStateLog(BootstrapServer, *stateTopic)
+		if err != nil {
+			log.Fatalf("Error creating state producer: %v", err)
+		}
+		defer stateLog.Close()
+	}
+
+	tables := make([]*TableConfig, len(schema.Tables))
+	for i := range schema.Tables {
+		tables[i] = &schema.Tables[i]
+	}
+	if err := rebuildIndexes(schema, tables, definitions, db, esClient, *batchSize, *deleteOld, stateLog); err != nil {
+		log.Fatalf("Error reindexing: %v", err)
+	}
+}
+
+// rebuildIndexes rebuilds the indexes of tables from Postgres into new
+// versioned indexes, catches up on changes made meanwhile from Kafka and then
+// swaps the aliases over. Indexes of other tables are left untouched. With a
+// state log, every row is also published to it once the indexes are built,
+// and the changes caught up on are published after it.
+func rebuildIndexes(schema *Schema, tables []*TableConfig, definitions map[string]*IndexDefinition, db *sql.DB, esClient *elasticsearch.TypedClient, batchSize int, deleteOld bool, stateLog *StateLog) error {
+	catchUp, err := newCatchUpConsumer(BootstrapServer, KafkaTopic, temporaryGroup("catch-up"))
+	if err != nil {
+		return fmt.Errorf("creating catch-up consumer: %w", err)
+	}
+	defer catchUp.Close()
+
+	// Every change committed after this point is in Kafka past these offsets
+	startOffsets, err := catchUp.EndOffsets()
+	if err != nil {
+		return fmt.Errorf("reading Kafka offsets: %w", err)
+	}
+
+	newIndexes, err := createVersionedIndexes(esClient, tables, definitions)
+	if err != nil {
+		return err
+	}
+	target, err := schema.withIndexes(newIndexes)
+	if err != nil {
+		return err
+	}
+	for i := range target.Tables {
+		table := &target.Tables[i]
+		count, err := reindexTable(db, esClient, target, table, batchSize)
+		if err != nil {
+			return fmt.Errorf("reindexing %s: %w", table.Name, err)
+		}
+		log.Printf("Reindexed %d rows from %s into %s", count, table.Name, table.Index)
+	}
+	if stateLog != nil {
+		// Changes made after the rows were read are published again by the
+		// catch-up, so the topic ends with their latest image
+		count, err := seedState(db, schema, stateLog)
+		if err != nil {
+			return fmt.Errorf("publishing row state: %w", err)
+		}
+		log.Printf("Published the state of %d rows", count)
+	}
+
+	writer := newElasticsearchWriter(esClient, nil)
+	return catchUpAndSwap(catchUp, startOffsets, target, db, writer, esClient, newIndexes, deleteOld, stateLog)
+}
+
+// catchUpAndSwap replays the changes made from startOffsets on into the new
+// indexes of target, swaps the aliases to them, then replays whatever the live
+// consumer wrote to the old indexes between the two steps.
+func catchUpAndSwap(catchUp *catchUpConsumer, startOffsets []kafka.TopicPartition, target *Schema, db *sql.DB, writer DocumentWriter, esClient *elasticsearch.TypedClient, newIndexes map[string]string, deleteOld bool, stateLog *StateLog) error {
+	applyChange := func(message *kafka.Message) {
+		replayMessage(message, target, db, writer, stateLog)
+	}
+	swapOffsets, err := catchUp.Replay(startOffsets, applyChange)
+	if err != nil {
+		return fmt.Errorf("catching up from Kafka: %w", err)
+	}
+	oldIndexes, err := swapAliases(esClient, newIndexes, deleteOld)
+	if err != nil {
+		return fmt.Errorf("swapping aliases: %w", err)
+	}
+	if _, err := catchUp.Replay(swapOffsets, applyChange); err != nil {
+		return fmt.Errorf("catching up from Kafka after the alias swap: %w", err)
+	}
+
+	for alias, index := range newIndexes {
+		log.Printf("Alias %s now points to %s (previously %s)", alias, index, strings.Join(oldIndexes[alias], ", "))
+	}
+	return nil
+}
+
+// createVersionedIndexes creates a new index named <index>_v<timestamp> for
+// the index of each table, from its declared mapping or, failing that, like
+// the index currently behind its alias. It returns the new index of each
+// alias.
+func createVersionedIndexes(esClient *elasticsearch.TypedClient, tables []*TableConfig, definitions map[string]*IndexDefinition) (map[string]string, error) {
+	suffix := time.Now().UTC().Format("20060102150405")
+	newIndexes := make(map[string]string, len(tables))
+	for _, table := range tables {
+		newIndexes[table.Index] = fmt.Sprintf("%s_v%s", table.Index, suffix)
+	}
+
+	for _, table := range tables {
+		var err error
+		if definition, ok := definitions[table.Index]; ok {
+			err = createIndex(esClient, newIndexes[table.Index], definition, "")
+		} else {
+			err = createIndexLike(esClient, newIndexes[table.Index], table.Index)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("creating index %s: %w", newIndexes[table.Index], err)
+		}
+	}
+	return newIndexes, nil
+}
+
+// reindexTable streams a table and bulk indexes its rows, together with their
+// relationship arrays, into table.Index.
+func reindexTable(db *sql.DB, esClient *elasticsearch.TypedClient, schema *Schema, table *TableConfig, batchSize int) (int, error) {
+	return forEachDocumentBatch(db, schema, table, batchSize, func(ids []string, documents map[string]map[string]interface{}, _ string) error {
+		if len(ids) == 0 {
+			return nil
+		}
+		return bulkIndexDocuments(esClient, table.Index, ids, documents)
+	})
+}
+
+// forEachDocumentBatch reads a table in primary-key order with keyset
+// pagination and calls handle with each batch of fully linked documents. ids
+// lists the batch's document ids in primary-key order, leaving out rows a
+// transformer skipped, and lastKey is the key of the batch's last row.
+func forEachDocumentBatch(db *sql.DB, schema *Schema, table *TableConfig, batchSize int, handle func(ids []string, documents map[string]map[string]interface{}, lastKey string) error) (int, error) {
+	// row_to_json produces the same row image the triggers send, so documents
+	// are decoded exactly as the live consumer decodes them. Soft-deleted rows
+	// are skipped unless the table keeps them as hidden documents.
+	live := table.SoftDelete.liveCondition("t", true)
+	firstQuery := fmt.Sprintf(`SELECT row_to_json(t) FROM %s t WHERE %s ORDER BY t.%s LIMIT $1`,
+		quoteIdentifier(table.Name), live, quoteIdentifier(table.PrimaryKey))
+	nextQuery := fmt.Sprintf(`SELECT row_to_json(t) FROM %s t WHERE t.%s > $2 AND %s ORDER BY t.%s LIMIT $1`,
+		quoteIdentifier(table.Name), quoteIdentifier(table.PrimaryKey), live, quoteIdentifier(table.PrimaryKey))
+
+	total := 0
+	lastKey := ""
+	for {
+		var rows *sql.Rows
+		var err error
+		if total == 0 {
+			rows, err = db.Query(firstQuery, batchSize)
+		} else {
+			rows, err = db.Query(nextQuery, batchSize, lastKey)
+		}
+		if err != nil {
+			return total, err
+		}
+		batch, err := scanJSONRows(rows)
+		if err != nil {
+			return total, err
+		}
+		if len(batch) == 0 {
+			return total, nil
+		}
+
+		documents := make(map[string]map[string]interface{}, len(batch))
+		ids := make([]string, 0, len(batch))
+		firstKey := ""
+		for i, row := range batch {
+			document, documentID, err := decodeDocument(table, row)
+			if err != nil {
+				return total, err
+			}
+			if i == 0 {
+				firstKey = documentID
+			}
+			lastKey = documentID
+			// Rows a transformer skips are left out, as the live consumer leaves them
+			keep, err := applyTransformers(table, OperationInsert, row, document)
+			if err != nil {
+				return total, err
+			}
+			if !keep {
+				continue
+			}
+			markSoftDeleted(table, row, document)
+			documents[documentID] = document
+			ids = append(ids, documentID)
+		}
+		if err := attachRelationshipArrays(db, schema, table, documents, firstKey, lastKey); err != nil {
+			return total, err
+		}
+		if err := handle(ids, documents, lastKey); err != nil {
+			return total, err
+		}
+
+		total += len(batch)
+		if len(batch) < batchSize {
+			return total, nil
+		}
+	}
+}
+
+// attachRelationshipArrays fills the relationship array fields, and the
+// embedded summaries, of documents in table.Index whose primary keys lie
+// between firstKey and lastKey.
+func attachRelationshipArrays(db *sql.DB, schema *Schema, table *TableConfig, documents map[string]map[string]interface{}, firstKey, lastKey string) error {
+	for i := range schema.Relationships {
+		relationship := &schema.Relationships[i]
+		for _, ownIsLeft := range []bool{true, false} {
+			own, other := relationship.Right, relationship.Left
+			if ownIsLeft {
+				own, other = other, own
+			}
+			if own.Index != table.Index || own.Field == "" {
+				continue
+			}
+			for _, document := range documents {
+				document[own.Field] = []interface{}{}
+				if own.Embed != nil {
+					document[own.Embed.Field] = []interface{}{}
+				}
+			}
+
+			linkQuery := fmt.Sprintf(`FROM %s j WHERE j.%s >= $1 AND j.%s <= $2 AND %s`,
+				quoteIdentifier(relationship.Table), quoteIdentifier(own.Column), quoteIdentifier(own.Column),
+				shownLinkCondition(relationship, other))
+			rows, err := db.Query("SELECT row_to_json(j) "+linkQuery, firstKey, lastKey)
+			if err != nil {
+				return err
+			}
+			links, err := scanJSONRows(rows)
+			if err != nil {
+				return err
+			}
+			var summaries map[string]map[string]interface{}
+			if own.Embed != nil {
+				condition := fmt.Sprintf("o.%s IN (SELECT j.%s %s)",
+					quoteIdentifier(other.entity.PrimaryKey), quoteIdentifier(other.Column), linkQuery)
+				summaries, err = loadSummaries(db, own.Embed, other, condition, firstKey, lastKey)
+				if err != nil {
+					return err
+				}
+			}
+			for _, link := range links {
+				ownID, otherID, err := decodeRelationshipIDs(relationship, link)
+				if err != nil {
+					return err
+				}
+				if !ownIsLeft {
+					ownID, otherID = otherID, ownID
+				}
+				documentID, _ := documentIDFromValue(ownID)
+				document, ok := documents[documentID]
+				if !ok {
+					continue
+				}
+				document[own.Field] = append(document[own.Field].([]interface{}), otherID)
+				if own.Embed != nil {
+					otherDocumentID, _ := documentIDFromValue(otherID)
+					if summary, ok := summaries[otherDocumentID]; ok {
+						document[own.Embed.Field] = append(document[own.Embed.Field].([]interface{}), summary)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func scanJSONRows(rows *sql.Rows) ([]map[string]interface{}, error) {
+	defer rows.Close()
+	var result []map[string]interface{}
+	for rows.Next() {
+		var raw []byte
+		if err := rows.Scan(&raw); err != nil {
+			return nil, err
+		}
+		var row map[string]interface{}
+		if err := json.Unmarshal(raw, &row); err != nil {
+			return nil, err
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// bulkIndexDocuments writes documents to indexName in one bulk request.
+func bulkIndexDocuments(esClient *elasticsearch.TypedClient, indexName string, ids []string, documents map[string]map[string]interface{}) error {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, id := range ids {
+		action := map[string]interface{}{"index": map[string]interface{}{"_index": indexName, "_id": id}}
+		if err := encoder.Encode(action); err != nil {
+			return err
+		}
+		if err := encoder.Encode(documents[id]); err != nil {
+			return err
+		}
+	}
+
+	return sendBulk(esClient, &body)
+}
+
+// bulkDeleteDocuments deletes documents from indexName in one bulk request.
+func bulkDeleteDocuments(esClient *elasticsearch.TypedClient, indexName string, ids []string) error {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, id := range ids {
+		action := map[string]interface{}{"delete": map[string]interface{}{"_index": indexName, "_id": id}}
+		if err := encoder.Encode(action); err != nil {
+			return err
+		}
+	}
+	return sendBulk(esClient, &body)
+}
+
+// bulkItem is the outcome of one action in a bulk request.
+type bulkItem struct {
+	Action string
+	ID     string          `json:"_id"`
+	Index  string          `json:"_index"`
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error"`
+}
+
+// sendBulk sends an NDJSON bulk body and returns the first item error.
+func sendBulk(esClient *elasticsearch.TypedClient, body *bytes.Buffer) error {
+	items, err := sendBulkItems(esClient, body)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if len(item.Error) > 0 {
+			return fmt.Errorf("bulk %s of document %s: %s", item.Action, item.ID, item.Error)
+		}
+	}
+	return nil
+}
+
+// sendBulkItems sends an NDJSON bulk body and returns the outcome of each
+// action, in request order.
+func sendBulkItems(esClient *elasticsearch.TypedClient, body *bytes.Buffer) ([]bulkItem, error) {
+	start := time.Now()
+	response, err := esapi.BulkRequest{Body: body}.Do(context.Background(), esClient)
+	failed := err
+	if err == nil && response.IsError() {
+		failed = errors.New(response.Status())
+	}
+	observeElasticsearch(RequestBulk, start, failed)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.IsError() {
+		return nil, fmt.Errorf("bulk request failed: %w", newStatusError(response))
+	}
+
+	var result struct {
+		Items []map[string]bulkItem `json:"items"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	items := make([]bulkItem, 0, len(result.Items))
+	for _, item := range result.Items {
+		for action, outcome := range item {
+			outcome.Action = action
+			items = append(items, outcome)
+		}
+	}
+	return items, nil
+}
+
+// createIndexLike creates indexName with the mappings and analysis settings of
+// the index currently behind alias, if there is one.
+func createIndexLike(esClient *elasticsearch.TypedClient, indexName, alias string) error {
+	body := map[string]interface{}{}
+	current, err := getIndexes(esClient, alias)
+	if err != nil {
+		return err
+	}
+	for _, definition := range current {
+		body["mappings"] = definition.Mappings
+		if analysis, ok := definition.Settings["index"]["analysis"]; ok {
+			body["settings"] = map[string]interface{}{"index": map[string]interface{}{"analysis": analysis}}
+		}
+		break
+	}
+
+	bodyJSON, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	response, err := esapi.IndicesCreateRequest{Index: indexName, Body: bytes.NewReader(bodyJSON)}.Do(context.Background(), esClient)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.IsError() {
+		return fmt.Errorf("creating index: %s", response.String())
+	}
+	return nil
+}
+
+type indexState struct {
+	Aliases  map[string]interface{}            `json:"aliases"`
+	Mappings map[string]interface{}            `json:"mappings"`
+	Settings map[string]map[string]interface{} `json:"settings"`
+}
+
+// getIndexes returns the concrete indexes behind name, keyed by index name.
+// A missing index or alias yields an empty map.
+func getIndexes(esClient *elasticsearch.TypedClient, name string) (map[string]indexState, error) {
+	response, err := esapi.IndicesGetRequest{Index: []string{name}}.Do(context.Background(), esClient)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return map[string]indexState{}, nil
+	}
+	if response.IsError() {
+		return nil, fmt.Errorf("reading index %s: %s", name, response.String())
+	}
+	var indexes map[string]indexState
+	if err := json.NewDecoder(response.Body).Decode(&indexes); err != nil {
+		return nil, err
+	}
+	return indexes, nil
+}
+
+// swapAliases points each alias at its new index in a single atomic request
+// and returns the indexes each alias pointed to before. A concrete index that
+// still carries the alias name, as created by create_es_index.sh, is removed
+// so the alias can take its place.
+func swapAliases(esClient *elasticsearch.TypedClient, newIndexes map[string]string, deleteOld bool) (map[string][]string, error) {
+	var actions []map[string]interface{}
+	oldIndexes := make(map[string][]string)
+	for alias, index := range newIndexes {
+		current, err := getIndexes(esClient, alias)
+		if err != nil {
+			return nil, err
+		}
+		for oldIndex := range current {
+			oldIndexes[alias] = append(oldIndexes[alias], oldIndex)
+			if oldIndex == alias || deleteOld {
+				actions = append(actions, map[string]interface{}{"remove_index": map[string]interface{}{"index": oldIndex}})
+			} else {
+				actions = append(actions, map[string]interface{}{"remove": map[string]interface{}{"index": oldIndex, "alias": alias}})
+			}
+		}
+		actions = append(actions, map[string]interface{}{"add": map[string]interface{}{"index": index, "alias": alias}})
+	}
+
+	bodyJSON, err := json.Marshal(map[string]interface{}{"actions": actions})
+	if err != nil {
+		return nil, err
+	}
+	response, err := esapi.IndicesUpdateAliasesRequest{Body: bytes.NewReader(bodyJSON)}.Do(context.Background(), esClient)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.IsError() {
+		return nil, fmt.Errorf("updating aliases: %s", response.String())
+	}
+	return oldIndexes, nil
+}
+
+// catchUpConsumer reads the change topic outside the consumer group, from
+// explicit offsets, without committing anything.
+type catchUpConsumer struct {
+	consumer *kafka.Consumer
+	topic    string
+}
+
+// temporaryGroup names a throwaway consumer group, so reading the topic does
+// not disturb the live consumer's group.
+func temporaryGroup(purpose string) string {
+	return fmt.Sprintf("%s-%s-%d", ConsumerGroup, purpose, time.Now().UnixNano())
+}
+
+func newCatchUpConsumer(brokers, topic, group string) (*catchUpConsumer, error) {
+	consumer, err := kafka.NewConsumer(&kafka.ConfigMap{
+		"bootstrap.servers":  brokers,
+		"group.id":           group,
+		"enable.auto.commit": false,
+		// Start offsets older than retention fall back to the oldest message
+		"auto.offset.reset": "earliest",
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &catchUpConsumer{consumer: consumer, topic: topic}, nil
+}
+
+// EndOffsets returns the current end offset of every partition of the topic.
+func (c *catchUpConsumer) EndOffsets() ([]kafka.TopicPartition, error) {
+	metadata, err := c.consumer.GetMetadata(&c.topic, false, KafkaTimeoutMs)
+	if err != nil {
+		return nil, err
+	}
+	topicMetadata, ok := metadata.Topics[c.topic]
+	if !ok {
+		return nil, fmt.Errorf("topic %s not found", c.topic)
+	}
+	offsets := make([]kafka.TopicPartition, 0, len(topicMetadata.Partitions))
+	for _, partition := range topicMetadata.Partitions {
+		_, high, err := c.consumer.QueryWatermarkOffsets(c.topic, partition.ID, KafkaTimeoutMs)
+		if err != nil {
+			return nil, err
+		}
+		offsets = append(offsets, kafka.TopicPartition{Topic: &c.topic, Partition: partition.ID, Offset: kafka.Offset(high)})
+	}
+	return offsets, nil
+}
+
+// Replay hands every message from the given offsets up to the current end of
+// each partition to handle, in order within each partition, and returns the
+// offsets it stopped at.
+func (c *catchUpConsumer) Replay(from []kafka.TopicPartition, handle func(message *kafka.Message)) ([]kafka.TopicPartition, error) {
+	until, err := c.EndOffsets()
+	if err != nil {
+		return nil, err
+	}
+	remaining := make(map[int32]kafka.Offset)
+	for _, end := range until {
+		for _, start := range from {
+			if start.Partition == end.Partition && start.Offset < end.Offset {
+				remaining[end.Partition] = end.Offset
+			}
+		}
+	}
+	if len(remaining) == 0 {
+		return until, nil
+	}
+	if err := c.consumer.Assign(from); err != nil {
+		return nil, err
+	}
+	defer c.consumer.Unassign()
+
+	replayed := 0
+	for len(remaining) > 0 {
+		ev := c.consumer.Poll(1000)
+		switch e := ev.(type) {
+		case *kafka.Message:
+			end, ok := remaining[e.TopicPartition.Partition]
+			if !ok {
+				continue
+			}
+			handle(e)
+			replayed++
+			if e.TopicPartition.Offset+1 >= end {
+				delete(remaining, e.TopicPartition.Partition)
+			}
+		case kafka.Error:
+			if e.IsFatal() {
+				return nil, e
+			}
+			log.Printf("Kafka error during catch-up: %v", e)
+		}
+	}
+	log.Printf("Replayed %d changes from Kafka", replayed)
+	return until, nil
+}
+
+// OffsetsForTime returns, for each of the given partitions, the offset of the
+// first message at or after at. Partitions with no such message get their
+// current end offset, leaving nothing to replay.
+func (c *catchUpConsumer) OffsetsForTime(at time.Time, ends []kafka.TopicPartition) ([]kafka.TopicPartition, error) {
+	query := make([]kafka.TopicPartition, len(ends))
+	for i, end := range ends {
+		query[i] = kafka.TopicPartition{Topic: end.Topic, Partition: end.Partition, Offset: kafka.Offset(at.UnixMilli())}
+	}
+	offsets, err := c.consumer.OffsetsForTimes(query, KafkaTimeoutMs)
+	if err != nil {
+		return nil, err
+	}
+	for i, offset := range offsets {
+		if offset.Error != nil {
+			return nil, offset.Error
+		}
+		for _, end := range ends {
+			if end.Partition == offset.Partition && offset.Offset < 0 {
+				offsets[i].Offset = end.Offset
+			}
+		}
+	}
+	return offsets, nil
+}
+
+// CommittedOffsets returns the position the consumer's group has committed
+// on each of the given partitions, or the oldest offset still in partitions
+// it has not committed on.
+func (c *catchUpConsumer) CommittedOffsets(partitions []kafka.TopicPartition) ([]kafka.TopicPartition, error) {
+	committed, err := c.consumer.Committed(partitions, KafkaTimeoutMs)
+	if err != nil {
+		return nil, err
+	}
+	for i := range committed {
+		if committed[i].Offset >= 0 {
+			continue
+		}
+		low, _, err := c.consumer.QueryWatermarkOffsets(c.topic, committed[i].Partition, KafkaTimeoutMs)
+		if err != nil {
+			return nil, err
+		}
+		committed[i].Offset = kafka.Offset(low)
+	}
+	return committed, nil
+}
+
+// Commit stores offsets as the consumer group's position.
+func (c *catchUpConsumer) Commit(offsets []kafka.TopicPartition) error {
+	committed, err := c.consumer.CommitOffsets(offsets)
+	if err != nil {
+		return err
+	}
+	for _, offset := range committed {
+		if offset.Error != nil {
+			return fmt.Errorf("partition %d: %w", offset.Partition, offset.Error)
+		}
+	}
+	return nil
+}
+
+// replayMessage applies a message read outside the consumer group, and
+// publishes the state it leaves its row in to stateLog. Messages that cannot
+// be applied are logged and skipped rather than dead-lettered, since the live
+// consumer has already seen them.
+func replayMessage(message *kafka.Message, schema *Schema, db *sql.DB, writer DocumentWriter, stateLog *StateLog) {
+	var notification Notification
+	if err := json.Unmarshal(message.Value, &notification); err != nil {
+		log.Printf("Skipping undecodable message at %v: %v", message.TopicPartition, err)
+	} else if err := processNotification(notification, schema, db, writer); err != nil {
+		log.Printf("Skipping message at %v: %v", message.TopicPartition, err)
+	} else {
+		stateLog.Record(notification, schema)
+	}
+}
+
+func (c *catchUpConsumer) Close() {
+	if err := c.consumer.Close(); err != nil {
+		log.Printf("Error closing catch-up consumer: %v", err)
+	}
+}
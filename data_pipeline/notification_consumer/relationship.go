@@ -0,0 +1,161 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// LinkVersionsField is the object on linked documents that keeps, for each
+// link, the version of the last change applied to it. It is not indexed.
+const LinkVersionsField = "link_versions"
+
+// linkVersionCheck starts both link scripts. A change that carries a version
+// is compared with the version stored under params.link in params.versions:
+// an older change is stale and leaves the document alone, and a newer one
+// stores its version. A transaction's messages are partitioned by txid, so
+// the changes to one link can arrive out of order.
+const linkVersionCheck = "boolean changed = false; boolean stale = false; " +
+	"if (params.version != null) { " +
+	"if (ctx._source[params.versions] == null) { ctx._source[params.versions] = [:] } " +
+	"def seen = ctx._source[params.versions][params.link]; " +
+	"if (seen != null && seen > params.version) { stale = true } " +
+	"else if (seen == null || seen < params.version) { ctx._source[params.versions][params.link] = params.version; changed = true } } "
+
+// linkAddScript adds params.id to the array params.field unless it is there
+// already, and linkRemoveScript removes it if present, so that replayed link
+// changes are no-ops. When params.embed names a summary array, the linked
+// document's summary is added, refreshed or removed alongside its id.
+const linkAddScript = linkVersionCheck +
+	"if (!stale) { " +
+	"if (ctx._source[params.field] == null) { ctx._source[params.field] = [] } " +
+	"if (!ctx._source[params.field].contains(params.id)) { ctx._source[params.field].add(params.id); changed = true } " +
+	"if (params.embed != null && params.summary != null) { " +
+	"if (ctx._source[params.embed] == null) { ctx._source[params.embed] = [] } " +
+	"def list = ctx._source[params.embed]; int found = -1; " +
+	"for (int i = 0; i < list.size(); i++) { if (list[i].id == params.id) { found = i } } " +
+	"if (found < 0) { list.add(params.summary); changed = true } " +
+	"else if (!list[found].equals(params.summary)) { list[found] = params.summary; changed = true } } } " +
+	"if (!changed) { ctx.op = 'noop' }"
+const linkRemoveScript = linkVersionCheck +
+	"if (!stale) { " +
+	"int i = ctx._source.containsKey(params.field) ? ctx._source[params.field].indexOf(params.id) : -1; " +
+	"if (i >= 0) { ctx._source[params.field].remove(i); changed = true } " +
+	"if (params.embed != null && ctx._source[params.embed] != null) { " +
+	"changed = ctx._source[params.embed].removeIf(s -> s.id == params.id) || changed } } " +
+	"if (!changed) { ctx.op = 'noop' }"
+
+// updateRelationshipIndexes applies a link added or removed by a row of any
+// relationship table to the documents on both of its sides. version is the
+// version of the change that added or removed it.
+func updateRelationshipIndexes(relationship *RelationshipConfig, operation string, leftID, rightID interface{}, version int64, db *sql.DB, writer DocumentWriter) error {
+	switch operation {
+	case OperationInsert:
+		// Links to soft-deleted entities are not shown, and deleted entities
+		// have no document to link from
+		leftLive := entityLive(db, relationship.Left, leftID)
+		rightLive := entityLive(db, relationship.Right, rightID)
+		if rightLive && (leftLive || sideHides(relationship.Left)) {
+			summary := loadSummary(db, relationship.Left, relationship.Right, rightID)
+			if err := updateRelationshipSide(db, relationship.Left, leftID, rightID, true, summary, version, writer); err != nil {
+				return err
+			}
+		}
+		if leftLive && (rightLive || sideHides(relationship.Right)) {
+			summary := loadSummary(db, relationship.Right, relationship.Left, leftID)
+			return updateRelationshipSide(db, relationship.Right, rightID, leftID, true, summary, version, writer)
+		}
+	case OperationDelete:
+		if err := updateRelationshipSide(db, relationship.Left, leftID, rightID, false, nil, version, writer); err != nil {
+			return err
+		}
+		return updateRelationshipSide(db, relationship.Right, rightID, leftID, false, nil, version, writer)
+	default:
+		log.Printf("Unsupported operation: %s", operation)
+	}
+	return nil
+}
+
+// updateRelationshipSide adds or removes otherID in the side's array field on
+// the document identified by ownID, together with summary, the other
+// document's summary, when the side embeds one. Adding a link to a document
+// that is not indexed yet creates it from the link, as long as its row is
+// still in Postgres; removing a link from a missing document does nothing.
+// The link is left alone when the document holds a newer change to it than
+// version. A failed write is returned, so that the change is retried or
+// dead-lettered.
+func updateRelationshipSide(db *sql.DB, side RelationshipSide, ownID, otherID interface{}, add bool, summary map[string]interface{}, version int64, writer DocumentWriter) error {
+	if side.Field == "" {
+		return nil
+	}
+	documentID, ok := documentIDFromValue(ownID)
+	if !ok {
+		log.Printf("Skipping update of %s: unusable document id %v", side.Index, ownID)
+		return nil
+	}
+
+	// Define the update query
+	otherDocumentID, _ := documentIDFromValue(otherID)
+	params := map[string]interface{}{
+		"field":    side.Field,
+		"id":       otherID,
+		"versions": LinkVersionsField,
+		"link":     side.Field + ":" + otherDocumentID,
+	}
+	if version > 0 {
+		params["version"] = version
+	}
+	if side.Embed != nil {
+		params["embed"] = side.Embed.Field
+		params["summary"] = summary
+	}
+	sourceScript := linkRemoveScript
+	if add {
+		sourceScript = linkAddScript
+	}
+	query := map[string]interface{}{
+		"script": map[string]interface{}{
+			"source": sourceScript,
+			"lang":   "painless",
+			"params": params,
+		},
+	}
+	// A stub for a row that is gone would never be replaced or deleted
+	if add && side.entity != nil && entityExists(db, side, ownID) {
+		query["upsert"] = linkStub(side, ownID, otherID, summary, params["link"].(string), version)
+	}
+
+	// Update the document in Elasticsearch
+	if err := writer.Update(side.Index, documentID, query); err != nil && !isDocumentMissing(err) {
+		return fmt.Errorf("updating links of %s/%s: %w", side.Index, documentID, err)
+	}
+	return nil
+}
+
+// linkStub is the document a link creates when the document on its side has
+// not been indexed yet, for example because the parent's own change is still
+// on its way: the parent's id, the link and its summary. The parent's change
+// replaces the stub with the whole document, links included, when it arrives.
+// The stub records version for link, as the script would.
+func linkStub(side RelationshipSide, ownID, otherID interface{}, summary map[string]interface{}, link string, version int64) map[string]interface{} {
+	stub := map[string]interface{}{side.Field: []interface{}{otherID}}
+	if version > 0 {
+		stub[LinkVersionsField] = map[string]interface{}{link: version}
+	}
+	if side.Embed != nil && summary != nil {
+		stub[side.Embed.Field] = []interface{}{summary}
+	}
+	if keyField := side.entity.KeyField(); keyField != "" {
+		stub[keyField] = ownID
+	}
+	return stub
+}
+
+// isDocumentMissing reports whether an update failed because its document
+// does not exist.
+func isDocumentMissing(err error) bool {
+	var statusErr *statusError
+	return errors.As(err, &statusErr) && statusErr.Status == http.StatusNotFound
+}
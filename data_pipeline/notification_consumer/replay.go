@@ -0,0 +1,200 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/elastic/go-elasticsearch/v8"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runReplay reprocesses part of the change topic. By default it reads from
+// the chosen position to the current end under a temporary group and applies
+// the matching changes itself. With -group it only moves that group's
+// committed offsets, so the consumer reprocesses everything from there once
+// it is restarted.
+func runReplay(args []string) {
+	flags := flag.NewFlagSet(CommandReplay, flag.ExitOnError)
+	schemaPath := flags.String("schema", "", "path to a YAML or JSON table-to-index mapping (defaults to the embedded schema.yaml)")
+	offset := flags.Int64("offset", -1, "replay every partition from this offset")
+	offsets := flags.String("offsets", "", "replay from per-partition offsets, as partition:offset pairs separated by commas")
+	since := flags.String("since", "", "replay every partition from the first message at or after this RFC 3339 time")
+	tables := flags.String("tables", "", "comma-separated tables to replay (defaults to all)")
+	operations := flags.String("operations", "", "comma-separated operations to replay, such as INSERT,UPDATE (defaults to all)")
+	keys := flags.String("keys", "", "comma-separated primary keys to replay; link rows match on either side (defaults to all)")
+	dryRun := flags.Bool("dry-run", false, "print the Elasticsearch writes instead of performing them")
+	group := flags.String("group", "", "seek this consumer group to the position instead of replaying; the group's consumers must be stopped")
+	flags.Parse(args)
+
+	filter := replayFilter{tables: commaSet(*tables), operations: commaSet(*operations), keys: commaSet(*keys)}
+	if *group != "" && (*dryRun || !filter.empty()) {
+		log.Fatalf("-group only seeks the group and cannot be combined with -dry-run, -tables, -operations or -keys")
+	}
+
+	consumerGroup := *group
+	if consumerGroup == "" {
+		consumerGroup = temporaryGroup("replay")
+	}
+	replay, err := newCatchUpConsumer(BootstrapServer, KafkaTopic, consumerGroup)
+	if err != nil {
+		log.Fatalf("Error creating Kafka consumer: %v", err)
+	}
+	defer replay.Close()
+
+	from, err := replayPosition(replay, *offset, *offsets, *since)
+	if err != nil {
+		log.Fatalf("Error resolving the replay position: %v", err)
+	}
+
+	if *group != "" {
+		if err := replay.Commit(from); err != nil {
+			log.Fatalf("Error seeking group %s: %v", *group, err)
+		}
+		for _, position := range from {
+			fmt.Printf("%s[%d] -> %v\n", *position.Topic, position.Partition, position.Offset)
+		}
+		log.Printf("Group %s will resume from these offsets when its consumers restart", *group)
+		return
+	}
+
+	schema, err := loadSchema(*schemaPath)
+	if err != nil {
+		log.Fatalf("Error loading schema: %v", err)
+	}
+	db, err := sql.Open("postgres", PostgresURL)
+	if err != nil {
+		log.Fatalf("Error connecting to Postgres: %v", err)
+	}
+	defer db.Close()
+	if err := schema.OpenSources(); err != nil {
+		log.Fatalf("Error connecting to Postgres: %v", err)
+	}
+	defer schema.CloseSources()
+
+	var writer DocumentWriter = newDryRunWriter(os.Stdout)
+	if !*dryRun {
+		esClient, err := elasticsearch.NewTypedClient(elasticsearch.Config{Addresses: []string{ElastisearchURL}})
+		if err != nil {
+			log.Fatalf("Error creating Elasticsearch client: %v", err)
+		}
+		writer = newReplayWriter(esClient)
+	}
+
+	matched := 0
+	_, err = replay.Replay(from, func(message *kafka.Message) {
+		var notification Notification
+		if err := json.Unmarshal(message.Value, &notification); err == nil && !filter.matches(notification, schema) {
+			return
+		}
+		matched++
+		if *dryRun {
+			fmt.Printf("# %s[%d]@%v\n", *message.TopicPartition.Topic, message.TopicPartition.Partition, message.TopicPartition.Offset)
+		}
+		replayMessage(message, schema, db, writer, nil)
+	})
+	if err != nil {
+		log.Fatalf("Error replaying: %v", err)
+	}
+	log.Printf("Applied %d matching changes", matched)
+}
+
+// replayPosition resolves exactly one of the position flags to an offset per
+// partition.
+func replayPosition(replay *catchUpConsumer, offset int64, offsets, since string) ([]kafka.TopicPartition, error) {
+	set := 0
+	for _, given := range []bool{offset >= 0, offsets != "", since != ""} {
+		if given {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, errors.New("give exactly one of -offset, -offsets and -since")
+	}
+
+	ends, err := replay.EndOffsets()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case offset >= 0:
+		for i := range ends {
+			ends[i].Offset = kafka.Offset(offset)
+		}
+		return ends, nil
+	case offsets != "":
+		var from []kafka.TopicPartition
+		for _, pair := range strings.Split(offsets, ",") {
+			partition, value, found := strings.Cut(strings.TrimSpace(pair), ":")
+			partitionID, err := strconv.ParseInt(partition, 10, 32)
+			if !found || err != nil {
+				return nil, fmt.Errorf("invalid partition:offset pair %q", pair)
+			}
+			start, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || start < 0 {
+				return nil, fmt.Errorf("invalid offset in %q", pair)
+			}
+			topic := KafkaTopic
+			from = append(from, kafka.TopicPartition{Topic: &topic, Partition: int32(partitionID), Offset: kafka.Offset(start)})
+		}
+		return from, nil
+	default:
+		at, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -since time: %w", err)
+		}
+		return replay.OffsetsForTime(at, ends)
+	}
+}
+
+// replayFilter selects the changes to replay. Empty sets match everything.
+type replayFilter struct {
+	tables     map[string]bool
+	operations map[string]bool
+	keys       map[string]bool
+}
+
+func (f replayFilter) empty() bool {
+	return len(f.tables) == 0 && len(f.operations) == 0 && len(f.keys) == 0
+}
+
+func (f replayFilter) matches(notification Notification, schema *Schema) bool {
+	if len(f.tables) > 0 && !f.tables[notification.Table] {
+		return false
+	}
+	if len(f.operations) > 0 && !f.operations[strings.ToUpper(notification.Operation)] {
+		return false
+	}
+	if len(f.keys) == 0 {
+		return true
+	}
+	var columns []string
+	if table, ok := schema.Table(notification.Table); ok {
+		columns = append(columns, table.PrimaryKey)
+	}
+	for _, relationship := range schema.RelationshipsFor(notification.Table) {
+		columns = append(columns, relationship.Left.Column, relationship.Right.Column)
+	}
+	for _, column := range columns {
+		if id, ok := documentIDFromValue(notification.Data[column]); ok && f.keys[id] {
+			return true
+		}
+	}
+	return false
+}
+
+func commaSet(list string) map[string]bool {
+	set := make(map[string]bool)
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			set[item] = true
+		}
+	}
+	return set
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"database/sql"
+	_ "embed"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+)
+
+const RelationshipManyToMany = "many_to_many"
+const RelationshipOneToMany = "one_to_many"
+
+const SoftDeleteDelete = "delete"
+const SoftDeleteHide = "hide"
+const DefaultSoftDeleteField = "deleted"
+
+const EvolutionIgnore = "ignore"
+const EvolutionAdd = "add"
+const EvolutionAlert = "alert"
+const EvolutionFail = "fail"
+const EvolutionOmit = "omit"
+
+//go:embed schema.yaml
+var defaultSchema []byte
+
+// Schema declares which source tables are synced and how their rows map to
+// Elasticsearch documents, and the databases other than PostgresURL they are
+// synced from.
+type Schema struct {
+	Tables        []TableConfig        `yaml:"tables" json:"tables"`
+	Relationships []RelationshipConfig `yaml:"relationships" json:"relationships"`
+	Sources       *SourcesConfig       `yaml:"sources" json:"sources"`
+
+	tablesByName        map[string]*TableConfig
+	relationshipsByName map[string][]*RelationshipConfig
+	watchedColumns      map[string]map[string]bool
+	tracker             *schemaTracker
+	sourceDBs           map[string]*sql.DB
+}
+
+// TableConfig maps a source table to its own index. Transforms rewrite each
+// decoded document, in order, before it is indexed.
+type TableConfig struct {
+	Name       string            `yaml:"name" json:"name"`
+	Index      string            `yaml:"index" json:"index"`
+	PrimaryKey string            `yaml:"primary_key" json:"primary_key"`
+	Columns    []ColumnConfig    `yaml:"columns" json:"columns"`
+	SoftDelete *SoftDeleteConfig `yaml:"soft_delete" json:"soft_delete"`
+	Transforms []TransformConfig `yaml:"transforms" json:"transforms"`
+	Evolution  *EvolutionConfig  `yaml:"evolution" json:"evolution"`
+
+	transformers []Transformer
+	knownColumns map[string]bool
+}
+
+// EvolutionConfig decides what happens when a table's rows stop matching its
+// declared columns after a schema change in Postgres. Added columns are
+// ignored (the default), indexed under their own name (add), or ignored and
+// alerted on (alert). Missing declared columns fail the row (the default),
+// are left out of the document (omit), or are left out and alerted on
+// (alert). Renames maps a declared column to the name it was renamed to, so
+// its field keeps being filled from the new column.
+type EvolutionConfig struct {
+	Added   string            `yaml:"added" json:"added"`
+	Removed string            `yaml:"removed" json:"removed"`
+	Renames map[string]string `yaml:"renames" json:"renames"`
+}
+
+// SoftDeleteConfig marks a row as deleted while Column is not NULL. In
+// "delete" mode the row's document is removed; in "hide" mode it is kept with
+// Field set to true. Either way the row's links are dropped from the
+// documents on the other side, and are restored when Column is cleared. On a
+// relationship only Column is used: a soft-deleted row is an absent link.
+type SoftDeleteConfig struct {
+	Column string `yaml:"column" json:"column"`
+	Mode   string `yaml:"mode" json:"mode"`
+	Field  string `yaml:"field" json:"field"`
+}
+
+// ColumnConfig maps a source column to a document field. Type is checked
+// while decoding rows; Null decides what happens to a NULL value. Mapping,
+// when set, is the field's Elasticsearch mapping in place of the one
+// infer-mappings derives from the column's Postgres type.
+type ColumnConfig struct {
+	Name    string                 `yaml:"name" json:"name"`
+	Field   string                 `yaml:"field" json:"field"`
+	Type    string                 `yaml:"type" json:"type"`
+	Null    string                 `yaml:"null" json:"null"`
+	Mapping map[string]interface{} `yaml:"mapping" json:"mapping"`
+}
+
+// RelationshipConfig declares a table whose rows link a document on the left
+// side to a document on the right side.
+type RelationshipConfig struct {
+	Table      string            `yaml:"table" json:"table"`
+	Type       string            `yaml:"type" json:"type"`
+	Left       RelationshipSide  `yaml:"left" json:"left"`
+	Right      RelationshipSide  `yaml:"right" json:"right"`
+	SoftDelete *SoftDeleteConfig `yaml:"soft_delete" json:"soft_delete"`
+}
+
+// RelationshipSide names the column holding one side's id and the array field
+// on that side's documents that collects the other side's ids. An empty Field
+// means that side's documents are not updated. Embed additionally keeps a
+// summary of each linked document from the other side.
+type RelationshipSide struct {
+	Column string       `yaml:"column" json:"column"`
+	Type   string       `yaml:"type" json:"type"`
+	Index  string       `yaml:"index" json:"index"`
+	Field  string       `yaml:"field" json:"field"`
+	Embed  *EmbedConfig `yaml:"embed" json:"embed"`
+
+	// entity is the table indexed into Index, when the schema declares one
+	entity *TableConfig
+}
+
+// EmbedConfig keeps, in the array Field, an object per linked document from
+// the other side holding its id and the listed Fields of that document.
+// Renaming the linked document rewrites its summary everywhere it is
+// embedded.
+type EmbedConfig struct {
+	Field  string   `yaml:"field" json:"field"`
+	Fields []string `yaml:"fields" json:"fields"`
+}
+
+// KeyField returns the document field holding the table's primary key, or ""
+// when the primary key is not indexed.
+func (t *TableConfig) KeyField() string {
+	for _, column := range t.Columns {
+		if column.Name == t.PrimaryKey {
+			return column.FieldName()
+		}
+	}
+	return ""
+}
+
+// FieldName returns the document field the column is written to.
+func (c ColumnConfig) FieldName() string {
+	if c.Field != "" {
+		return c.Field
+	}
+	return c.Name
+}
+
+// loadSchema reads the schema from path, or the embedded default when path is
+// empty. YAML is a superset of JSON, so both formats are accepted.
+func loadSchema(path string) (*Schema, error) {
+	data := defaultSchema
+	if path != "" {
+		var err error
+		data, err = os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading schema %s: %w", path, err)
+		}
+	}
+
+	var schema Schema
+	if err := yaml.Unmarshal(data, &schema); err != nil {
+		return nil, fmt.Errorf("parsing schema: %w", err)
+	}
+	if err := schema.init(); err != nil {
+		return nil, err
+	}
+	return &schema, nil
+}
+
+func (s *Schema) init() error {
+	s.tablesByName = make(map[string]*TableConfig)
+	s.relationshipsByName = make(map[string][]*RelationshipConfig)
+
+	for i := range s.Tables {
+		table := &s.Tables[i]
+		if table.Name == "" || table.Index == "" || table.PrimaryKey == "" {
+			return fmt.Errorf("schema: table %q needs a name, an index and a primary_key", table.Name)
+		}
+		if len(table.Columns) == 0 {
+			return fmt.Errorf("schema: table %s declares no columns", table.Name)
+		}
+		for _, column := range table.Columns {
+			if err := validateColumn(table.Name, column); err != nil {
+				return err
+			}
+		}
+		if err := validateSoftDelete(table.Name, table.SoftDelete, true); err != nil {
+			return err
+		}
+		if err := buildTransformers(table); err != nil {
+			return err
+		}
+		if err := validateEvolution(table); err != nil {
+			return err
+		}
+		table.knownColumns = table.declaredColumns()
+		if _, exists := s.tablesByName[table.Name]; exists {
+			return fmt.Errorf("schema: table %s is declared twice", table.Name)
+		}
+		s.tablesByName[table.Name] = table
+	}
+
+	for i := range s.Relationships {
+		rel := &s.Relationships[i]
+		if rel.Table == "" {
+			return errors.New("schema: relationship without a table")
+		}
+		switch rel.Type {
+		case RelationshipManyToMany:
+		case RelationshipOneToMany:
+			if rel.Right.Field != "" {
+				return fmt.Errorf("schema: one_to_many relationship %s can only keep ids on the left side", rel.Table)
+			}
+		default:
+			return fmt.Errorf("schema: relationship %s has unknown type %q", rel.Table, rel.Type)
+		}
+		for _, side := range []*RelationshipSide{&rel.Left, &rel.Right} {
+			if side.Column == "" || side.Index == "" {
+				return fmt.Errorf("schema: relationship %s needs a column and an index on both sides", rel.Table)
+			}
+			if !validColumnType(side.Type) {
+				return fmt.Errorf("schema: relationship %s column %s has unknown type %q", rel.Table, side.Column, side.Type)
+			}
+			for _, table := range s.tablesByName {
+				if table.Index == side.Index {
+					side.entity = table
+				}
+			}
+		}
+		for _, sides := range [][2]*RelationshipSide{{&rel.Left, &rel.Right}, {&rel.Right, &rel.Left}} {
+			if err := validateEmbed(rel.Table, sides[0], sides[1]); err != nil {
+				return err
+			}
+		}
+		if err := validateSoftDelete(rel.Table, rel.SoftDelete, false); err != nil {
+			return err
+		}
+		s.relationshipsByName[rel.Table] = append(s.relationshipsByName[rel.Table], rel)
+	}
+	if err := validateSources(s.Sources); err != nil {
+		return err
+	}
+	s.watchColumns()
+	return nil
+}
+
+func validateColumn(table string, column ColumnConfig) error {
+	if column.Name == "" {
+		return fmt.Errorf("schema: table %s has a column without a name", table)
+	}
+	if !validColumnType(column.Type) {
+		return fmt.Errorf("schema: column %s.%s has unknown type %q", table, column.Name, column.Type)
+	}
+	switch column.Null {
+	case "", NullPolicyAllow, NullPolicyOmit, NullPolicyReject:
+		return nil
+	default:
+		return fmt.Errorf("schema: column %s.%s has unknown null policy %q", table, column.Name, column.Null)
+	}
+}
+
+func validateSoftDelete(table string, config *SoftDeleteConfig, entity bool) error {
+	if config == nil {
+		return nil
+	}
+	if config.Column == "" {
+		return fmt.Errorf("schema: soft_delete of %s needs a column", table)
+	}
+	switch config.Mode {
+	case "":
+		config.Mode = SoftDeleteDelete
+	case SoftDeleteDelete:
+	case SoftDeleteHide:
+		if !entity {
+			return fmt.Errorf("schema: soft_delete of relationship %s can only use the delete mode", table)
+		}
+		if config.Field == "" {
+			config.Field = DefaultSoftDeleteField
+		}
+	default:
+		return fmt.Errorf("schema: soft_delete of %s has unknown mode %q", table, config.Mode)
+	}
+	return nil
+}
+
+func validateEvolution(table *TableConfig) error {
+	if table.Evolution == nil {
+		table.Evolution = &EvolutionConfig{}
+	}
+	evolution := table.Evolution
+	switch evolution.Added {
+	case "":
+		evolution.Added = EvolutionIgnore
+	case EvolutionIgnore, EvolutionAdd, EvolutionAlert:
+	default:
+		return fmt.Errorf("schema: evolution of %s has unknown rule %q for added columns", table.Name, evolution.Added)
+	}
+	switch evolution.Removed {
+	case "":
+		evolution.Removed = EvolutionFail
+	case EvolutionFail, EvolutionOmit, EvolutionAlert:
+	default:
+		return fmt.Errorf("schema: evolution of %s has unknown rule %q for removed columns", table.Name, evolution.Removed)
+	}
+	if _, renamed := evolution.Renames[table.PrimaryKey]; renamed {
+		return fmt.Errorf("schema: evolution of %s cannot rename the primary key %s", table.Name, table.PrimaryKey)
+	}
+	return nil
+}
+
+// declaredColumns returns every source column the schema reads from the
+// table: its columns, primary key, soft-delete column and the new names of
+// renamed columns.
+func (t *TableConfig) declaredColumns() map[string]bool {
+	columns := map[string]bool{t.PrimaryKey: true}
+	for _, column := range t.Columns {
+		columns[column.Name] = true
+	}
+	if t.SoftDelete != nil {
+		columns[t.SoftDelete.Column] = true
+	}
+	for _, renamed := range t.Evolution.Renames {
+		columns[renamed] = true
+	}
+	return columns
+}
+
+// sourceColumn returns the column of row holding the declared column name:
+// name itself or, once it has been renamed in Postgres, its new name.
+func (t *TableConfig) sourceColumn(name string, row map[string]interface{}) string {
+	if _, ok := row[name]; ok {
+		return name
+	}
+	if renamed, ok := t.Evolution.Renames[name]; ok {
+		if _, ok := row[renamed]; ok {
+			return renamed
+		}
+	}
+	return name
+}
+
+func validateEmbed(table string, own, other *RelationshipSide) error {
+	if own.Embed == nil {
+		return nil
+	}
+	switch {
+	case own.Field == "":
+		return fmt.Errorf("schema: relationship %s can only embed on the %s side alongside its id field", table, own.Index)
+	case own.Embed.Field == "" || len(own.Embed.Fields) == 0:
+		return fmt.Errorf("schema: embed on the %s side of relationship %s needs a field and fields", own.Index, table)
+	case other.entity == nil:
+		return fmt.Errorf("schema: relationship %s embeds %s documents, but no table is indexed into %s", table, other.Index, other.Index)
+	}
+	return nil
+}
+
+func validColumnType(columnType string) bool {
+	switch columnType {
+	case ColumnTypeAny, ColumnTypeInteger, ColumnTypeFloat, ColumnTypeString,
+		ColumnTypeBoolean, ColumnTypeTimestamp, ColumnTypeJSON:
+		return true
+	}
+	return false
+}
+
+// withIndexes returns a copy of the schema that writes only to the indexes
+// named in indexes, each replaced by the index it maps to. Tables and
+// relationship sides on any other index are dropped from the copy, which
+// keeps the schema's sources and their connections.
+func (s *Schema) withIndexes(indexes map[string]string) (*Schema, error) {
+	clone := &Schema{Sources: s.Sources, sourceDBs: s.sourceDBs}
+	for _, table := range s.Tables {
+		if renamed, ok := indexes[table.Index]; ok {
+			table.Index = renamed
+			clone.Tables = append(clone.Tables, table)
+		}
+	}
+	for _, relationship := range s.Relationships {
+		for _, side := range []*RelationshipSide{&relationship.Left, &relationship.Right} {
+			if renamed, ok := indexes[side.Index]; ok {
+				side.Index = renamed
+			} else {
+				side.Field = ""
+				side.Embed = nil
+			}
+		}
+		clone.Relationships = append(clone.Relationships, relationship)
+	}
+	if err := clone.init(); err != nil {
+		return nil, err
+	}
+	return clone, nil
+}
+
+// Table returns the entity mapping for a source table.
+func (s *Schema) Table(name string) (*TableConfig, bool) {
+	table, ok := s.tablesByName[name]
+	return table, ok
+}
+
+// RelationshipsFor returns the relationships whose rows live in a source table.
+func (s *Schema) RelationshipsFor(name string) []*RelationshipConfig {
+	return s.relationshipsByName[name]
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"log"
+	"os"
+)
+
+// ShadowFailedPrimary and ShadowFailedShadow label the side of a write that
+// failed when only one of them did.
+const ShadowFailedPrimary = "primary"
+const ShadowFailedShadow = "shadow"
+
+// shadowIndex is the name of the shadow of index.
+func shadowIndex(index string) string {
+	return index + ShadowIndexSuffix
+}
+
+// ensureShadowIndexes prepares a shadow index, named <index>_shadow, for
+// every definition in dir whose index the schema syncs, and returns the
+// indexes that have one. A shadow is created from its definition and filled
+// from its index; one built from another version of the definition is
+// dropped and built again, so bumping the version restarts an experiment.
+func ensureShadowIndexes(schema *Schema, esClient *elasticsearch.TypedClient, dir string) (map[string]bool, error) {
+	definitions, err := readIndexDefinitions(os.DirFS(dir), ".")
+	if err != nil {
+		return nil, err
+	}
+	synced := make(map[string]bool, len(schema.Tables))
+	for _, table := range schema.Tables {
+		synced[table.Index] = true
+	}
+
+	shadowed := make(map[string]bool, len(definitions))
+	for index, definition := range definitions {
+		if !synced[index] {
+			log.Printf("Ignoring shadow mapping for %s: no table is synced to it", index)
+			continue
+		}
+		name := shadowIndex(index)
+		current, err := getIndexes(esClient, name)
+		if err != nil {
+			return nil, err
+		}
+		if state, ok := current[name]; ok {
+			if mappingVersion(state) == definition.Version {
+				shadowed[index] = true
+				continue
+			}
+			if err := deleteIndex(esClient, name); err != nil {
+				return nil, err
+			}
+			log.Printf("Dropped shadow index %s built from mapping version %d", name, mappingVersion(state))
+		}
+		if err := createIndex(esClient, name, definition, ""); err != nil {
+			return nil, err
+		}
+		copied, err := copyIndex(esClient, index, name)
+		if err != nil {
+			return nil, fmt.Errorf("filling shadow index %s: %w", name, err)
+		}
+		log.Printf("Created shadow index %s (mapping version %d) with %d documents from %s", name, definition.Version, copied, index)
+		shadowed[index] = true
+	}
+	return shadowed, nil
+}
+
+// copyIndex copies every document of source into dest with the reindex API,
+// keeping their versions so that later versioned writes apply to both alike,
+// and returns how many documents were copied.
+func copyIndex(esClient *elasticsearch.TypedClient, source, dest string) (int, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"source": map[string]interface{}{"index": source},
+		"dest":   map[string]interface{}{"index": dest, "version_type": "external"},
+	})
+	if err != nil {
+		return 0, err
+	}
+	waitForCompletion := true
+	response, err := esapi.ReindexRequest{Body: bytes.NewReader(body), WaitForCompletion: &waitForCompletion}.Do(context.Background(), esClient)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	if response.IsError() {
+		return 0, newStatusError(response)
+	}
+
+	var result struct {
+		Created  int               `json:"created"`
+		Failures []json.RawMessage `json:"failures"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return 0, err
+	}
+	if len(result.Failures) > 0 {
+		return result.Created, fmt.Errorf("%d documents failed, first: %s", len(result.Failures), result.Failures[0])
+	}
+	return result.Created, nil
+}
+
+func deleteIndex(esClient *elasticsearch.TypedClient, indexName string) error {
+	response, err := esapi.IndicesDeleteRequest{Index: []string{indexName}}.Do(context.Background(), esClient)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.IsError() {
+		return fmt.Errorf("deleting index %s: %s", indexName, response.String())
+	}
+	return nil
+}
+
+// shadowWriter applies every write to the primary indexes and repeats the
+// writes to shadowed indexes on their shadows, so that an experimental
+// mapping sees the same live traffic. Shadow writes go through a throttle of
+// their own and are retried on rejection like primary ones, as a shadow that
+// missed writes would drift from its index and spoil the comparison. Writes
+// that fail on only one side are counted.
+type shadowWriter struct {
+	primary  *elasticsearchWriter
+	shadow   *elasticsearchWriter
+	shadowed map[string]bool
+}
+
+func newShadowWriter(primary *elasticsearchWriter, client *elasticsearch.TypedClient, shadowed map[string]bool) *shadowWriter {
+	shadow := newElasticsearchWriter(client, newUntrackedThrottle(WorkerCount, MinBulkActions, MaxBulkActions))
+	return &shadowWriter{primary: primary, shadow: shadow, shadowed: shadowed}
+}
+
+func (w *shadowWriter) Apply(operation, indexName, documentID string, document interface{}, version int64) error {
+	primaryErr := w.primary.Apply(operation, indexName, documentID, document, version)
+	if w.shadowed[indexName] {
+		shadowErr := w.shadow.Apply(operation, shadowIndex(indexName), documentID, document, version)
+		compareShadowWrite(indexName, applyRequest(operation), primaryErr != nil, shadowErr != nil)
+	}
+	return primaryErr
+}
+
+func (w *shadowWriter) Update(indexName, documentID string, query map[string]interface{}) error {
+	primaryErr := w.primary.Update(indexName, documentID, query)
+	if w.shadowed[indexName] {
+		shadowErr := w.shadow.Update(shadowIndex(indexName), documentID, query)
+		compareShadowWrite(indexName, RequestUpdate, primaryErr != nil, shadowErr != nil)
+	}
+	return primaryErr
+}
+
+func (w *shadowWriter) UpdateByQuery(indexName string, query map[string]interface{}) error {
+	primaryErr := w.primary.UpdateByQuery(indexName, query)
+	if w.shadowed[indexName] {
+		shadowErr := w.shadow.UpdateByQuery(shadowIndex(indexName), query)
+		compareShadowWrite(indexName, RequestUpdateByQuery, primaryErr != nil, shadowErr != nil)
+	}
+	return primaryErr
+}
+
+func (w *shadowWriter) Bulk() BatchWriter {
+	return &shadowBulkWriter{
+		primary:  newBulkWriter(w.primary.client, w.primary.throttle),
+		shadow:   newBulkWriter(w.shadow.client, w.shadow.throttle),
+		shadowed: w.shadowed,
+	}
+}
+
+// shadowBulkWriter collects a transaction's writes for the primary indexes
+// and for the shadows, and compares their outcomes write by write on Flush.
+type shadowBulkWriter struct {
+	primary  *bulkWriter
+	shadow   *bulkWriter
+	shadowed map[string]bool
+	writes   []shadowedWrite
+}
+
+// shadowedWrite pairs the numbers a write has in the primary and shadow
+// bulk writers.
+type shadowedWrite struct {
+	index, request        string
+	primarySeq, shadowSeq int
+}
+
+func (w *shadowBulkWriter) Apply(operation, indexName, documentID string, document interface{}, version int64) error {
+	return w.mirror(indexName, applyRequest(operation), func(writer *bulkWriter, index string) error {
+		return writer.Apply(operation, index, documentID, document, version)
+	})
+}
+
+func (w *shadowBulkWriter) Update(indexName, documentID string, query map[string]interface{}) error {
+	return w.mirror(indexName, RequestUpdate, func(writer *bulkWriter, index string) error {
+		return writer.Update(index, documentID, query)
+	})
+}
+
+func (w *shadowBulkWriter) UpdateByQuery(indexName string, query map[string]interface{}) error {
+	return w.mirror(indexName, RequestUpdateByQuery, func(writer *bulkWriter, index string) error {
+		return writer.UpdateByQuery(index, query)
+	})
+}
+
+// mirror collects a write for the primary index and, when it is shadowed and
+// the primary collected it, for the shadow. It returns the primary's error.
+func (w *shadowBulkWriter) mirror(indexName, request string, write func(writer *bulkWriter, index string) error) error {
+	primarySeq := w.primary.written
+	err := write(w.primary, indexName)
+	if !w.shadowed[indexName] || w.primary.written == primarySeq {
+		return err
+	}
+	shadowSeq := w.shadow.written
+	write(w.shadow, shadowIndex(indexName))
+	if w.shadow.written > shadowSeq {
+		w.writes = append(w.writes, shadowedWrite{index: indexName, request: request, primarySeq: primarySeq, shadowSeq: shadowSeq})
+	}
+	return err
+}
+
+// Flush sends the primary writes, then the shadow writes, and returns the
+// primary's error. Writes whose primary failed are compared again when the
+// next Flush retries them.
+func (w *shadowBulkWriter) Flush() error {
+	err := w.primary.Flush()
+	if shadowErr := w.shadow.Flush(); shadowErr != nil {
+		log.Printf("Error applying shadow writes: %v", shadowErr)
+	}
+	var retried []shadowedWrite
+	for _, write := range w.writes {
+		compareShadowWrite(write.index, write.request, w.primary.failed[write.primarySeq], w.shadow.failed[write.shadowSeq])
+		if w.primary.failed[write.primarySeq] {
+			retried = append(retried, write)
+		}
+	}
+	w.writes = retried
+	return err
+}
+
+// applyRequest names the request Apply makes for operation.
+func applyRequest(operation string) string {
+	if operation == OperationDelete {
+		return RequestDelete
+	}
+	return RequestIndex
+}
+
+// compareShadowWrite records a write that failed on only one of index and its
+// shadow.
+func compareShadowWrite(index, request string, primaryFailed, shadowFailed bool) {
+	switch {
+	case primaryFailed && !shadowFailed:
+		shadowWriteMismatches.WithLabelValues(index, request, ShadowFailedPrimary).Inc()
+		log.Printf("Shadow mismatch: %s on %s failed but succeeded on its shadow", request, index)
+	case shadowFailed && !primaryFailed:
+		shadowWriteMismatches.WithLabelValues(index, request, ShadowFailedShadow).Inc()
+		log.Printf("Shadow mismatch: %s on %s succeeded but failed on its shadow", request, index)
+	}
+}
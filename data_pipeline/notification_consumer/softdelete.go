@@ -0,0 +1,143 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// IsDeleted reports whether a row image is soft-deleted. A nil config never
+// is.
+func (c *SoftDeleteConfig) IsDeleted(row map[string]interface{}) bool {
+	return c != nil && row[c.Column] != nil
+}
+
+// Hides reports whether soft-deleted rows keep a flagged document.
+func (c *SoftDeleteConfig) Hides() bool {
+	return c != nil && c.Mode == SoftDeleteHide
+}
+
+// liveCondition is an SQL condition on the rows aliased alias that holds for
+// rows that are not soft-deleted. With withHidden it also holds for hidden
+// rows, whose documents still exist.
+func (c *SoftDeleteConfig) liveCondition(alias string, withHidden bool) string {
+	if c == nil || (withHidden && c.Hides()) {
+		return "TRUE"
+	}
+	return fmt.Sprintf("%s.%s IS NULL", alias, quoteIdentifier(c.Column))
+}
+
+// markSoftDeleted sets the hidden flag of a document in a table that hides
+// soft-deleted rows, and leaves other documents alone.
+func markSoftDeleted(table *TableConfig, row, document map[string]interface{}) {
+	if table.SoftDelete.Hides() {
+		document[table.SoftDelete.Field] = table.SoftDelete.IsDeleted(row)
+	}
+}
+
+// entityCondition is an SQL condition on join rows aliased j that holds when
+// the entity on side is live, or merely hidden when withHidden is set.
+func entityCondition(side RelationshipSide, withHidden bool) string {
+	if side.entity == nil || side.entity.SoftDelete == nil || (withHidden && side.entity.SoftDelete.Hides()) {
+		return "TRUE"
+	}
+	return fmt.Sprintf("EXISTS (SELECT 1 FROM %s o WHERE o.%s = j.%s AND %s)",
+		quoteIdentifier(side.entity.Name), quoteIdentifier(side.entity.PrimaryKey), quoteIdentifier(side.Column),
+		side.entity.SoftDelete.liveCondition("o", false))
+}
+
+// shownLinkCondition is an SQL condition on join rows aliased j that keeps
+// the links documents show: the join row and the entity on the other side are
+// both live.
+func shownLinkCondition(relationship *RelationshipConfig, other RelationshipSide) string {
+	return relationship.SoftDelete.liveCondition("j", false) + " AND " + entityCondition(other, false)
+}
+
+// entityLive reports whether the entity with id on side is not soft-deleted.
+// Sides without a soft-deleting table always are, and so is an entity whose
+// state cannot be read, so that a failed lookup does not drop a link.
+func entityLive(db *sql.DB, side RelationshipSide, id interface{}) bool {
+	if side.entity == nil || side.entity.SoftDelete == nil {
+		return true
+	}
+	query := fmt.Sprintf(`SELECT NOT EXISTS (SELECT 1 FROM %s o WHERE o.%s = $1 AND o.%s IS NOT NULL)`,
+		quoteIdentifier(side.entity.Name), quoteIdentifier(side.entity.PrimaryKey), quoteIdentifier(side.entity.SoftDelete.Column))
+	var live bool
+	if err := db.QueryRow(query, id).Scan(&live); err != nil {
+		log.Printf("Error checking whether %s %v is soft-deleted: %v", side.entity.Name, id, err)
+		return true
+	}
+	return live
+}
+
+// entityExists reports whether the entity with id on side still has its row
+// in Postgres. When that cannot be checked the row is assumed to exist.
+func entityExists(db *sql.DB, side RelationshipSide, id interface{}) bool {
+	query := fmt.Sprintf(`SELECT EXISTS (SELECT 1 FROM %s o WHERE o.%s = $1)`,
+		quoteIdentifier(side.entity.Name), quoteIdentifier(side.entity.PrimaryKey))
+	var exists bool
+	if err := db.QueryRow(query, id).Scan(&exists); err != nil {
+		log.Printf("Error checking whether %s %v exists: %v", side.entity.Name, id, err)
+		return true
+	}
+	return exists
+}
+
+// sideHides reports whether the entity table on side keeps flagged documents
+// for soft-deleted rows.
+func sideHides(side RelationshipSide) bool {
+	return side.entity != nil && side.entity.SoftDelete.Hides()
+}
+
+// syncSoftDeletedLinks removes a soft-deleted entity's id from the documents
+// it is linked to, or adds it back once the entity is restored, as of the
+// version of the change that deleted or restored it.
+func syncSoftDeletedLinks(db *sql.DB, schema *Schema, table *TableConfig, documentID string, deleted bool, version int64, writer DocumentWriter) error {
+	for i := range schema.Relationships {
+		relationship := &schema.Relationships[i]
+		for _, ownIsLeft := range []bool{true, false} {
+			own, other := relationship.Left, relationship.Right
+			if !ownIsLeft {
+				own, other = other, own
+			}
+			if own.Index != table.Index || other.Field == "" {
+				continue
+			}
+
+			// Removing touches every linked document that still exists;
+			// restoring only re-adds the links documents would show
+			condition := entityCondition(other, true)
+			if !deleted {
+				condition = shownLinkCondition(relationship, other)
+			}
+			query := fmt.Sprintf(`SELECT row_to_json(j) FROM %s j WHERE j.%s = $1 AND %s`,
+				quoteIdentifier(relationship.Table), quoteIdentifier(own.Column), condition)
+			rows, err := db.Query(query, documentID)
+			if err != nil {
+				return err
+			}
+			links, err := scanJSONRows(rows)
+			if err != nil {
+				return err
+			}
+			for _, link := range links {
+				ownID, otherID, err := decodeRelationshipIDs(relationship, link)
+				if err != nil {
+					log.Printf("Skipping %s link of %s %s: %v", relationship.Table, table.Name, documentID, err)
+					continue
+				}
+				if !ownIsLeft {
+					ownID, otherID = otherID, ownID
+				}
+				var summary map[string]interface{}
+				if !deleted {
+					summary = loadSummary(db, other, own, ownID)
+				}
+				if err := updateRelationshipSide(db, other, otherID, ownID, !deleted, summary, version, writer); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+)
+
+const SourceRoutingShared = "shared"
+const SourceRoutingIndex = "index"
+
+// SourceField is the document field holding the source a document came from,
+// in shared indexes.
+const SourceField = "source"
+
+// validSourceName keeps source tags usable in index names and document ids.
+var validSourceName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// SourcesConfig declares the Postgres databases, other than PostgresURL, that
+// change events come from, tagged by the producer with the source's name.
+// Routing decides where their documents go: into the schema's indexes,
+// shared by every source, with a source field and ids prefixed with
+// "<source>:" (shared, the default), or into an index of their own per
+// source named <index>_<source> (index). Change events without a source
+// come from PostgresURL and are written as they always were.
+type SourcesConfig struct {
+	Routing   string           `yaml:"routing" json:"routing"`
+	Databases []SourceDatabase `yaml:"databases" json:"databases"`
+}
+
+// SourceDatabase is the connection to a source's database, which relationship
+// arrays and summaries of its documents are read from.
+type SourceDatabase struct {
+	Name string `yaml:"name" json:"name"`
+	URL  string `yaml:"url" json:"url"`
+}
+
+func validateSources(sources *SourcesConfig) error {
+	if sources == nil {
+		return nil
+	}
+	switch sources.Routing {
+	case "":
+		sources.Routing = SourceRoutingShared
+	case SourceRoutingShared, SourceRoutingIndex:
+	default:
+		return fmt.Errorf("schema: sources have unknown routing %q", sources.Routing)
+	}
+	seen := make(map[string]bool, len(sources.Databases))
+	for _, database := range sources.Databases {
+		if !validSourceName.MatchString(database.Name) {
+			return fmt.Errorf("schema: source name %q must be lowercase letters, digits, '-' and '_'", database.Name)
+		}
+		if seen[database.Name] {
+			return fmt.Errorf("schema: source %s is declared twice", database.Name)
+		}
+		seen[database.Name] = true
+		if database.URL == "" {
+			return fmt.Errorf("schema: source %s has no url", database.Name)
+		}
+	}
+	return nil
+}
+
+// OpenSources opens the database of every declared source.
+func (s *Schema) OpenSources() error {
+	if s.Sources == nil {
+		return nil
+	}
+	s.sourceDBs = make(map[string]*sql.DB, len(s.Sources.Databases))
+	for _, database := range s.Sources.Databases {
+		db, err := sql.Open("postgres", database.URL)
+		if err != nil {
+			return fmt.Errorf("connecting to source %s: %w", database.Name, err)
+		}
+		s.sourceDBs[database.Name] = db
+	}
+	return nil
+}
+
+func (s *Schema) CloseSources() {
+	for _, db := range s.sourceDBs {
+		db.Close()
+	}
+}
+
+// SourceNames returns the names of the declared sources.
+func (s *Schema) SourceNames() []string {
+	if s.Sources == nil {
+		return nil
+	}
+	names := make([]string, len(s.Sources.Databases))
+	for i, database := range s.Sources.Databases {
+		names[i] = database.Name
+	}
+	return names
+}
+
+// singleSource fails a command that reads from PostgresURL alone when the
+// schema declares other sources, whose documents it would miss or clobber.
+func (s *Schema) singleSource(command string) error {
+	if s.Sources == nil || len(s.Sources.Databases) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s only reads the database at PostgresURL and does not support the sources the schema declares", command)
+}
+
+// routeSource returns the database to read a change event's rows from and
+// the writer that routes its documents, for the source that tagged it.
+func (s *Schema) routeSource(source string, db *sql.DB, writer DocumentWriter) (*sql.DB, DocumentWriter, error) {
+	if source == "" {
+		return db, writer, nil
+	}
+	sourceDB, ok := s.sourceDBs[source]
+	if !ok {
+		return nil, nil, fmt.Errorf("change event from undeclared source %q", source)
+	}
+	return sourceDB, &sourceWriter{writer: writer, source: source, routing: s.Sources.Routing}, nil
+}
+
+// sourceIndex is the index of a source's documents for index, with index
+// routing.
+func sourceIndex(index, source string) string {
+	return index + "_" + source
+}
+
+// sourceDocumentID is the id of a source's document in a shared index.
+func sourceDocumentID(source, id string) string {
+	return source + ":" + id
+}
+
+// sourceKey scopes an ordering or state key to the source of a change event.
+func sourceKey(source, key string) string {
+	if source == "" {
+		return key
+	}
+	return source + "/" + key
+}
+
+// sourceWriter writes a source's documents where its routing puts them. With
+// index routing every write goes to the source's own index. With shared
+// routing documents get the source field and prefixed ids, and updates by
+// query only touch the source's documents. Ids inside documents, such as
+// relationship arrays and summaries, are left as Postgres has them: they
+// refer to documents of the same source.
+type sourceWriter struct {
+	writer  DocumentWriter
+	source  string
+	routing string
+}
+
+func (w *sourceWriter) Apply(operation, indexName, documentID string, document interface{}, version int64) error {
+	if w.routing == SourceRoutingIndex {
+		return w.writer.Apply(operation, sourceIndex(indexName, w.source), documentID, document, version)
+	}
+	return w.writer.Apply(operation, indexName, sourceDocumentID(w.source, documentID), w.tag(document), version)
+}
+
+func (w *sourceWriter) Update(indexName, documentID string, query map[string]interface{}) error {
+	if w.routing == SourceRoutingIndex {
+		return w.writer.Update(sourceIndex(indexName, w.source), documentID, query)
+	}
+	if upsert, ok := query["upsert"]; ok {
+		query = copyQuery(query)
+		query["upsert"] = w.tag(upsert)
+	}
+	return w.writer.Update(indexName, sourceDocumentID(w.source, documentID), query)
+}
+
+func (w *sourceWriter) UpdateByQuery(indexName string, query map[string]interface{}) error {
+	if w.routing == SourceRoutingIndex {
+		return w.writer.UpdateByQuery(sourceIndex(indexName, w.source), query)
+	}
+	filtered := copyQuery(query)
+	filtered["query"] = map[string]interface{}{
+		"bool": map[string]interface{}{
+			"filter": []interface{}{
+				query["query"],
+				map[string]interface{}{"term": map[string]interface{}{SourceField: w.source}},
+			},
+		},
+	}
+	return w.writer.UpdateByQuery(indexName, filtered)
+}
+
+// tag returns a copy of document with the source field set.
+func (w *sourceWriter) tag(document interface{}) interface{} {
+	fields, ok := document.(map[string]interface{})
+	if !ok {
+		return document
+	}
+	tagged := make(map[string]interface{}, len(fields)+1)
+	for field, value := range fields {
+		tagged[field] = value
+	}
+	tagged[SourceField] = w.source
+	return tagged
+}
+
+func copyQuery(query map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(query))
+	for key, value := range query {
+		copied[key] = value
+	}
+	return copied
+}
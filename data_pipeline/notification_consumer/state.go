@@ -0,0 +1,232 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"log"
+	"strconv"
+)
+
+// stateVersionHeader is the header that carries the version of the change a
+// state record comes from.
+const stateVersionHeader = "version"
+
+// StateLog publishes the latest image of every synced row to a log-compacted
+// topic, keyed by table and primary key, so that the topic alone holds the
+// current contents of the source tables. Deleted rows are published as
+// tombstones. A nil StateLog publishes nothing.
+type StateLog struct {
+	producer *kafka.Producer
+	topic    string
+}
+
+func newStateLog(brokers, topic string) (*StateLog, error) {
+	producer, err := kafka.NewProducer(&kafka.ConfigMap{
+		"bootstrap.servers": brokers,
+		// Keep the records for one key in the order they were produced
+		"enable.idempotence": true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	stateLog := &StateLog{producer: producer, topic: topic}
+	go stateLog.reportFailures()
+	return stateLog, nil
+}
+
+// Record publishes the state a processed change leaves its row in. Every
+// record carries the change's version, tombstones in a header as they have no
+// value, so that readers can keep the newest state of a row whatever order
+// its records were published in.
+func (l *StateLog) Record(notification Notification, schema *Schema) {
+	if l == nil {
+		return
+	}
+	for _, entry := range stateEntries(notification, schema) {
+		var value []byte
+		if entry.Data != nil {
+			record := Notification{
+				Table:     notification.Table,
+				Operation: notification.Operation,
+				Version:   notification.Version,
+				Data:      entry.Data,
+			}
+			var err error
+			if value, err = json.Marshal(record); err != nil {
+				log.Printf("Error encoding state of %s: %v", entry.Key, err)
+				continue
+			}
+		}
+		l.produce(entry.Key, value, notification.Version)
+	}
+}
+
+func (l *StateLog) produce(key string, value []byte, version int64) {
+	message := &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &l.topic, Partition: kafka.PartitionAny},
+		Key:            []byte(key),
+		Value:          value,
+		Headers:        []kafka.Header{{Key: stateVersionHeader, Value: []byte(strconv.FormatInt(version, 10))}},
+	}
+	if err := l.producer.Produce(message, nil); err != nil {
+		log.Printf("Error publishing state of %s to %s: %v", key, l.topic, err)
+	}
+}
+
+// reportFailures logs the records the producer could not deliver.
+func (l *StateLog) reportFailures() {
+	for event := range l.producer.Events() {
+		if message, ok := event.(*kafka.Message); ok && message.TopicPartition.Error != nil {
+			log.Printf("State delivery of %s failed: %v", message.Key, message.TopicPartition.Error)
+		}
+	}
+}
+
+func (l *StateLog) Close() {
+	if l == nil {
+		return
+	}
+	l.producer.Flush(5000)
+	l.producer.Close()
+}
+
+// seedState publishes the current image of every row of the schema's tables
+// and relationship tables, read from Postgres, so that the topic also holds
+// the rows that have not changed since the consumer started publishing. The
+// images are versioned with the WAL position from before they were read, so
+// changes made while they are read are newer. It returns the number of rows
+// published.
+func seedState(db *sql.DB, schema *Schema, stateLog *StateLog) (int, error) {
+	var version int64
+	if err := db.QueryRow(`SELECT (pg_current_wal_insert_lsn() - '0/0'::pg_lsn)::bigint`).Scan(&version); err != nil {
+		return 0, fmt.Errorf("reading the WAL position: %w", err)
+	}
+	var tables []string
+	seen := make(map[string]bool)
+	for i := range schema.Tables {
+		seen[schema.Tables[i].Name] = true
+		tables = append(tables, schema.Tables[i].Name)
+	}
+	for i := range schema.Relationships {
+		if table := schema.Relationships[i].Table; !seen[table] {
+			seen[table] = true
+			tables = append(tables, table)
+		}
+	}
+
+	total := 0
+	for _, table := range tables {
+		rows, err := db.Query(fmt.Sprintf(`SELECT row_to_json(t) FROM %s t`, quoteIdentifier(table)))
+		if err != nil {
+			return total, fmt.Errorf("reading %s: %w", table, err)
+		}
+		for rows.Next() {
+			var raw []byte
+			var row map[string]interface{}
+			if err := rows.Scan(&raw); err == nil {
+				err = json.Unmarshal(raw, &row)
+			}
+			if err != nil {
+				rows.Close()
+				return total, fmt.Errorf("reading %s: %w", table, err)
+			}
+			stateLog.Record(Notification{Table: table, Operation: OperationInsert, Version: version, Data: row}, schema)
+			total++
+		}
+		if err := rows.Close(); err != nil {
+			return total, err
+		}
+		if err := rows.Err(); err != nil {
+			return total, fmt.Errorf("reading %s: %w", table, err)
+		}
+	}
+	return total, nil
+}
+
+// stateEntry is one record a change leaves in the state topic: a row image
+// under Key, or a tombstone when Data is nil.
+type stateEntry struct {
+	Key  string
+	Data map[string]interface{}
+}
+
+// stateEntries returns the records a processed change leaves in the state
+// topic: the new row image, a tombstone for a deleted row, and also a
+// tombstone for the old key of a row whose key changed.
+func stateEntries(notification Notification, schema *Schema) []stateEntry {
+	if notification.Operation == OperationCommit {
+		return nil
+	}
+	key, ok := stateKey(notification.Table, notification.Data, schema)
+	if !ok {
+		return nil
+	}
+	if notification.Operation == OperationDelete {
+		return []stateEntry{{Key: key}}
+	}
+	var entries []stateEntry
+	if notification.Old != nil {
+		if oldKey, ok := stateKey(notification.Table, notification.Old, schema); ok && oldKey != key {
+			entries = append(entries, stateEntry{Key: oldKey})
+		}
+	}
+	return append(entries, stateEntry{Key: key, Data: notification.Data})
+}
+
+// rowState is the latest image of a row and the version of the change that
+// left the row so. A deleted row keeps its version without an image, so that
+// an older image read after the tombstone does not bring it back.
+type rowState struct {
+	Version int64
+	Data    map[string]interface{}
+}
+
+// stateStore holds row state by table and state key. Consumers working on
+// different partitions can publish the changes to one row out of order, so
+// state is kept by version rather than by arrival: a record only replaces one
+// of the same or an older version.
+type stateStore map[string]map[string]rowState
+
+func (s stateStore) set(table, key string, version int64, data map[string]interface{}) {
+	rows := s[table]
+	if rows == nil {
+		rows = make(map[string]rowState)
+		s[table] = rows
+	}
+	if current, ok := rows[key]; ok && current.Version > version {
+		return
+	}
+	rows[key] = rowState{Version: version, Data: data}
+}
+
+// Apply brings the store in line with a change, as publishing the state the
+// change leaves its row in would.
+func (s stateStore) Apply(notification Notification, schema *Schema) {
+	for _, entry := range stateEntries(notification, schema) {
+		s.set(notification.Table, entry.Key, notification.Version, entry.Data)
+	}
+}
+
+// stateKey is the state topic key of a row: table:pk for entity tables, and
+// table:left:right for relationship tables, whose rows are identified by the
+// link they make.
+func stateKey(tableName string, row map[string]interface{}, schema *Schema) (string, bool) {
+	if table, ok := schema.Table(tableName); ok {
+		id, ok := documentIDFromValue(row[table.PrimaryKey])
+		return entityStateKey(tableName, id), ok
+	}
+	for _, relationship := range schema.RelationshipsFor(tableName) {
+		leftID, leftOK := documentIDFromValue(row[relationship.Left.Column])
+		rightID, rightOK := documentIDFromValue(row[relationship.Right.Column])
+		return tableName + ":" + leftID + ":" + rightID, leftOK && rightOK
+	}
+	return "", false
+}
+
+// entityStateKey is the state topic key of the row of an entity table whose
+// document has id documentID.
+func entityStateKey(tableName, documentID string) string {
+	return tableName + ":" + documentID
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"github.com/elastic/go-elasticsearch/v8/typedapi/types"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rejectionErrorTypes are the Elasticsearch errors that mean the cluster is
+// overloaded rather than that the write is wrong.
+var rejectionErrorTypes = []string{"es_rejected_execution_exception", "circuit_breaking_exception"}
+
+// statusError is an error response from Elasticsearch.
+type statusError struct {
+	Status int
+	Body   string
+}
+
+func newStatusError(response *esapi.Response) *statusError {
+	body, _ := io.ReadAll(response.Body)
+	return &statusError{Status: response.StatusCode, Body: string(body)}
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("status %d: %s", e.Status, e.Body)
+}
+
+// isRejection reports whether Elasticsearch turned a write away because it is
+// overloaded, with a 429 or a circuit breaker, so that it should be retried
+// later instead of dropped.
+func isRejection(err error) bool {
+	var esErr *types.ElasticsearchError
+	if errors.As(err, &esErr) {
+		return esErr.Status == http.StatusTooManyRequests || isRejectionType(esErr.ErrorCause.Type)
+	}
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		return isRejectionStatus(statusErr.Status, statusErr.Body)
+	}
+	return false
+}
+
+// isRejectionStatus checks an HTTP status and error body, such as those of
+// the items of a bulk response.
+func isRejectionStatus(status int, body string) bool {
+	return status == http.StatusTooManyRequests || isRejectionType(body)
+}
+
+func isRejectionType(text string) bool {
+	for _, rejection := range rejectionErrorTypes {
+		if strings.Contains(text, rejection) {
+			return true
+		}
+	}
+	return false
+}
+
+// Throttle adapts how hard the consumer writes to Elasticsearch. It limits
+// the number of concurrent write requests and the number of actions per bulk
+// request, halving both whenever Elasticsearch rejects a write and growing
+// them again step by step while writes succeed (additive increase,
+// multiplicative decrease). While writes are being rejected the poll loop
+// pauses its partitions, so a burst slows the pipeline down instead of
+// piling up in memory.
+//
+// A nil *Throttle does not limit anything, but writes run through it are
+// still retried on rejection.
+type Throttle struct {
+	mu        sync.Mutex
+	available *sync.Cond
+
+	limit, maxLimit            int // concurrent writes allowed
+	inFlight                   int
+	bulkSize, minBulk, maxBulk int
+	successes                  int // since the last increase
+	lastRejection              time.Time
+	tracked                    bool // limits and rejections are published as metrics
+}
+
+func newThrottle(maxConcurrency, minBulk, maxBulk int) *Throttle {
+	throttle := newUntrackedThrottle(maxConcurrency, minBulk, maxBulk)
+	throttle.tracked = true
+	throttle.record()
+	return throttle
+}
+
+// newUntrackedThrottle returns a Throttle whose limits and rejections are
+// kept out of the consumer's metrics, for writes that are not part of the
+// sync itself, such as those to shadow indexes.
+func newUntrackedThrottle(maxConcurrency, minBulk, maxBulk int) *Throttle {
+	throttle := &Throttle{
+		limit:    maxConcurrency,
+		maxLimit: maxConcurrency,
+		bulkSize: maxBulk,
+		minBulk:  minBulk,
+		maxBulk:  maxBulk,
+	}
+	throttle.available = sync.NewCond(&throttle.mu)
+	return throttle
+}
+
+// Do runs write, which reports whether Elasticsearch rejected it, within the
+// concurrency limit, and retries it with exponential backoff for as long as
+// it is rejected.
+func (t *Throttle) Do(write func() (rejected bool)) {
+	for attempt := 0; ; attempt++ {
+		t.acquire()
+		rejected := write()
+		t.release(rejected)
+		if !rejected {
+			return
+		}
+		wait := RejectionBackoff << attempt
+		if wait > MaxRejectionBackoff || wait <= 0 {
+			wait = MaxRejectionBackoff
+		}
+		log.Printf("Elasticsearch rejected a write, retrying in %v", wait)
+		time.Sleep(wait)
+	}
+}
+
+func (t *Throttle) acquire() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for t.inFlight >= t.limit {
+		t.available.Wait()
+	}
+	t.inFlight++
+}
+
+func (t *Throttle) release(rejected bool) {
+	if t == nil {
+		if rejected {
+			writeRejections.Inc()
+		}
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.inFlight--
+	if rejected {
+		if t.tracked {
+			writeRejections.Inc()
+		}
+		t.lastRejection = time.Now()
+		t.successes = 0
+		if t.limit /= 2; t.limit < 1 {
+			t.limit = 1
+		}
+		if t.bulkSize /= 2; t.bulkSize < t.minBulk {
+			t.bulkSize = t.minBulk
+		}
+	} else {
+		// Grow once per round of successful writes at the current limit
+		t.successes++
+		if t.successes >= t.limit {
+			t.successes = 0
+			if t.limit < t.maxLimit {
+				t.limit++
+			}
+			if t.bulkSize += BulkSizeStep; t.bulkSize > t.maxBulk {
+				t.bulkSize = t.maxBulk
+			}
+		}
+	}
+	t.record()
+	t.available.Broadcast()
+}
+
+// BulkSize returns the number of actions to send per bulk request.
+func (t *Throttle) BulkSize() int {
+	if t == nil {
+		return MaxBulkActions
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.bulkSize
+}
+
+// Throttled reports whether Elasticsearch rejected a write within the last
+// ThrottleCooldown, in which case consumption should stay paused.
+func (t *Throttle) Throttled() bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return time.Since(t.lastRejection) < ThrottleCooldown
+}
+
+// record publishes the current limits; the caller holds t.mu.
+func (t *Throttle) record() {
+	if !t.tracked {
+		return
+	}
+	writeConcurrency.Set(float64(t.limit))
+	bulkSize.Set(float64(t.bulkSize))
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/elastic/go-elasticsearch/v8"
+	"log"
+	"net/http"
+	"time"
+)
+
+// transactionBuffer holds the changes of each Postgres transaction until its
+// COMMIT marker and every change the marker counts have arrived. The producer
+// keys a transaction's messages by its txid, so they share a partition and
+// reach the same consumer; they are gathered by source and txid, as txids
+// are only unique within a database. It is only used from the poll loop.
+type transactionBuffer struct {
+	pending    map[transactionKey]*pendingTransaction
+	maxChanges int
+}
+
+type transactionKey struct {
+	source string
+	txid   int64
+}
+
+// pendingTransaction is a transaction, or the part of it not yet applied.
+type pendingTransaction struct {
+	Source    string
+	TxID      int64
+	Changes   []bufferedChange
+	Positions []kafka.TopicPartition // every message held, markers included
+	Complete  bool
+
+	markers   []bufferedChange // COMMIT markers held
+	received  int              // changes received, including chunks already applied
+	expected  int              // changes counted by the COMMIT markers seen so far
+	firstSeen time.Time
+}
+
+type bufferedChange struct {
+	message      *kafka.Message
+	notification Notification
+}
+
+func newTransactionBuffer(maxChanges int) *transactionBuffer {
+	return &transactionBuffer{pending: make(map[transactionKey]*pendingTransaction), maxChanges: maxChanges}
+}
+
+// Add buffers a change or COMMIT marker and returns the transaction once it
+// is complete. A transaction that grows past maxChanges is returned in chunks
+// of that size instead, giving up atomicity to bound memory.
+func (b *transactionBuffer) Add(message *kafka.Message, notification Notification) *pendingTransaction {
+	key := transactionKey{source: notification.Source, txid: notification.TxID}
+	transaction, ok := b.pending[key]
+	if !ok {
+		transaction = &pendingTransaction{Source: notification.Source, TxID: notification.TxID, firstSeen: time.Now()}
+		b.pending[key] = transaction
+	}
+	transaction.Positions = append(transaction.Positions, message.TopicPartition)
+	if notification.Operation == OperationCommit {
+		transaction.markers = append(transaction.markers, bufferedChange{message: message, notification: notification})
+		transaction.expected += notification.Count
+	} else {
+		transaction.Changes = append(transaction.Changes, bufferedChange{message: message, notification: notification})
+		transaction.received++
+	}
+
+	if transaction.expected > 0 && transaction.received >= transaction.expected {
+		delete(b.pending, key)
+		transaction.Complete = true
+		return transaction
+	}
+	if b.maxChanges > 0 && len(transaction.Changes) >= b.maxChanges {
+		chunk := &pendingTransaction{Source: transaction.Source, TxID: transaction.TxID, Changes: transaction.Changes, Positions: transaction.Positions}
+		transaction.Changes, transaction.Positions, transaction.markers = nil, nil, nil
+		return chunk
+	}
+	return nil
+}
+
+// Expired removes and returns the transactions still incomplete after
+// timeout, for example because their marker was lost, so that they are
+// applied as they are rather than held forever.
+func (b *transactionBuffer) Expired(timeout time.Duration) []*pendingTransaction {
+	var expired []*pendingTransaction
+	for key, transaction := range b.pending {
+		if time.Since(transaction.firstSeen) >= timeout {
+			delete(b.pending, key)
+			expired = append(expired, transaction)
+		}
+	}
+	return expired
+}
+
+// Forget drops the parts of pending transactions read from partitions this
+// consumer no longer owns. Their next owner reads those messages again, so
+// keeping them would apply them twice, here on expiry and there, and count
+// them twice should the partitions come back. A transaction left with no
+// messages is dropped altogether.
+func (b *transactionBuffer) Forget(partitions []kafka.TopicPartition) {
+	revoked := make(map[partitionKey]bool, len(partitions))
+	for _, partition := range partitions {
+		revoked[partitionKey{topic: *partition.Topic, partition: partition.Partition}] = true
+	}
+	owned := func(position kafka.TopicPartition) bool {
+		return !revoked[partitionKey{topic: *position.Topic, partition: position.Partition}]
+	}
+
+	for key, transaction := range b.pending {
+		var changes, markers []bufferedChange
+		for _, change := range transaction.Changes {
+			if owned(change.message.TopicPartition) {
+				changes = append(changes, change)
+			} else {
+				transaction.received--
+			}
+		}
+		for _, marker := range transaction.markers {
+			if owned(marker.message.TopicPartition) {
+				markers = append(markers, marker)
+			} else {
+				transaction.expected -= marker.notification.Count
+			}
+		}
+		var positions []kafka.TopicPartition
+		for _, position := range transaction.Positions {
+			if owned(position) {
+				positions = append(positions, position)
+			}
+		}
+		transaction.Changes, transaction.markers, transaction.Positions = changes, markers, positions
+		if len(positions) == 0 {
+			delete(b.pending, key)
+		}
+	}
+}
+
+// submitTransaction applies the changes of a transaction as one bulk request,
+// ordered with every other task on the documents it touches. A bulk request
+// that still fails after FlushAttempts sends every change of the transaction
+// to the dead-letter topic, and when that fails too the transaction's offsets
+// are held so that it is applied again when read again.
+func submitTransaction(pool *WorkerPool, transaction *pendingTransaction, schema *Schema, db *sql.DB, esWriter LiveWriter, deadLetters *DeadLetterQueue, stateLog *StateLog) {
+	keys := make([]string, 0, len(transaction.Changes))
+	for _, change := range transaction.Changes {
+		keys = append(keys, orderingKeys(change.notification, schema)...)
+	}
+	pool.SubmitGroup(keys, transaction.Positions, func() bool {
+		writer := esWriter.Bulk()
+		delivered := true
+		var processed []bufferedChange
+		for _, change := range transaction.Changes {
+			if err := processNotification(change.notification, schema, db, writer); err != nil {
+				log.Printf("Error processing notification: %v", err)
+				if !sendDeadLetter(deadLetters, change.message, change.notification.Table, err) {
+					delivered = false
+					continue
+				}
+				messagesProcessed.WithLabelValues(change.notification.Table, change.notification.Operation, ResultDeadLettered).Inc()
+				continue
+			}
+			processed = append(processed, change)
+		}
+
+		err := writer.Flush()
+		for attempt := 1; err != nil && attempt < FlushAttempts; attempt++ {
+			log.Printf("Error applying transaction %d, retrying: %v", transaction.TxID, err)
+			time.Sleep(time.Duration(attempt) * FlushBackoff)
+			err = writer.Flush()
+		}
+		if err != nil {
+			log.Printf("Error applying transaction %d, dead-lettering its changes: %v", transaction.TxID, err)
+			for _, change := range processed {
+				if !sendDeadLetter(deadLetters, change.message, change.notification.Table, err) {
+					delivered = false
+					continue
+				}
+				messagesProcessed.WithLabelValues(change.notification.Table, change.notification.Operation, ResultDeadLettered).Inc()
+			}
+			return delivered
+		}
+		for _, change := range processed {
+			stateLog.Record(change.notification, schema)
+			messagesProcessed.WithLabelValues(change.notification.Table, change.notification.Operation, ResultProcessed).Inc()
+		}
+		if transaction.Complete {
+			log.Printf("Applied transaction %d with %d changes", transaction.TxID, len(transaction.Changes))
+		} else {
+			log.Printf("Applied %d changes of incomplete transaction %d", len(transaction.Changes), transaction.TxID)
+		}
+		return delivered
+	})
+}
+
+// bulkWriter collects writes and sends them in bulk requests on Flush, as
+// many actions per request as the throttle allows. Elasticsearch applies the
+// actions on each shard in order, so later writes to a document see earlier
+// ones.
+type bulkWriter struct {
+	client   *elasticsearch.TypedClient
+	throttle *Throttle
+	actions  []bulkAction
+	queries  []pendingQuery
+	written  int          // writes collected, numbering them in order
+	failed   map[int]bool // numbers of the writes that failed on the last Flush
+}
+
+// pendingQuery is an update-by-query held until the bulk actions before it
+// have been sent.
+type pendingQuery struct {
+	seq   int
+	index string
+	query map[string]interface{}
+}
+
+// bulkAction is one action's NDJSON lines and, for index and delete actions,
+// its external version.
+type bulkAction struct {
+	seq     int
+	lines   []byte
+	version int64
+}
+
+func newBulkWriter(client *elasticsearch.TypedClient, throttle *Throttle) *bulkWriter {
+	return &bulkWriter{client: client, throttle: throttle}
+}
+
+func (w *bulkWriter) Apply(operation, indexName, documentID string, document interface{}, version int64) error {
+	meta := map[string]interface{}{"_index": indexName, "_id": documentID}
+	if version > 0 {
+		meta["version"] = version
+		meta["version_type"] = "external"
+	}
+	var err error
+	switch operation {
+	case OperationInsert, OperationUpdate:
+		err = w.add(map[string]interface{}{"index": meta}, document, version)
+	case OperationDelete:
+		err = w.add(map[string]interface{}{"delete": meta}, nil, version)
+	default:
+		log.Printf("Unhandled operation: %s", operation)
+	}
+	if err != nil {
+		return fmt.Errorf("encoding bulk %s of %s/%s: %w", operation, indexName, documentID, err)
+	}
+	return nil
+}
+
+func (w *bulkWriter) Update(indexName, documentID string, query map[string]interface{}) error {
+	meta := map[string]interface{}{"_index": indexName, "_id": documentID, "retry_on_conflict": UpdateRetryOnConflict}
+	return w.add(map[string]interface{}{"update": meta}, query, 0)
+}
+
+// UpdateByQuery cannot be part of a bulk request, so it is sent on Flush,
+// after the bulk actions.
+func (w *bulkWriter) UpdateByQuery(indexName string, query map[string]interface{}) error {
+	w.queries = append(w.queries, pendingQuery{seq: w.written, index: indexName, query: query})
+	w.written++
+	return nil
+}
+
+func (w *bulkWriter) add(action, source interface{}, version int64) error {
+	var lines bytes.Buffer
+	encoder := json.NewEncoder(&lines)
+	if err := encoder.Encode(action); err != nil {
+		return err
+	}
+	if source != nil {
+		if err := encoder.Encode(source); err != nil {
+			return err
+		}
+	}
+	w.actions = append(w.actions, bulkAction{seq: w.written, lines: lines.Bytes(), version: version})
+	w.written++
+	return nil
+}
+
+// Flush sends the collected writes in order, then the held update-by-query
+// requests. Actions Elasticsearch rejects for overload are retried before the
+// next request is sent. Version conflicts are stale writes and are counted
+// rather than reported, and link removals from missing documents are
+// ignored. Any other failed write is kept, and reported in the error, so that
+// calling Flush again retries the failed writes alone.
+func (w *bulkWriter) Flush() error {
+	w.failed = nil
+	if err := w.flushActions(); err != nil {
+		for _, pending := range w.queries {
+			w.markFailed(pending.seq)
+		}
+		return err
+	}
+	queries := w.queries
+	w.queries = nil
+	for _, pending := range queries {
+		var err error
+		w.throttle.Do(func() bool {
+			err = updateDocumentsByQuery(pending.index, pending.query, w.client)
+			return isRejection(err)
+		})
+		if err != nil {
+			log.Printf("Error updating %s by query: %v", pending.index, err)
+			w.markFailed(pending.seq)
+			w.queries = append(w.queries, pending)
+		}
+	}
+	if len(w.queries) > 0 {
+		return fmt.Errorf("%d of %d updates by query failed", len(w.queries), len(queries))
+	}
+	return nil
+}
+
+// flushActions sends the collected actions and keeps those that failed.
+func (w *bulkWriter) flushActions() error {
+	pending := w.actions
+	total := len(pending)
+	w.actions = nil
+	for len(pending) > 0 {
+		size := w.throttle.BulkSize()
+		if size > len(pending) {
+			size = len(pending)
+		}
+		chunk := pending[:size]
+		pending = pending[size:]
+
+		var err error
+		w.throttle.Do(func() bool {
+			var body bytes.Buffer
+			for _, action := range chunk {
+				body.Write(action.lines)
+			}
+			var items []bulkItem
+			items, err = sendBulkItems(w.client, &body)
+			if err != nil {
+				return isRejection(err)
+			}
+
+			var rejected []bulkAction
+			for i, item := range items {
+				switch {
+				case len(item.Error) == 0:
+				case isRejectionStatus(item.Status, string(item.Error)) && i < len(chunk):
+					rejected = append(rejected, chunk[i])
+				case item.Status == http.StatusConflict && item.Action != RequestUpdate && i < len(chunk):
+					recordVersionConflict(item.Index, item.ID, chunk[i].version)
+				case item.Status == http.StatusNotFound && item.Action == RequestUpdate:
+					// A link removed from a document that is already gone
+				default:
+					log.Printf("Error in bulk %s of %s/%s: %s", item.Action, item.Index, item.ID, item.Error)
+					if i < len(chunk) {
+						w.markFailed(chunk[i].seq)
+						w.actions = append(w.actions, chunk[i])
+					}
+				}
+			}
+			chunk = rejected
+			return len(rejected) > 0
+		})
+		if err != nil {
+			for _, action := range append(chunk, pending...) {
+				w.markFailed(action.seq)
+			}
+			w.actions = append(w.actions, append(chunk, pending...)...)
+			return err
+		}
+	}
+	if len(w.actions) > 0 {
+		return fmt.Errorf("%d of %d bulk actions failed", len(w.actions), total)
+	}
+	return nil
+}
+
+// markFailed records that the write numbered seq failed.
+func (w *bulkWriter) markFailed(seq int) {
+	if w.failed == nil {
+		w.failed = make(map[int]bool)
+	}
+	w.failed[seq] = true
+}
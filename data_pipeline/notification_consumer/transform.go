@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrSkipEvent is returned by a Transformer to drop an event: nothing is
+// indexed for it and the transformers after it do not run.
+var ErrSkipEvent = errors.New("skip event")
+
+// Change is what a Transformer sees of one row: the decoded document, which
+// it rewrites in place, and the row image it was decoded from.
+type Change struct {
+	Table     string
+	Operation string
+	Row       map[string]interface{}
+	Document  map[string]interface{}
+}
+
+// Transformer rewrites documents between decoding and indexing. A table's
+// transformers run in the order they are declared, and each sees the
+// document as the previous one left it. Transformers run for inserts and
+// updates only, since a delete carries no document, and not for updates that
+// change none of the table's declared columns.
+type Transformer interface {
+	Transform(change *Change) error
+}
+
+// TransformerFunc adapts a function to the Transformer interface.
+type TransformerFunc func(change *Change) error
+
+func (f TransformerFunc) Transform(change *Change) error {
+	return f(change)
+}
+
+// TransformConfig declares one transformer on a table. Type selects a
+// registered transformer; the other fields are its parameters, and Options
+// holds parameters for transformers registered outside this package's
+// built-ins.
+type TransformConfig struct {
+	Type      string            `yaml:"type" json:"type"`
+	Field     string            `yaml:"field" json:"field"`
+	Fields    []string          `yaml:"fields" json:"fields"`
+	Target    string            `yaml:"target" json:"target"`
+	Template  string            `yaml:"template" json:"template"`
+	Algorithm string            `yaml:"algorithm" json:"algorithm"`
+	Options   map[string]string `yaml:"options" json:"options"`
+}
+
+// TransformerFactory builds a transformer from its configuration, or says
+// why the configuration is invalid.
+type TransformerFactory func(config TransformConfig) (Transformer, error)
+
+var transformerFactories = map[string]TransformerFactory{}
+
+// RegisterTransformer makes a transformer available to schemas under name.
+// It is meant to be called from init functions and panics if name is taken.
+func RegisterTransformer(name string, factory TransformerFactory) {
+	if _, exists := transformerFactories[name]; exists {
+		panic(fmt.Sprintf("transformer %q is registered twice", name))
+	}
+	transformerFactories[name] = factory
+}
+
+func newTransformer(config TransformConfig) (Transformer, error) {
+	factory, ok := transformerFactories[config.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown type %q (known: %v)", config.Type, transformerNames())
+	}
+	return factory(config)
+}
+
+func transformerNames() []string {
+	names := make([]string, 0, len(transformerFactories))
+	for name := range transformerFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// buildTransformers builds the transformers a table declares, in order.
+func buildTransformers(table *TableConfig) error {
+	table.transformers = make([]Transformer, 0, len(table.Transforms))
+	for i, config := range table.Transforms {
+		transformer, err := newTransformer(config)
+		if err != nil {
+			return fmt.Errorf("schema: transform %d of table %s: %w", i+1, table.Name, err)
+		}
+		table.transformers = append(table.transformers, transformer)
+	}
+	return nil
+}
+
+// applyTransformers runs a table's transformers over a decoded document and
+// reports whether the event should still be indexed.
+func applyTransformers(table *TableConfig, operation string, row, document map[string]interface{}) (bool, error) {
+	change := &Change{Table: table.Name, Operation: operation, Row: row, Document: document}
+	for i, transformer := range table.transformers {
+		err := transformer.Transform(change)
+		if errors.Is(err, ErrSkipEvent) {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("transform %d (%s) of table %s: %w", i+1, table.Transforms[i].Type, table.Name, err)
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApplyTransformers(t *testing.T) {
+	var ran []string
+	record := func(name string, err error) Transformer {
+		return TransformerFunc(func(change *Change) error {
+			ran = append(ran, name)
+			change.Document[name] = true
+			return err
+		})
+	}
+	failure := errors.New("boom")
+	tests := []struct {
+		name         string
+		transformers []Transformer
+		wantIndex    bool
+		wantErr      string
+		wantRan      []string
+	}{
+		{
+			name:         "runs every transformer in order",
+			transformers: []Transformer{record("first", nil), record("second", nil)},
+			wantIndex:    true,
+			wantRan:      []string{"first", "second"},
+		},
+		{
+			name:         "skip stops the chain without an error",
+			transformers: []Transformer{record("first", ErrSkipEvent), record("second", nil)},
+			wantRan:      []string{"first"},
+		},
+		{
+			name:         "wrapped skip is recognised",
+			transformers: []Transformer{record("first", nil), record("second", fmt.Errorf("filtered: %w", ErrSkipEvent)), record("third", nil)},
+			wantRan:      []string{"first", "second"},
+		},
+		{
+			name:         "errors name the failing transform",
+			transformers: []Transformer{record("first", nil), record("second", failure)},
+			wantErr:      "transform 2 (second) of table posts: boom",
+			wantRan:      []string{"first", "second"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ran = nil
+			table := &TableConfig{Name: "posts", transformers: test.transformers}
+			for _, name := range []string{"first", "second", "third"}[:len(test.transformers)] {
+				table.Transforms = append(table.Transforms, TransformConfig{Type: name})
+			}
+			index, err := applyTransformers(table, OperationInsert, nil, map[string]interface{}{})
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("error = %v, want one containing %q", err, test.wantErr)
+				}
+				if !errors.Is(err, failure) {
+					t.Errorf("error %v does not wrap the transformer's error", err)
+				}
+			} else if err != nil {
+				t.Fatalf("applyTransformers: %v", err)
+			}
+			if index != test.wantIndex {
+				t.Errorf("index = %v, want %v", index, test.wantIndex)
+			}
+			if !reflect.DeepEqual(ran, test.wantRan) {
+				t.Errorf("ran %v, want %v", ran, test.wantRan)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+const TransformRename = "rename"
+const TransformDrop = "drop"
+const TransformLowercase = "lowercase"
+const TransformTemplate = "template"
+const TransformHash = "hash"
+const TransformWordCount = "word_count"
+
+func init() {
+	RegisterTransformer(TransformRename, newRenameTransformer)
+	RegisterTransformer(TransformDrop, newDropTransformer)
+	RegisterTransformer(TransformLowercase, newLowercaseTransformer)
+	RegisterTransformer(TransformTemplate, newTemplateTransformer)
+	RegisterTransformer(TransformHash, newHashTransformer)
+	RegisterTransformer(TransformWordCount, newWordCountTransformer)
+}
+
+// newRenameTransformer moves field to target. A missing field is left
+// missing.
+func newRenameTransformer(config TransformConfig) (Transformer, error) {
+	if config.Field == "" || config.Target == "" {
+		return nil, errors.New("rename needs a field and a target")
+	}
+	return TransformerFunc(func(change *Change) error {
+		if value, ok := change.Document[config.Field]; ok {
+			delete(change.Document, config.Field)
+			change.Document[config.Target] = value
+		}
+		return nil
+	}), nil
+}
+
+// newDropTransformer removes field and every entry of fields.
+func newDropTransformer(config TransformConfig) (Transformer, error) {
+	fields := config.Fields
+	if config.Field != "" {
+		fields = append([]string{config.Field}, fields...)
+	}
+	if len(fields) == 0 {
+		return nil, errors.New("drop needs a field or fields")
+	}
+	return TransformerFunc(func(change *Change) error {
+		for _, field := range fields {
+			delete(change.Document, field)
+		}
+		return nil
+	}), nil
+}
+
+// newLowercaseTransformer writes the lower-cased string in field to target,
+// or back to field when no target is given. Other values are left alone.
+func newLowercaseTransformer(config TransformConfig) (Transformer, error) {
+	if config.Field == "" {
+		return nil, errors.New("lowercase needs a field")
+	}
+	target := targetOrField(config)
+	return TransformerFunc(func(change *Change) error {
+		if value, ok := change.Document[config.Field].(string); ok {
+			change.Document[target] = strings.ToLower(value)
+		}
+		return nil
+	}), nil
+}
+
+// templateFuncs are available to template transformers besides the
+// text/template builtins.
+var templateFuncs = template.FuncMap{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"trim":  strings.TrimSpace,
+	"slug":  slugify,
+}
+
+var nonSlugCharacters = regexp.MustCompile(`[^a-z0-9]+`)
+
+// slugify lower-cases s and joins its runs of letters and digits with
+// hyphens, so "Healthy Recipes!" becomes "healthy-recipes".
+func slugify(s string) string {
+	return strings.Trim(nonSlugCharacters.ReplaceAllString(strings.ToLower(s), "-"), "-")
+}
+
+// newTemplateTransformer renders a text/template against the document and
+// writes the result to target. A template that fails to render, for example
+// on a missing field, sends the row to the dead-letter topic.
+func newTemplateTransformer(config TransformConfig) (Transformer, error) {
+	if config.Target == "" || config.Template == "" {
+		return nil, errors.New("template needs a target and a template")
+	}
+	parsed, err := template.New(config.Target).Funcs(templateFuncs).Option("missingkey=error").Parse(config.Template)
+	if err != nil {
+		return nil, err
+	}
+	return TransformerFunc(func(change *Change) error {
+		var rendered strings.Builder
+		if err := parsed.Execute(&rendered, change.Document); err != nil {
+			return err
+		}
+		change.Document[config.Target] = rendered.String()
+		return nil
+	}), nil
+}
+
+// newHashTransformer replaces field, or writes to target, with the hex digest
+// of its value. Strings are hashed as they are and other values as JSON;
+// NULL stays NULL. The algorithm is sha256 unless sha1 or md5 is named.
+func newHashTransformer(config TransformConfig) (Transformer, error) {
+	if config.Field == "" {
+		return nil, errors.New("hash needs a field")
+	}
+	var newHash func() hash.Hash
+	switch config.Algorithm {
+	case "", "sha256":
+		newHash = sha256.New
+	case "sha1":
+		newHash = sha1.New
+	case "md5":
+		newHash = md5.New
+	default:
+		return nil, fmt.Errorf("hash has unknown algorithm %q", config.Algorithm)
+	}
+	target := targetOrField(config)
+	return TransformerFunc(func(change *Change) error {
+		value, ok := change.Document[config.Field]
+		if !ok || value == nil {
+			return nil
+		}
+		content, isString := value.(string)
+		if !isString {
+			encoded, err := json.Marshal(value)
+			if err != nil {
+				return err
+			}
+			content = string(encoded)
+		}
+		digest := newHash()
+		digest.Write([]byte(content))
+		change.Document[target] = hex.EncodeToString(digest.Sum(nil))
+		return nil
+	}), nil
+}
+
+// newWordCountTransformer writes the number of whitespace-separated words in
+// the string in field to target, <field>_word_count by default. A missing or
+// NULL field counts as zero words.
+func newWordCountTransformer(config TransformConfig) (Transformer, error) {
+	if config.Field == "" {
+		return nil, errors.New("word_count needs a field")
+	}
+	target := config.Target
+	if target == "" {
+		target = config.Field + "_word_count"
+	}
+	return TransformerFunc(func(change *Change) error {
+		text, _ := change.Document[config.Field].(string)
+		change.Document[target] = len(strings.Fields(text))
+		return nil
+	}), nil
+}
+
+func targetOrField(config TransformConfig) string {
+	if config.Target != "" {
+		return config.Target
+	}
+	return config.Field
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestBuiltinTransformers(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   TransformConfig
+		document map[string]interface{}
+		want     map[string]interface{}
+		wantErr  string
+	}{
+		{
+			name:     "rename moves the field",
+			config:   TransformConfig{Type: TransformRename, Field: "title", Target: "name"},
+			document: map[string]interface{}{"title": "Soup", "id": 1.0},
+			want:     map[string]interface{}{"name": "Soup", "id": 1.0},
+		},
+		{
+			name:     "rename leaves a missing field missing",
+			config:   TransformConfig{Type: TransformRename, Field: "title", Target: "name"},
+			document: map[string]interface{}{"id": 1.0},
+			want:     map[string]interface{}{"id": 1.0},
+		},
+		{
+			name:     "rename keeps NULL",
+			config:   TransformConfig{Type: TransformRename, Field: "title", Target: "name"},
+			document: map[string]interface{}{"title": nil},
+			want:     map[string]interface{}{"name": nil},
+		},
+		{
+			name:     "drop removes field and fields",
+			config:   TransformConfig{Type: TransformDrop, Field: "a", Fields: []string{"b", "missing"}},
+			document: map[string]interface{}{"a": 1.0, "b": 2.0, "c": 3.0},
+			want:     map[string]interface{}{"c": 3.0},
+		},
+		{
+			name:     "lowercase in place",
+			config:   TransformConfig{Type: TransformLowercase, Field: "tag"},
+			document: map[string]interface{}{"tag": "GoLang"},
+			want:     map[string]interface{}{"tag": "golang"},
+		},
+		{
+			name:     "lowercase to target",
+			config:   TransformConfig{Type: TransformLowercase, Field: "tag", Target: "tag_lower"},
+			document: map[string]interface{}{"tag": "GoLang"},
+			want:     map[string]interface{}{"tag": "GoLang", "tag_lower": "golang"},
+		},
+		{
+			name:     "lowercase leaves non-strings alone",
+			config:   TransformConfig{Type: TransformLowercase, Field: "tag", Target: "tag_lower"},
+			document: map[string]interface{}{"tag": 7.0},
+			want:     map[string]interface{}{"tag": 7.0},
+		},
+		{
+			name:     "template renders with funcs",
+			config:   TransformConfig{Type: TransformTemplate, Target: "slug", Template: "{{ slug .title }}-{{ .id }}"},
+			document: map[string]interface{}{"title": "Healthy Recipes!", "id": 3.0},
+			want:     map[string]interface{}{"title": "Healthy Recipes!", "id": 3.0, "slug": "healthy-recipes-3"},
+		},
+		{
+			name:     "template fails on a missing field",
+			config:   TransformConfig{Type: TransformTemplate, Target: "slug", Template: "{{ .title }}"},
+			document: map[string]interface{}{"id": 3.0},
+			wantErr:  "map has no entry for key",
+		},
+		{
+			name:     "hash a string with sha256 by default",
+			config:   TransformConfig{Type: TransformHash, Field: "email"},
+			document: map[string]interface{}{"email": "a@example.com"},
+			want:     map[string]interface{}{"email": sha256Hex("a@example.com")},
+		},
+		{
+			name:     "hash a non-string as JSON",
+			config:   TransformConfig{Type: TransformHash, Field: "tags", Target: "tags_hash", Algorithm: "md5"},
+			document: map[string]interface{}{"tags": []interface{}{"a", 1.0}},
+			want:     map[string]interface{}{"tags": []interface{}{"a", 1.0}, "tags_hash": md5Hex(`["a",1]`)},
+		},
+		{
+			name:     "hash keeps NULL",
+			config:   TransformConfig{Type: TransformHash, Field: "email"},
+			document: map[string]interface{}{"email": nil},
+			want:     map[string]interface{}{"email": nil},
+		},
+		{
+			name:     "hash skips a missing field",
+			config:   TransformConfig{Type: TransformHash, Field: "email", Target: "email_hash"},
+			document: map[string]interface{}{},
+			want:     map[string]interface{}{},
+		},
+		{
+			name:     "word_count defaults its target",
+			config:   TransformConfig{Type: TransformWordCount, Field: "body"},
+			document: map[string]interface{}{"body": "  one two\tthree\n"},
+			want:     map[string]interface{}{"body": "  one two\tthree\n", "body_word_count": 3},
+		},
+		{
+			name:     "word_count counts NULL as zero",
+			config:   TransformConfig{Type: TransformWordCount, Field: "body", Target: "words"},
+			document: map[string]interface{}{"body": nil},
+			want:     map[string]interface{}{"body": nil, "words": 0},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transformer, err := newTransformer(test.config)
+			if err != nil {
+				t.Fatalf("newTransformer: %v", err)
+			}
+			err = transformer.Transform(&Change{Document: test.document})
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("Transform error = %v, want one containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Transform: %v", err)
+			}
+			if !reflect.DeepEqual(test.document, test.want) {
+				t.Errorf("document = %v, want %v", test.document, test.want)
+			}
+		})
+	}
+}
+
+func TestBuiltinTransformerConfigErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config TransformConfig
+	}{
+		{"rename without target", TransformConfig{Type: TransformRename, Field: "a"}},
+		{"drop without fields", TransformConfig{Type: TransformDrop}},
+		{"lowercase without field", TransformConfig{Type: TransformLowercase}},
+		{"template without template", TransformConfig{Type: TransformTemplate, Target: "a"}},
+		{"template that does not parse", TransformConfig{Type: TransformTemplate, Target: "a", Template: "{{ .a"}},
+		{"hash with unknown algorithm", TransformConfig{Type: TransformHash, Field: "a", Algorithm: "crc32"}},
+		{"word_count without field", TransformConfig{Type: TransformWordCount}},
+		{"unknown type", TransformConfig{Type: "uppercase", Field: "a"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := newTransformer(test.config); err == nil {
+				t.Errorf("newTransformer(%+v) succeeded, want an error", test.config)
+			}
+		})
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+const DriftMissing = "missing"
+const DriftExtra = "extra"
+const DriftStale = "stale"
+const DriftWrongLink = "wrong_link"
+
+// Drift is one document whose index copy disagrees with Postgres.
+type Drift struct {
+	Table string
+	Index string
+	ID    string
+	Kind  string
+}
+
+// runVerify compares every table with its index, chunk by chunk in primary
+// key order, prints each difference and optionally repairs it. The command
+// exits non-zero when the number of drifted documents exceeds the threshold.
+func runVerify(args []string) {
+	flags := flag.NewFlagSet(CommandVerify, flag.ExitOnError)
+	schemaPath := flags.String("schema", "", "path to a YAML or JSON table-to-index mapping (defaults to the embedded schema.yaml)")
+	batchSize := flags.Int("batch-size", ReindexBatchSize, "rows compared per chunk")
+	tables := flags.String("tables", "", "comma-separated tables to verify (defaults to every table in the schema)")
+	repair := flags.Bool("repair", false, "re-index missing, stale and wrongly linked documents and delete extra ones")
+	threshold := flags.Int("threshold", 0, "number of drifted documents tolerated before exiting with status 1")
+	flags.Parse(args)
+
+	schema, err := loadSchema(*schemaPath)
+	if err == nil {
+		err = schema.singleSource(CommandVerify)
+	}
+	if err != nil {
+		log.Fatalf("Error loading schema: %v", err)
+	}
+
+	db, err := sql.Open("postgres", PostgresURL)
+	if err != nil {
+		log.Fatalf("Error connecting to Postgres: %v", err)
+	}
+	defer db.Close()
+
+	esClient, err := elasticsearch.NewTypedClient(elasticsearch.Config{Addresses: []string{ElastisearchURL}})
+	if err != nil {
+		log.Fatalf("Error creating Elasticsearch client: %v", err)
+	}
+
+	selected := make(map[string]bool)
+	for _, name := range strings.Split(*tables, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			selected[name] = true
+		}
+	}
+
+	totalDrift := 0
+	for i := range schema.Tables {
+		table := &schema.Tables[i]
+		if len(selected) > 0 && !selected[table.Name] {
+			continue
+		}
+		drifts, checked, err := verifyTable(db, esClient, schema, table, *batchSize, *repair)
+		if err != nil {
+			log.Fatalf("Error verifying %s: %v", table.Name, err)
+		}
+		counts := make(map[string]int)
+		for _, drift := range drifts {
+			counts[drift.Kind]++
+		}
+		fmt.Printf("%s -> %s: %d rows checked, %d missing, %d extra, %d stale, %d wrong links\n",
+			table.Name, table.Index, checked, counts[DriftMissing], counts[DriftExtra], counts[DriftStale], counts[DriftWrongLink])
+		totalDrift += len(drifts)
+	}
+
+	if *repair && totalDrift > 0 {
+		fmt.Printf("Repaired %d drifted documents\n", totalDrift)
+	}
+	if totalDrift > *threshold {
+		log.Printf("Drift of %d documents is over the threshold of %d", totalDrift, *threshold)
+		os.Exit(1)
+	}
+}
+
+// verifyTable compares a table with its index and returns every drifted
+// document together with the number of rows checked.
+func verifyTable(db *sql.DB, esClient *elasticsearch.TypedClient, schema *Schema, table *TableConfig, batchSize int, repair bool) ([]Drift, int, error) {
+	keyField := table.KeyField()
+	if keyField == "" {
+		return nil, 0, fmt.Errorf("primary key %s is not an indexed column, so index ranges cannot be compared", table.PrimaryKey)
+	}
+	linkFields := relationshipFields(schema, table)
+
+	var drifts []Drift
+	lastKey := ""
+	compare := func(expected map[string]map[string]interface{}, upTo string) error {
+		actual, err := searchDocumentRange(esClient, table.Index, keyField, lastKey, upTo)
+		if err != nil {
+			return err
+		}
+		chunk := compareDocuments(table, linkFields, expected, actual)
+		for _, drift := range chunk {
+			fmt.Printf("drift\t%s\t%s\t%s/%s\n", drift.Kind, drift.Table, drift.Index, drift.ID)
+		}
+		drifts = append(drifts, chunk...)
+		if repair {
+			if err := repairDrift(esClient, table.Index, chunk, expected); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	checked, err := forEachDocumentBatch(db, schema, table, batchSize, func(_ []string, documents map[string]map[string]interface{}, upTo string) error {
+		if err := compare(documents, upTo); err != nil {
+			return err
+		}
+		lastKey = upTo
+		return nil
+	})
+	if err != nil {
+		return drifts, checked, err
+	}
+	// Anything indexed past the last row no longer exists in Postgres
+	if err := compare(map[string]map[string]interface{}{}, ""); err != nil {
+		return drifts, checked, err
+	}
+	return drifts, checked, nil
+}
+
+// compareDocuments classifies the differences between the documents built
+// from Postgres and the documents found in the index for the same key range.
+func compareDocuments(table *TableConfig, linkFields []string, expected, actual map[string]map[string]interface{}) []Drift {
+	var drifts []Drift
+	add := func(id, kind string) {
+		drifts = append(drifts, Drift{Table: table.Name, Index: table.Index, ID: id, Kind: kind})
+	}
+
+	for _, id := range sortedKeys(expected) {
+		document, found := actual[id]
+		switch {
+		case !found:
+			add(id, DriftMissing)
+		case contentHash(expected[id], linkFields) != contentHash(document, linkFields):
+			add(id, DriftStale)
+		case !sameLinks(expected[id], document, linkFields):
+			add(id, DriftWrongLink)
+		}
+	}
+	for _, id := range sortedKeys(actual) {
+		if _, found := expected[id]; !found {
+			add(id, DriftExtra)
+		}
+	}
+	return drifts
+}
+
+func repairDrift(esClient *elasticsearch.TypedClient, indexName string, drifts []Drift, expected map[string]map[string]interface{}) error {
+	var reindex, remove []string
+	for _, drift := range drifts {
+		if drift.Kind == DriftExtra {
+			remove = append(remove, drift.ID)
+		} else {
+			reindex = append(reindex, drift.ID)
+		}
+	}
+	if len(reindex) > 0 {
+		if err := bulkIndexDocuments(esClient, indexName, reindex, expected); err != nil {
+			return err
+		}
+	}
+	if len(remove) > 0 {
+		if err := bulkDeleteDocuments(esClient, indexName, remove); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// contentHash hashes every field of a document except its relationship
+// arrays and their versions, in canonical JSON form, so a document built from
+// Postgres and one read back from the index hash the same when their contents
+// agree. Fields added by transformers and the hidden flag are covered with
+// the columns.
+func contentHash(document map[string]interface{}, linkFields []string) string {
+	content := make(map[string]interface{}, len(document))
+	for field, value := range document {
+		content[field] = canonicalValue(value)
+	}
+	for _, field := range linkFields {
+		delete(content, field)
+	}
+	delete(content, LinkVersionsField)
+	encoded, _ := json.Marshal(content)
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:])
+}
+
+// sameLinks compares relationship arrays as sets.
+func sameLinks(expected, actual map[string]interface{}, linkFields []string) bool {
+	for _, field := range linkFields {
+		if linkSet(expected[field]) != linkSet(actual[field]) {
+			return false
+		}
+	}
+	return true
+}
+
+func linkSet(value interface{}) string {
+	values, _ := canonicalValue(value).([]interface{})
+	members := make([]string, 0, len(values))
+	for _, member := range values {
+		encoded, _ := json.Marshal(member)
+		members = append(members, string(encoded))
+	}
+	sort.Strings(members)
+	return strings.Join(members, ",")
+}
+
+// canonicalValue round-trips a value through JSON so that, for example, int64
+// ids built from Postgres compare equal to float64 ids read from the index.
+func canonicalValue(value interface{}) interface{} {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return value
+	}
+	var canonical interface{}
+	if err := json.Unmarshal(encoded, &canonical); err != nil {
+		return value
+	}
+	return canonical
+}
+
+// relationshipFields lists the relationship array fields, and embedded
+// summary arrays, kept on table's documents.
+func relationshipFields(schema *Schema, table *TableConfig) []string {
+	var fields []string
+	for _, relationship := range schema.Relationships {
+		for _, side := range []RelationshipSide{relationship.Left, relationship.Right} {
+			if side.Index == table.Index && side.Field != "" {
+				fields = append(fields, side.Field)
+			}
+			if side.Index == table.Index && side.Embed != nil {
+				fields = append(fields, side.Embed.Field)
+			}
+		}
+	}
+	return fields
+}
+
+func sortedKeys(documents map[string]map[string]interface{}) []string {
+	keys := make([]string, 0, len(documents))
+	for key := range documents {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// searchDocumentRange returns every document in indexName whose keyField lies
+// after `after` and up to `upTo`. Empty bounds are open.
+func searchDocumentRange(esClient *elasticsearch.TypedClient, indexName, keyField, after, upTo string) (map[string]map[string]interface{}, error) {
+	bounds := map[string]interface{}{}
+	if after != "" {
+		bounds["gt"] = after
+	}
+	if upTo != "" {
+		bounds["lte"] = upTo
+	}
+
+	documents := make(map[string]map[string]interface{})
+	var searchAfter []interface{}
+	for {
+		query := map[string]interface{}{
+			"query": map[string]interface{}{"range": map[string]interface{}{keyField: bounds}},
+			"sort":  []interface{}{map[string]interface{}{keyField: "asc"}},
+			"size":  VerifyPageSize,
+		}
+		if searchAfter != nil {
+			query["search_after"] = searchAfter
+		}
+		queryJSON, err := json.Marshal(query)
+		if err != nil {
+			return nil, err
+		}
+
+		response, err := esapi.SearchRequest{Index: []string{indexName}, Body: bytes.NewReader(queryJSON)}.Do(context.Background(), esClient)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Hits struct {
+				Hits []struct {
+					ID     string                 `json:"_id"`
+					Source map[string]interface{} `json:"_source"`
+					Sort   []interface{}          `json:"sort"`
+				} `json:"hits"`
+			} `json:"hits"`
+		}
+		if response.IsError() {
+			response.Body.Close()
+			return nil, fmt.Errorf("searching %s: %s", indexName, response.String())
+		}
+		err = json.NewDecoder(response.Body).Decode(&result)
+		response.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, hit := range result.Hits.Hits {
+			documents[hit.ID] = hit.Source
+		}
+		if len(result.Hits.Hits) < VerifyPageSize {
+			return documents, nil
+		}
+		searchAfter = result.Hits.Hits[len(result.Hits.Hits)-1].Sort
+	}
+}
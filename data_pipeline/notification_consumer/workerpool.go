@@ -0,0 +1,218 @@
+package main
+
+import (
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"hash/fnv"
+	"sync"
+)
+
+// WorkerPool runs message tasks on a fixed set of goroutines. Tasks with the
+// same key always run on the same worker, in submission order, so changes to
+// one document are applied in order while different documents run in
+// parallel. Submit blocks when the chosen worker's queue is full, which holds
+// back the poll loop until Elasticsearch catches up. A task reports whether
+// its messages are done; a task that returns false leaves them in flight, so
+// their offsets are never committed and they are read again after a restart
+// or rebalance.
+type WorkerPool struct {
+	queues  []chan workerTask
+	wg      sync.WaitGroup
+	offsets *offsetTracker
+	closed  bool
+}
+
+type workerTask struct {
+	positions []kafka.TopicPartition
+	run       func() bool
+}
+
+func newWorkerPool(workers, queueSize int) *WorkerPool {
+	pool := &WorkerPool{
+		queues:  make([]chan workerTask, workers),
+		offsets: newOffsetTracker(),
+	}
+	for i := range pool.queues {
+		pool.queues[i] = make(chan workerTask, queueSize)
+		pool.wg.Add(1)
+		go pool.work(pool.queues[i])
+	}
+	return pool
+}
+
+func (p *WorkerPool) work(queue chan workerTask) {
+	defer p.wg.Done()
+	for task := range queue {
+		if !task.run() {
+			continue
+		}
+		for _, position := range task.positions {
+			p.offsets.Done(position)
+		}
+	}
+}
+
+// Submit queues run for the message at position on the worker owning key.
+func (p *WorkerPool) Submit(key string, position kafka.TopicPartition, run func() bool) {
+	p.offsets.Start(position)
+	p.queues[workerIndex(key, len(p.queues))] <- workerTask{positions: []kafka.TopicPartition{position}, run: run}
+}
+
+// Hold marks a message as in flight before its task is submitted, so that its
+// offset is not committed while the message waits, for example for the rest
+// of its transaction. Its task must be submitted with SubmitGroup.
+func (p *WorkerPool) Hold(position kafka.TopicPartition) {
+	p.offsets.Start(position)
+}
+
+// SubmitGroup queues run for held messages that change the documents of
+// several keys. It runs once every worker owning one of the keys has reached
+// it in its queue, and those workers wait until it finishes, so run is
+// ordered with every other task on any of the keys. All tasks are submitted
+// from one goroutine and every queue sees them in the same order, so workers
+// waiting on each other cannot deadlock.
+func (p *WorkerPool) SubmitGroup(keys []string, positions []kafka.TopicPartition, run func() bool) {
+	var workers []int
+	seen := make(map[int]bool)
+	for _, key := range keys {
+		worker := workerIndex(key, len(p.queues))
+		if !seen[worker] {
+			seen[worker] = true
+			workers = append(workers, worker)
+		}
+	}
+	if len(workers) == 0 {
+		workers = append(workers, 0)
+	}
+
+	var arrived sync.WaitGroup
+	arrived.Add(len(workers) - 1)
+	finished := make(chan struct{})
+	p.queues[workers[0]] <- workerTask{positions: positions, run: func() bool {
+		arrived.Wait()
+		defer close(finished)
+		return run()
+	}}
+	for _, worker := range workers[1:] {
+		p.queues[worker] <- workerTask{run: func() bool {
+			arrived.Done()
+			<-finished
+			return true
+		}}
+	}
+}
+
+// Committable returns, per partition, the offset to commit: everything below
+// it has been fully processed.
+func (p *WorkerPool) Committable() []kafka.TopicPartition {
+	return p.offsets.Committable()
+}
+
+// Drain waits for every task submitted so far to finish, by queueing a task
+// behind them on every worker. It must be called from the goroutine that
+// submits tasks. After Close there is nothing left to wait for.
+func (p *WorkerPool) Drain() {
+	if p.closed {
+		return
+	}
+	var drained sync.WaitGroup
+	drained.Add(len(p.queues))
+	for _, queue := range p.queues {
+		queue <- workerTask{run: func() bool {
+			drained.Done()
+			return true
+		}}
+	}
+	drained.Wait()
+}
+
+// Forget stops tracking the offsets of partitions this consumer no longer
+// owns, so they are not committed over the progress of their new owner.
+func (p *WorkerPool) Forget(partitions []kafka.TopicPartition) {
+	p.offsets.Forget(partitions)
+}
+
+// Close waits for every queued task to finish.
+func (p *WorkerPool) Close() {
+	p.closed = true
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	p.wg.Wait()
+}
+
+func workerIndex(key string, workers int) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return int(hash.Sum32() % uint32(workers))
+}
+
+type partitionKey struct {
+	topic     string
+	partition int32
+}
+
+// partitionOffsets tracks the messages of one partition that are in flight.
+type partitionOffsets struct {
+	inFlight map[kafka.Offset]struct{}
+	next     kafka.Offset // one past the highest offset submitted
+}
+
+// offsetTracker works out how far each partition can be committed when
+// messages finish out of order.
+type offsetTracker struct {
+	mu         sync.Mutex
+	partitions map[partitionKey]*partitionOffsets
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{partitions: make(map[partitionKey]*partitionOffsets)}
+}
+
+func (t *offsetTracker) Start(position kafka.TopicPartition) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := partitionKey{topic: *position.Topic, partition: position.Partition}
+	offsets, ok := t.partitions[key]
+	if !ok {
+		offsets = &partitionOffsets{inFlight: make(map[kafka.Offset]struct{})}
+		t.partitions[key] = offsets
+	}
+	offsets.inFlight[position.Offset] = struct{}{}
+	if position.Offset+1 > offsets.next {
+		offsets.next = position.Offset + 1
+	}
+}
+
+func (t *offsetTracker) Done(position kafka.TopicPartition) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := partitionKey{topic: *position.Topic, partition: position.Partition}
+	if offsets, ok := t.partitions[key]; ok {
+		delete(offsets.inFlight, position.Offset)
+	}
+}
+
+func (t *offsetTracker) Forget(partitions []kafka.TopicPartition) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, position := range partitions {
+		delete(t.partitions, partitionKey{topic: *position.Topic, partition: position.Partition})
+	}
+}
+
+func (t *offsetTracker) Committable() []kafka.TopicPartition {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var commits []kafka.TopicPartition
+	for key, offsets := range t.partitions {
+		commit := offsets.next
+		for offset := range offsets.inFlight {
+			if offset < commit {
+				commit = offset
+			}
+		}
+		topic := key.topic
+		commits = append(commits, kafka.TopicPartition{Topic: &topic, Partition: key.partition, Offset: commit})
+	}
+	return commits
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/typedapi/types/enums/versiontype"
+	"io"
+	"sync"
+)
+
+// DocumentWriter performs the Elasticsearch writes that processing a change
+// event produces.
+type DocumentWriter interface {
+	// Apply indexes or deletes a whole document, depending on operation.
+	Apply(operation, indexName, documentID string, document interface{}, version int64) error
+	// Update runs a partial update, such as a link script, on a document.
+	Update(indexName, documentID string, query map[string]interface{}) error
+	// UpdateByQuery runs a script over every document matching a query.
+	UpdateByQuery(indexName string, query map[string]interface{}) error
+}
+
+// BatchWriter is a DocumentWriter that holds its writes until Flush.
+type BatchWriter interface {
+	DocumentWriter
+	// Flush sends the writes held so far.
+	Flush() error
+}
+
+// LiveWriter is the writer the consumer applies change events with: one by
+// one, or collected per transaction in a BatchWriter from Bulk.
+type LiveWriter interface {
+	DocumentWriter
+	Bulk() BatchWriter
+}
+
+// elasticsearchWriter writes to the cluster through the throttle, so writes
+// rejected for overload are retried rather than dropped.
+type elasticsearchWriter struct {
+	client      *elasticsearch.TypedClient
+	throttle    *Throttle
+	versionType versiontype.VersionType
+}
+
+func newElasticsearchWriter(client *elasticsearch.TypedClient, throttle *Throttle) *elasticsearchWriter {
+	return &elasticsearchWriter{client: client, throttle: throttle, versionType: versiontype.External}
+}
+
+// newReplayWriter returns a writer for change events that may already have
+// been applied. Their versions are sent as external_gte, so an event is
+// applied again over the document it wrote, while events older than the
+// document's last change are still rejected as stale.
+func newReplayWriter(client *elasticsearch.TypedClient) *elasticsearchWriter {
+	writer := newElasticsearchWriter(client, nil)
+	writer.versionType = versiontype.Externalgte
+	return writer
+}
+
+func (w *elasticsearchWriter) Apply(operation, indexName, documentID string, document interface{}, version int64) error {
+	var err error
+	w.throttle.Do(func() bool {
+		err = updateElasticsearchIndex(operation, w.client, indexName, documentID, document, version, w.versionType)
+		return isRejection(err)
+	})
+	return err
+}
+
+func (w *elasticsearchWriter) Update(indexName, documentID string, query map[string]interface{}) error {
+	var err error
+	w.throttle.Do(func() bool {
+		err = updateDocumentInElasticsearch(indexName, documentID, query, w.client)
+		return isRejection(err)
+	})
+	return err
+}
+
+func (w *elasticsearchWriter) UpdateByQuery(indexName string, query map[string]interface{}) error {
+	var err error
+	w.throttle.Do(func() bool {
+		err = updateDocumentsByQuery(indexName, query, w.client)
+		return isRejection(err)
+	})
+	return err
+}
+
+// Bulk returns a writer that collects writes for one bulk request sent
+// through the same throttle.
+func (w *elasticsearchWriter) Bulk() BatchWriter {
+	return newBulkWriter(w.client, w.throttle)
+}
+
+// dryRunWriter prints the writes it is given instead of performing them, one
+// line per write.
+type dryRunWriter struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func newDryRunWriter(out io.Writer) *dryRunWriter {
+	return &dryRunWriter{out: out}
+}
+
+func (w *dryRunWriter) Apply(operation, indexName, documentID string, document interface{}, version int64) error {
+	request := RequestIndex
+	if operation == OperationDelete {
+		request = RequestDelete
+		document = nil
+	}
+	w.print(request, indexName, documentID, version, document)
+	return nil
+}
+
+func (w *dryRunWriter) Update(indexName, documentID string, query map[string]interface{}) error {
+	w.print(RequestUpdate, indexName, documentID, 0, query)
+	return nil
+}
+
+func (w *dryRunWriter) UpdateByQuery(indexName string, query map[string]interface{}) error {
+	w.print(RequestUpdateByQuery, indexName, "_query", 0, query)
+	return nil
+}
+
+func (w *dryRunWriter) print(request, indexName, documentID string, version int64, body interface{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	line := fmt.Sprintf("%s\t%s/%s", request, indexName, documentID)
+	if version > 0 {
+		line += fmt.Sprintf("\tversion=%d", version)
+	}
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			encoded = []byte(err.Error())
+		}
+		line += "\t" + string(encoded)
+	}
+	fmt.Fprintln(w.out, line)
+}
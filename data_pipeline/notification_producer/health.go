@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/lib/pq"
+	"net/http"
+)
+
+const HealthOK = "ok"
+const HealthDegraded = "degraded"
+const HealthUnavailable = "unavailable"
+
+// HealthCheck is the outcome of checking one dependency.
+type HealthCheck struct {
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Readiness is the overall status, the worst of its checks, together with
+// each check. A degraded producer is still ready.
+type Readiness struct {
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks"`
+}
+
+func (r *Readiness) add(name, status, detail string) {
+	r.Checks[name] = HealthCheck{Status: status, Detail: detail}
+	if healthRank(status) > healthRank(r.Status) {
+		r.Status = status
+	}
+}
+
+func healthRank(status string) int {
+	switch status {
+	case HealthDegraded:
+		return 1
+	case HealthUnavailable:
+		return 2
+	default:
+		return 0
+	}
+}
+
+// HealthChecker checks the dependencies the producer needs to forward
+// notifications.
+type HealthChecker struct {
+	sources  []*sourceConnection
+	producer *kafka.Producer
+}
+
+func newHealthChecker(sources []*sourceConnection, producer *kafka.Producer) *HealthChecker {
+	return &HealthChecker{sources: sources, producer: producer}
+}
+
+// Ready checks Postgres and the LISTEN connection of every source, the Kafka
+// brokers and topic, and how many messages are waiting to be delivered.
+// Checks of a named source are suffixed with its name, as in postgres:billing.
+func (h *HealthChecker) Ready(ctx context.Context) *Readiness {
+	readiness := &Readiness{Status: HealthOK, Checks: make(map[string]HealthCheck)}
+
+	for _, connection := range h.sources {
+		suffix := ""
+		if connection.source.Name != "" {
+			suffix = ":" + connection.source.Name
+		}
+		if err := connection.db.PingContext(ctx); err != nil {
+			readiness.add("postgres"+suffix, HealthUnavailable, err.Error())
+		} else {
+			readiness.add("postgres"+suffix, HealthOK, "")
+		}
+
+		if err := pingListener(ctx, connection.listener); err != nil {
+			readiness.add("listen"+suffix, HealthUnavailable, err.Error())
+		} else {
+			readiness.add("listen"+suffix, HealthOK, "listening on "+connection.source.Channel)
+		}
+	}
+
+	topic := KafkaTopic
+	metadata, err := h.producer.GetMetadata(&topic, false, KafkaTimeoutMs)
+	switch {
+	case err != nil:
+		readiness.add("kafka", HealthUnavailable, err.Error())
+	case len(metadata.Brokers) == 0:
+		readiness.add("kafka", HealthUnavailable, "no brokers available")
+	case metadata.Topics[topic].Error.Code() != kafka.ErrNoError:
+		readiness.add("kafka", HealthUnavailable, fmt.Sprintf("topic %s: %v", topic, metadata.Topics[topic].Error))
+	default:
+		readiness.add("kafka", HealthOK, fmt.Sprintf("%d brokers", len(metadata.Brokers)))
+	}
+
+	depth := h.producer.Len()
+	if depth > SpoolDepthThreshold {
+		readiness.add("spool", HealthDegraded, fmt.Sprintf("%d messages queued, over the threshold of %d", depth, SpoolDepthThreshold))
+	} else {
+		readiness.add("spool", HealthOK, fmt.Sprintf("%d messages queued", depth))
+	}
+	return readiness
+}
+
+// pingListener checks the connection holding the LISTEN. The listener's Ping
+// takes no context, so it is abandoned rather than cancelled on timeout.
+func pingListener(ctx context.Context, listener *pq.Listener) error {
+	result := make(chan error, 1)
+	go func() {
+		result <- listener.Ping()
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return errors.New("listener did not answer in time")
+	}
+}
+
+// handleLiveness answers as long as the process is serving requests.
+func handleLiveness(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, map[string]string{"status": HealthOK})
+}
+
+// handleReadiness answers 503 when any check is unavailable.
+func (h *HealthChecker) handleReadiness(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), HealthCheckTimeout)
+	defer cancel()
+	readiness := h.Ready(ctx)
+	status := http.StatusOK
+	if readiness.Status == HealthUnavailable {
+		status = http.StatusServiceUnavailable
+	}
+	writeHealth(w, status, readiness)
+}
+
+func writeHealth(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
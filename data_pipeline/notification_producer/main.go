@@ -9,43 +9,73 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"github.com/confluentinc/confluent-kafka-go/kafka"
 	"github.com/lib/pq"
 	_ "github.com/lib/pq"
 	"log"
+	"strconv"
 	"time"
 )
 
 type Notification struct {
+	Source    string                 `json:"source,omitempty"` // tag of the database it comes from, with several sources
 	Table     string                 `json:"table"`
 	Operation string                 `json:"operation"`
-	Data      map[string]interface{} `json:"data"`
+	Version   int64                  `json:"version,omitempty"`
+	TxID      int64                  `json:"txid,omitempty"`
+	Count     int                    `json:"count,omitempty"` // changes in the transaction, on COMMIT markers
+	Data      map[string]interface{} `json:"data,omitempty"`
+	Old       map[string]interface{} `json:"old,omitempty"` // previous row image, on updates
 }
 
 func main() {
-	connStr := PostgresURL //TODO: Fetch from env or aws secrets
-	db := openDatabaseConnection(connStr)
-	defer db.Close()
+	sourcesPath := flag.String("sources", "", "path to a YAML or JSON list of Postgres sources to listen to (defaults to PostgresURL alone)")
+	flag.Parse()
 
-	channels := []string{NotificationChannel} // Replace with your channel name
-	setupDatabaseListeners(db, channels)
+	sources, err := loadSources(*sourcesPath) //TODO: Fetch URLs from env or aws secrets
+	if err != nil {
+		log.Fatalf("Error loading sources: %v", err)
+	}
 
 	brokers := BootstrapServer // Replace with your Kafka broker addresses
 	producer := setupConfluentKafkaProducer(brokers)
 	defer closeConfluentKafkaProducer(producer)
 
-	listener := setupPqListener(connStr)
-	defer listener.Close()
+	connections := make([]*sourceConnection, len(sources))
+	for i, source := range sources {
+		db := openDatabaseConnection(source.URL)
+		defer db.Close()
+		setupDatabaseListeners(db, []string{source.Channel})
+
+		listener := setupPqListener(source.URL, source.Channel)
+		defer listener.Close()
+		connections[i] = &sourceConnection{source: source, db: db, listener: listener}
+	}
+
+	registerSpoolDepth(producer)
+	go serveMetrics(MetricsAddr, newHealthChecker(connections, producer))
+
+	// Every source is listened to on its own, so a quiet or reconnecting
+	// database does not hold up the others
+	for _, connection := range connections[1:] {
+		go listen(connection, producer)
+	}
+	listen(connections[0], producer)
+}
 
+// listen forwards the notifications of one source, checking its connection
+// when it has been quiet for a while.
+func listen(connection *sourceConnection, producer *kafka.Producer) {
 	for {
 		select {
-		case notification := <-listener.Notify:
-			handleNotification(notification, producer)
+		case notification := <-connection.listener.Notify:
+			handleNotification(connection.source, notification, producer)
 		case <-time.After(90 * time.Second):
 			fmt.Println("Received no events for 90 seconds, checking connection")
 			go func() {
-				listener.Ping()
+				connection.listener.Ping()
 			}()
 		}
 	}
@@ -80,7 +110,7 @@ func closeConfluentKafkaProducer(producer *kafka.Producer) {
 	producer.Close()
 }
 
-func setupPqListener(connStr string) *pq.Listener {
+func setupPqListener(connStr, channel string) *pq.Listener {
 	notificationHandler := func(ev pq.ListenerEventType, err error) {
 		if err != nil {
 			panic(err)
@@ -88,14 +118,20 @@ func setupPqListener(connStr string) *pq.Listener {
 	}
 
 	listener := pq.NewListener(connStr, 10*time.Second, time.Minute, notificationHandler)
-	err := listener.Listen(NotificationChannel)
+	err := listener.Listen(channel)
 	if err != nil {
 		panic(err)
 	}
 	return listener
 }
 
-func handleNotification(notification *pq.Notification, producer *kafka.Producer) {
+func handleNotification(source *Source, notification *pq.Notification, producer *kafka.Producer) {
+	if notification == nil {
+		// The listener reconnected; notifications sent meanwhile were lost
+		log.Printf("Reconnected to source %q", source.Name)
+		source.Reconnected()
+		return
+	}
 	fmt.Println("Received notification:", notification.Extra, notification.BePid)
 	var dbNotification Notification
 	err := json.Unmarshal([]byte(notification.Extra), &dbNotification)
@@ -103,6 +139,11 @@ func handleNotification(notification *pq.Notification, producer *kafka.Producer)
 		fmt.Println("Error parsing JSON:", err)
 		return
 	}
+	if !source.Forward(&dbNotification) {
+		return
+	}
+	dbNotification.Source = source.Name
+	notificationsReceived.WithLabelValues(source.Name, dbNotification.Table).Inc()
 	jsonData, err := json.Marshal(dbNotification)
 	if err != nil {
 		log.Println("Error converting to JSON:", err)
@@ -111,22 +152,44 @@ func handleNotification(notification *pq.Notification, producer *kafka.Producer)
 	kafkaTopic := KafkaTopic
 	message := &kafka.Message{
 		TopicPartition: kafka.TopicPartition{Topic: &kafkaTopic, Partition: kafka.PartitionAny},
-		Key:            []byte(dbNotification.Table),
+		Key:            []byte(messageKey(dbNotification)),
 		Value:          jsonData,
 	}
 
 	deliveryChan := make(chan kafka.Event)
 
+	start := time.Now()
 	producer.Produce(message, deliveryChan)
 
 	// Wait for delivery report
 	e := <-deliveryChan
 	m := e.(*kafka.Message)
+	publishDuration.Observe(time.Since(start).Seconds())
 
 	if m.TopicPartition.Error != nil {
+		deliveryFailures.Inc()
 		log.Printf("Delivery failed: %v\n", m.TopicPartition.Error)
 	} else {
 		log.Printf("Delivered message to topic %s [%d] at offset %v\n",
 			*m.TopicPartition.Topic, m.TopicPartition.Partition, m.TopicPartition.Offset)
 	}
 }
+
+// messageKey partitions messages by transaction, so that every change of a
+// transaction and its COMMIT marker reach the same consumer, which applies
+// them together. Notifications without a transaction id, from triggers
+// installed before the markers existed, are partitioned by table instead.
+// Two transactions changing the same row can land on different partitions;
+// the consumer versions its writes, link updates included, so that the
+// later change wins whichever is applied first. Both keys include the source when there are several, as txids are only
+// unique within a database.
+func messageKey(notification Notification) string {
+	key := notification.Table
+	if notification.TxID != 0 {
+		key = "tx:" + strconv.FormatInt(notification.TxID, 10)
+	}
+	if notification.Source == "" {
+		return key
+	}
+	return notification.Source + ":" + key
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log"
+	"net/http"
+)
+
+var (
+	notificationsReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pgsync_producer_notifications_total",
+		Help: "Postgres notifications received, by source and table.",
+	}, []string{"source", "table"})
+
+	publishDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "pgsync_producer_publish_duration_seconds",
+		Help:    "Time from producing a message to receiving its delivery report.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	deliveryFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pgsync_producer_delivery_failures_total",
+		Help: "Messages Kafka failed to deliver.",
+	})
+)
+
+// registerSpoolDepth reports the number of messages waiting in the producer's
+// local queue for delivery to Kafka.
+func registerSpoolDepth(producer *kafka.Producer) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "pgsync_producer_spool_depth",
+		Help: "Messages queued in the producer and not yet delivered to Kafka.",
+	}, func() float64 {
+		return float64(producer.Len())
+	})
+}
+
+// serveMetrics exposes the Prometheus registry on addr, next to the liveness
+// and readiness endpoints.
+func serveMetrics(addr string, health *HealthChecker) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/health/live", handleLiveness)
+	mux.HandleFunc("/health/ready", health.handleReadiness)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Printf("Error serving metrics on %s: %v", addr, err)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/lib/pq"
+	"gopkg.in/yaml.v3"
+	"os"
+	"regexp"
+)
+
+// validSourceName keeps source tags usable in index names and document ids.
+var validSourceName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Source is a Postgres database the producer listens to. Name tags every
+// notification from it; Tables, when set, limits which tables are forwarded.
+type Source struct {
+	Name    string   `yaml:"name" json:"name"`
+	URL     string   `yaml:"url" json:"url"`
+	Channel string   `yaml:"channel" json:"channel"`
+	Tables  []string `yaml:"tables" json:"tables"`
+
+	tables    map[string]bool
+	forwarded map[int64]int // changes forwarded per open transaction, with Tables set
+}
+
+// Forward reports whether a notification is forwarded. With Tables set, a
+// COMMIT marker is forwarded with its count cut down to the changes of its
+// transaction that were forwarded, and dropped when there were none, so the
+// consumer does not wait for changes it will never receive. It is only
+// called from the source's listen loop.
+func (s *Source) Forward(notification *Notification) bool {
+	if len(s.tables) == 0 {
+		return true
+	}
+	if notification.Operation == OperationCommit {
+		count := s.forwarded[notification.TxID]
+		delete(s.forwarded, notification.TxID)
+		notification.Count = count
+		return count > 0
+	}
+	if !s.tables[notification.Table] {
+		return false
+	}
+	if notification.TxID != 0 {
+		s.forwarded[notification.TxID]++
+	}
+	return true
+}
+
+// Reconnected forgets the open transactions, whose markers may have been
+// lost with the connection.
+func (s *Source) Reconnected() {
+	if len(s.tables) > 0 {
+		s.forwarded = make(map[int64]int)
+	}
+}
+
+// sourceConnection is a source with its database handle and the listener
+// receiving its notifications.
+type sourceConnection struct {
+	source   *Source
+	db       *sql.DB
+	listener *pq.Listener
+}
+
+// loadSources reads a YAML or JSON list of sources from path. Without a path
+// the producer listens to PostgresURL alone, with no source tag, as it always
+// has.
+func loadSources(path string) ([]*Source, error) {
+	if path == "" {
+		return []*Source{{URL: PostgresURL, Channel: NotificationChannel}}, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Sources []*Source `yaml:"sources" json:"sources"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if len(file.Sources) == 0 {
+		return nil, fmt.Errorf("%s declares no sources", path)
+	}
+
+	seen := make(map[string]bool, len(file.Sources))
+	for _, source := range file.Sources {
+		if !validSourceName.MatchString(source.Name) {
+			return nil, fmt.Errorf("source name %q must be lowercase letters, digits, '-' and '_'", source.Name)
+		}
+		if seen[source.Name] {
+			return nil, fmt.Errorf("source %s is declared twice", source.Name)
+		}
+		seen[source.Name] = true
+		if source.URL == "" {
+			return nil, fmt.Errorf("source %s has no url", source.Name)
+		}
+		if source.Channel == "" {
+			source.Channel = NotificationChannel
+		}
+		source.tables = make(map[string]bool, len(source.Tables))
+		for _, table := range source.Tables {
+			source.tables[table] = true
+		}
+		source.forwarded = make(map[int64]int)
+	}
+	return file.Sources, nil
+}
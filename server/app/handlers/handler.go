@@ -1,9 +1,12 @@
 package handlers
 
 import (
+	"context"
 	"github.com/gin-gonic/gin"
 	"log"
+	"net/http"
 	"pgsync/server/app/middleware/web"
+	"pgsync/server/config"
 	"pgsync/server/database"
 )
 
@@ -28,107 +31,44 @@ func SearchProjectsByUser(ctx *gin.Context) (*web.JSONResponse, *web.ErrorInterf
 	userName := user["name"].(string)
 	createdAt := user["created_at"].(string)
 
-	// Query Elasticsearch to get the list of project IDs associated with the user
-	userProjects, err := database.GetUserProjectsByUserID(int(userID))
+	// Query Elasticsearch for the user's projects, which embed their hashtags.
+	// User ids repeat across sources, so only the user's source is searched.
+	source, _ := user[config.SourceField].(string)
+	projects, err := database.GetProjectsByUser(int(userID), source)
 	if err != nil {
 		log.Printf("Error querying user projects: %v", err)
 		return nil, web.NewError(500, "Internal Server Error", "Error querying user projects", nil)
 	}
-
-	// Fetch detailed project information using the retrieved project IDs
-	projects, err := database.GetProjectsDetails(userProjects)
-	if err != nil {
-		log.Printf("Error querying project details: %v", err)
-		return nil, web.NewError(500, "Internal Server Error", "Error querying project details", nil)
-	}
-
-	// Attach hashtag details to each project in the result
-	resultProjects, err := attachHashtagsToProjects(projects)
-	if err != nil {
-		log.Printf("Error attaching hashtag details to projects: %v", err)
-		return nil, web.NewError(500, "Internal Server Error", "Error attaching hashtag details to projects", nil)
+	for _, project := range projects {
+		delete(project, "hashtag_ids")
+		delete(project, "user_ids")
+		delete(project, "users")
 	}
 
 	// Merge user information with project details
 	result := map[string]interface{}{
 		"user":     map[string]interface{}{"id": userID, "name": userName, "created_at": createdAt},
-		"projects": resultProjects,
+		"projects": projects,
 	}
 
 	// Return the result as a JSON response
 	return web.NewHTTPSuccessResponse(ctx, result), nil
 }
 
-func attachHashtagsToProjects(projects []map[string]interface{}) ([]map[string]interface{}, error) {
-	// Extract all hashtag IDs from projects
-	var hashtagIDs []int
-	for _, project := range projects {
-		ids, ok := project["hashtag_ids"].([]interface{})
-		if !ok {
-			continue
-		}
-		for _, id := range ids {
-			if hashtagID, ok := id.(float64); ok {
-				hashtagIDs = append(hashtagIDs, int(hashtagID))
-			}
-		}
-	}
-
-	// Query Elasticsearch to get details of all hashtags using the hashtag IDs
-	hashtags, err := database.GetHashtagsDetails(hashtagIDs)
-	if err != nil {
-		log.Printf("Error querying hashtag details: %v", err)
-		return nil, err
-	}
-	// Create a map for faster lookup of hashtag details using ID
-
-	hashtagMap := make(map[int]map[string]interface{})
-	for _, hashtag := range hashtags {
-		id, ok := hashtag["id"].(float64)
-		if ok {
-			hashtagMap[int(id)] = hashtag
-		}
-	}
-	log.Printf("hashtag details: %v", hashtagMap)
-	// Attach hashtag details to each project in the result
-	for _, project := range projects {
-		ids, ok := project["hashtag_ids"].([]interface{})
-		if !ok {
-			continue
-		}
-		var projectHashtags []map[string]interface{}
-		for _, id := range ids {
-			if hashtagID, ok := id.(float64); ok {
-				if hashtag, exists := hashtagMap[int(hashtagID)]; exists {
-					projectHashtags = append(projectHashtags, map[string]interface{}{
-						"id":   hashtag["id"],
-						"name": hashtag["name"],
-					})
-				}
-			}
-		}
-
-		project["hashtags"] = projectHashtags
-		delete(project, "hashtag_ids")
-		delete(project, "user_ids")
-	}
-	return projects, nil
-}
-
 // SearchProjectsByHashtags handles the search for projects that use specific hashtags.
 func SearchProjectsByHashtags(ctx *gin.Context) (*web.JSONResponse, *web.ErrorInterface) {
 	// Extract hashtags from the request or URL parameters
 	hashtags := ctx.Param("hashtags")
 	log.Println(hashtags)
 
-	hashtagDetails, err := database.GetProjectsDetailsByHashtags(hashtags)
+	hashtagDetails, err := database.GetHashtagsByName(hashtags)
 	if err != nil {
 		log.Printf("Error querying project details: %v", err)
 		return nil, web.NewError(500, "Internal Server Error", "Error querying project details", nil)
 	}
 
-	// Attach hashtag details and user details to each project in the result
-	resultProjects, err := attachDetailsToHashtag(hashtagDetails)
+	// Attach project details, with their users, to each hashtag in the result
+	resultProjects, err := attachProjectsToHashtags(hashtagDetails)
 	if err != nil {
 		log.Printf("Error attaching details to hashtagDetails: %v", err)
 		return nil, web.NewError(500, "Internal Server Error", "Error attaching details to hashtagDetails", nil)
@@ -138,104 +78,64 @@ func SearchProjectsByHashtags(ctx *gin.Context) (*web.JSONResponse, *web.ErrorIn
 	return web.NewHTTPSuccessResponse(ctx, map[string]interface{}{"hashtags": resultProjects}), nil
 }
 
-// attachDetailsToHashtag attaches hashtag details and user details to each project.
-func attachDetailsToHashtag(hashtagDetails []map[string]interface{}) ([]map[string]interface{}, error) {
-	// Extract all project IDs and user IDs from hashtagDetails
-	var projectIDs []int
-	var userIDs []int
-
+// attachProjectsToHashtags replaces the project ids of each hashtag with the
+// projects' details. Projects embed summaries of their users, so one search
+// per source fetches everything: project ids repeat across sources, so each
+// hashtag's ids are looked up among the projects of its own source.
+func attachProjectsToHashtags(hashtagDetails []map[string]interface{}) ([]map[string]interface{}, error) {
+	// Extract all project IDs from hashtagDetails, by source
+	projectIDs := make(map[string][]interface{})
 	for _, hashtag := range hashtagDetails {
-		// Extracting project IDs
-		ids, ok := hashtag["project_ids"].([]interface{})
-		if ok {
-			for _, id := range ids {
-				if projectID, ok := id.(float64); ok {
-					projectIDs = append(projectIDs, int(projectID))
-				}
-			}
+		source, _ := hashtag[config.SourceField].(string)
+		if ids, ok := hashtag["project_ids"].([]interface{}); ok {
+			projectIDs[source] = append(projectIDs[source], ids...)
 		}
-
 	}
 
-	// Query Elasticsearch to get details of all projects using the project IDs
-	projects, err := database.GetProjectsDetails(projectIDs)
-	if err != nil {
-		log.Printf("Error querying project details: %v", err)
-		return nil, err
-	}
-	// Create a map for faster lookup of project details using ID
-	projectMap := make(map[int]map[string]interface{})
-	for _, project := range projects {
-		id, ok := project["id"].(float64)
-		if ok {
-			projectMap[int(id)] = project
+	// Create a map for faster lookup of project details using source and ID
+	projectMap := make(map[string]map[float64]map[string]interface{})
+	for source, ids := range projectIDs {
+		if len(ids) == 0 {
+			continue
 		}
-		userID, ok := project["user_ids"].([]interface{})
-		if ok {
-			for _, id := range userID {
-				if userID, ok := id.(float64); ok {
-					userIDs = append(userIDs, int(userID))
-				}
-			}
+		projects, err := database.GetProjectsByIDs(ids, source)
+		if err != nil {
+			log.Printf("Error querying project details: %v", err)
+			return nil, err
 		}
-	}
-	// Query Elasticsearch to get details of all users using the user IDs
-	users, err := database.GetUsersDetails(userIDs)
-	if err != nil {
-		log.Printf("Error querying user details: %v", err)
-		return nil, err
-	}
-	// Create a map for faster lookup of user details using ID
-	userMap := make(map[int]map[string]interface{})
-	for _, user := range users {
-		id, ok := user["id"].(float64)
-		if ok {
-			userMap[int(id)] = user
+		projectMap[source] = make(map[float64]map[string]interface{}, len(projects))
+		for _, project := range projects {
+			if id, ok := project["id"].(float64); ok {
+				projectMap[source][id] = project
+			}
 		}
 	}
-	// Attach project details and user details to each hashtag in the result
+
 	for _, hashtag := range hashtagDetails {
-		// Attach project details
 		ids, ok := hashtag["project_ids"].([]interface{})
-		if ok {
-			var projectList []map[string]interface{}
-			for _, id := range ids {
-				if projectID, ok := id.(float64); ok {
-					if project, exists := projectMap[int(projectID)]; exists {
-
-						newUserIDs, ok := project["user_ids"].([]interface{})
-						var userList []map[string]interface{}
-						if ok {
-							for _, eachUser := range newUserIDs {
-								if user, exists := userMap[int(eachUser.(float64))]; exists {
-									userList = append(userList, map[string]interface{}{
-										"id":   user["id"],
-										"name": user["name"],
-										// Add other user details as needed
-									})
-								}
-								log.Printf("project: %v", project)
-							}
-						}
-						projectList = append(projectList, map[string]interface{}{
-							"id":          project["id"],
-							"name":        project["name"],
-							"slug":        project["slug"],
-							"description": project["description"],
-							"users":       userList,
-							// Add other project details as needed
-						})
-						log.Printf("project list: %v", projectList)
-					}
-
-				}
+		if !ok {
+			continue
+		}
+		source, _ := hashtag[config.SourceField].(string)
+		var projectList []map[string]interface{}
+		for _, id := range ids {
+			projectID, ok := id.(float64)
+			if !ok {
+				continue
+			}
+			if project, exists := projectMap[source][projectID]; exists {
+				projectList = append(projectList, map[string]interface{}{
+					"id":          project["id"],
+					"name":        project["name"],
+					"slug":        project["slug"],
+					"description": project["description"],
+					"users":       project["users"],
+				})
 			}
-			hashtag["projects"] = projectList
-			delete(hashtag, "project_ids")
 		}
-		// Attach user details
+		hashtag["projects"] = projectList
+		delete(hashtag, "project_ids")
 	}
-
 	return hashtagDetails, nil
 }
 
@@ -280,3 +180,27 @@ func SendError(ctx *gin.Context) (*web.JSONResponse, *web.ErrorInterface) {
 		"Error": "Temporary Downtime",
 	})
 }
+
+// SendLiveness answers as long as the server is handling requests.
+func SendLiveness(ctx *gin.Context) (*web.JSONResponse, *web.ErrorInterface) {
+	return web.NewHTTPSuccessResponse(ctx, map[string]interface{}{"status": database.HealthOK}), nil
+}
+
+// SendReadiness checks Elasticsearch and the indexes the API searches, and
+// answers 503 when either is unavailable.
+func SendReadiness(ctx *gin.Context) (*web.JSONResponse, *web.ErrorInterface) {
+	checkCtx, cancel := context.WithTimeout(ctx.Request.Context(), config.HealthCheckTimeout)
+	defer cancel()
+	checks := map[string]database.HealthCheck{
+		"elasticsearch": database.CheckElasticsearch(checkCtx),
+		"indexes":       database.CheckIndexes(checkCtx),
+	}
+
+	status, statusCode := database.HealthOK, http.StatusOK
+	for _, check := range checks {
+		if check.Status != database.HealthOK {
+			status, statusCode = database.HealthUnavailable, http.StatusServiceUnavailable
+		}
+	}
+	return web.NewJSONResponse(ctx, statusCode, map[string]interface{}{"status": status, "checks": checks}), nil
+}
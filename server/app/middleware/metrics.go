@@ -0,0 +1,31 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"strconv"
+	"time"
+)
+
+var requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "pgsync_api_request_duration_seconds",
+	Help:    "Latency of API requests, by route, method and status code.",
+	Buckets: prometheus.DefBuckets,
+}, []string{"route", "method", "status"})
+
+// RequestMetrics records the latency and status of every request under the
+// route pattern it matched, so that path parameters do not create new series.
+func RequestMetrics() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		start := time.Now()
+		ctx.Next()
+
+		route := ctx.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		requestDuration.WithLabelValues(route, ctx.Request.Method, strconv.Itoa(ctx.Writer.Status())).
+			Observe(time.Since(start).Seconds())
+	}
+}
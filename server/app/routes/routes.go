@@ -2,6 +2,7 @@ package routes
 
 import (
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"log"
 	"pgsync/server/app/handlers"
 	"pgsync/server/app/middleware"
@@ -13,10 +14,17 @@ const GetProjectByHashtag = "/hashtags/:hashtags"
 const SearchProject = "/search"
 const SendError = "/error"
 const HealthCheck = "/health-check"
+const Metrics = "/metrics"
+const Liveness = "/health/live"
+const Readiness = "/health/ready"
 
 func SetupServer() *gin.Engine {
 	log.Printf("setting_up_routes...")
 	r := gin.Default()
+	r.Use(middleware.RequestMetrics())
+	r.GET(Metrics, gin.WrapH(promhttp.Handler()))
+	r.GET(Liveness, middleware.ServeEndpoint(handlers.SendLiveness))
+	r.GET(Readiness, middleware.ServeEndpoint(handlers.SendReadiness))
 	pgCore := r.Group("/v1/projects")
 	_, err := database.ConnectEsClient()
 	if err != nil {
@@ -1,6 +1,27 @@
 package config
 
+import (
+	"os"
+	"time"
+)
+
 const PORT = ":8080"
 const ProjectIndex = "projects"
 const UserIndex = "users"
-const HashtagIndex = "hashtags"
\ No newline at end of file
+const HashtagIndex = "hashtags"
+const HealthCheckTimeout = 5 * time.Second
+const ShadowIndexSuffix = "_shadow"
+
+// SourceField holds the source database of each document in indexes the
+// consumer shares between several sources. Ids only identify a document
+// together with its source there.
+const SourceField = "source"
+
+// LinkVersionsField is where the consumer keeps the version of each link of a
+// document. It is bookkeeping, so searches leave it out of their results.
+const LinkVersionsField = "link_versions"
+
+// ShadowRead repeats every search on the shadow of its index, as written by
+// the consumer's -shadow-mappings, and logs how the results differ. Enable it
+// with SHADOW_READ=true.
+var ShadowRead = os.Getenv("SHADOW_READ") == "true"
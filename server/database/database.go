@@ -2,15 +2,14 @@ package database
 
 import (
 	"bytes"
-	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/elastic/go-elasticsearch/v8"
-	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"io"
 	"log"
 	"pgsync/server/config"
-	"strings"
 	"sync"
+	"time"
 )
 
 var (
@@ -18,76 +17,9 @@ var (
 	esClientOnce sync.Once
 )
 
-func GetUserProjectsByUserID(userID int) ([]int, error) {
-	_, err := ConnectEsClient()
-	if err != nil {
-		return nil, err
-	}
-	indexName := config.UserIndex
-	// Define the query to get user projects
-	query := map[string]interface{}{
-		"query": map[string]interface{}{
-			"match": map[string]interface{}{
-				"id": userID,
-			},
-		},
-	}
-
-	// Serialize the query to JSON
-	queryJSON, err := json.Marshal(query)
-	if err != nil {
-		return nil, err
-	}
-
-	// Create an io.Reader from the JSON bytes
-	bodyReader := strings.NewReader(string(queryJSON))
-
-	// Define the SearchRequest
-	request := esapi.SearchRequest{
-		Index: []string{indexName},
-		Body:  bodyReader,
-	}
-
-	// Perform the search request
-	response, err := request.Do(context.Background(), esClient)
-	if err != nil {
-		return nil, err
-	}
-	defer response.Body.Close()
-
-	// Parse the response
-	var result map[string]interface{}
-	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
-		return nil, err
-	}
-
-	// Extract project IDs from the response
-	var projectIDs []int
-	hits, ok := result["hits"].(map[string]interface{})["hits"].([]interface{})
-	if !ok {
-		return nil, fmt.Errorf("unexpected response format")
-	}
-	for _, hit := range hits {
-		source, ok := hit.(map[string]interface{})["_source"].(map[string]interface{})
-		if !ok {
-			continue
-		}
-		projectIDsField, ok := source["project_ids"].([]interface{})
-		if !ok {
-			continue
-		}
-		for _, projectID := range projectIDsField {
-			if id, ok := projectID.(float64); ok {
-				projectIDs = append(projectIDs, int(id))
-			}
-		}
-	}
-
-	return projectIDs, nil
-}
-
 // getUserByName queries Elasticsearch to get the user details by name.
 func GetUserById(userID string) (map[string]interface{}, error) {
+	defer observeQuery("user_by_id", time.Now())
 	_, err := ConnectEsClient()
 	if err != nil {
 		return nil, err
@@ -107,25 +39,15 @@ func GetUserById(userID string) (map[string]interface{}, error) {
 		return nil, err
 	}
 
-	// Create an io.Reader from the JSON bytes
-	bodyReader := strings.NewReader(string(queryJSON))
-
-	// Define the SearchRequest
-	request := esapi.SearchRequest{
-		Index: []string{indexName},
-		Body:  bodyReader,
-	}
-
 	// Perform the search request
-	response, err := request.Do(context.Background(), esClient)
+	body, err := search("user_by_id", indexName, queryJSON)
 	if err != nil {
 		return nil, err
 	}
-	defer response.Body.Close()
 
 	// Parse the response
 	var result map[string]interface{}
-	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+	if err := json.Unmarshal(body, &result); err != nil {
 		return nil, err
 	}
 
@@ -143,239 +65,183 @@ func GetUserById(userID string) (map[string]interface{}, error) {
 	return source, nil
 }
 
-// getProjectsDetails queries Elasticsearch to fetch detailed information about projects using their IDs.
-func GetProjectsDetails(projectIDs []int) ([]map[string]interface{}, error) {
+// GetProjectsByUser searches the projects a user of source belongs to.
+// Projects embed {id, name} summaries of their users and hashtags, so one
+// search returns everything the response needs.
+func GetProjectsByUser(userID int, source string) ([]map[string]interface{}, error) {
+	defer observeQuery("projects_by_user", time.Now())
 	_, err := ConnectEsClient()
 	if err != nil {
 		return nil, err
 	}
-	indexName := config.ProjectIndex
 
-	// Define the query to get project details by project IDs
-	query := map[string]interface{}{
-		"query": map[string]interface{}{
-			"terms": map[string]interface{}{
-				"id": projectIDs,
+	// Users are nested objects, so match them with a nested query
+	searchRequest := map[string]interface{}{
+		"query": fromSource(map[string]interface{}{
+			"nested": map[string]interface{}{
+				"path": "users",
+				"query": map[string]interface{}{
+					"term": map[string]interface{}{
+						"users.id": userID,
+					},
+				},
 			},
-		},
+		}, source),
 	}
-
-	// Serialize the query to JSON
-	queryJSON, err := json.Marshal(query)
-	if err != nil {
-		return nil, err
-	}
-
-	// Create an io.Reader from the JSON bytes
-	bodyReader := strings.NewReader(string(queryJSON))
-
-	// Define the SearchRequest
-	request := esapi.SearchRequest{
-		Index: []string{indexName},
-		Body:  bodyReader,
-	}
-
-	// Perform the search request
-	response, err := request.Do(context.Background(), esClient)
+	hits, err := searchProjects("projects_by_user", searchRequest)
 	if err != nil {
 		return nil, err
 	}
-	defer response.Body.Close()
 
-	// Parse the response
-	var result map[string]interface{}
-	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
-		return nil, err
-	}
-
-	// Extract project details from the response
 	var projects []map[string]interface{}
-	hits, ok := result["hits"].(map[string]interface{})["hits"].([]interface{})
-	if !ok {
-		return nil, fmt.Errorf("unexpected response format")
-	}
 	for _, hit := range hits {
-		source, ok := hit.(map[string]interface{})["_source"].(map[string]interface{})
-		if !ok {
-			continue
-		}
-		projects = append(projects, source)
+		projects = append(projects, hit.Source)
 	}
-
 	return projects, nil
 }
 
-func GetHashtagsDetails(hashtagIDs []int) ([]map[string]interface{}, error) {
-	// Filter out null values from hashtagIDs
+// GetHashtagsByName searches the hashtags whose name is exactly the given
+// one.
+func GetHashtagsByName(hashtag string) ([]map[string]interface{}, error) {
+	defer observeQuery("projects_by_hashtag", time.Now())
 	_, err := ConnectEsClient()
 	if err != nil {
 		return nil, err
 	}
-	filteredHashtagIDs := make([]int, 0, len(hashtagIDs))
-	for _, id := range hashtagIDs {
-		if id != 0 { // Assuming 0 represents a null value, adjust this condition if needed
-			filteredHashtagIDs = append(filteredHashtagIDs, id)
-		}
-	}
-
-	// Check if all values were null
-	if len(filteredHashtagIDs) == 0 {
-		return nil, nil
-	}
 
-	// Build the terms query for hashtag IDs
-	termsQuery := map[string]interface{}{
-		"terms": map[string]interface{}{
-			"id": filteredHashtagIDs,
-		},
-	}
-
-	// Create the search request
+	// name is a keyword, so this only matches the exact name
 	searchRequest := map[string]interface{}{
-		"query": termsQuery,
+		"query": map[string]interface{}{
+			"match": map[string]interface{}{
+				"name": hashtag,
+			},
+		},
 	}
-
-	// Convert the search request to JSON
 	searchJSON, err := json.Marshal(searchRequest)
 	if err != nil {
 		return nil, err
 	}
-
-	// Execute the search query against Elasticsearch
-	res, err := esClient.Search(
-		esClient.Search.WithIndex(config.HashtagIndex),
-		esClient.Search.WithBody(bytes.NewReader(searchJSON)),
-	)
+	body, err := search("projects_by_hashtag", config.HashtagIndex, searchJSON)
 	if err != nil {
 		return nil, err
 	}
-	defer res.Body.Close()
 
-	// Check if the response is successful
-	if res.IsError() {
-		return nil, fmt.Errorf("Elasticsearch error: %s", res.String())
+	var response struct {
+		Hits struct {
+			Hits []searchHit `json:"hits"`
+		} `json:"hits"`
 	}
-
-	// Parse the response to get the hashtag details
-	var response map[string]interface{}
-	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+	if err := json.Unmarshal(body, &response); err != nil {
 		return nil, err
 	}
-
-	// Extract the hits from the response
-	hits, ok := response["hits"].(map[string]interface{})["hits"].([]interface{})
-	if !ok {
-		return nil, fmt.Errorf("Invalid Elasticsearch response format")
+	var hashtags []map[string]interface{}
+	for _, hit := range response.Hits.Hits {
+		hashtags = append(hashtags, hit.Source)
 	}
-	// Extract the source of each hit (hashtag details)
-	var hashtagDetails []map[string]interface{}
-	for _, hit := range hits {
-		hitMap, ok := hit.(map[string]interface{})
-		if !ok {
-			continue
-		}
-
-		source, ok := hitMap["_source"].(map[string]interface{})
-		if ok {
-			hashtagDetails = append(hashtagDetails, source)
-		}
-	}
-
-	return hashtagDetails, nil
+	return hashtags, nil
 }
 
-// GetProjectsDetailsByHashtags fetches project details based on specified hashtags.
-func GetProjectsDetailsByHashtags(hashtag string) ([]map[string]interface{}, error) {
+// GetProjectsByIDs searches the projects of source with the given ids.
+// Projects embed {id, name} summaries of their users, so no user search is
+// needed.
+func GetProjectsByIDs(projectIDs []interface{}, source string) ([]map[string]interface{}, error) {
+	defer observeQuery("projects_details", time.Now())
 	_, err := ConnectEsClient()
 	if err != nil {
 		return nil, err
 	}
-	indexName := config.HashtagIndex
-
-	// Build the terms query for hashtag
-	termQuery := map[string]interface{}{
-		"match": map[string]interface{}{
-			"name": hashtag,
-		},
-	}
 
-	// Create the search request
 	searchRequest := map[string]interface{}{
-		"query": termQuery,
+		"size": len(projectIDs),
+		"query": fromSource(map[string]interface{}{
+			"terms": map[string]interface{}{
+				"id": projectIDs,
+			},
+		}, source),
 	}
-
-	// Convert the search request to JSON
-	searchJSON, err := json.Marshal(searchRequest)
+	hits, err := searchProjects("projects_details", searchRequest)
 	if err != nil {
 		return nil, err
 	}
 
-	// Execute the search query against Elasticsearch
-	res, err := esClient.Search(
-		esClient.Search.WithIndex(indexName),
-		esClient.Search.WithBody(bytes.NewReader(searchJSON)),
-	)
-	if err != nil {
-		return nil, err
+	var projects []map[string]interface{}
+	for _, hit := range hits {
+		projects = append(projects, hit.Source)
 	}
-	defer res.Body.Close()
+	return projects, nil
+}
 
-	// Check if the response is successful
-	if res.IsError() {
-		return nil, fmt.Errorf("Elasticsearch error: %s", res.String())
+// fromSource restricts query to the documents of source. Link arrays and
+// summaries hold ids as they are in their source database, so in indexes
+// shared by several sources an id is only looked up among the documents of
+// the source that holds it. Documents without a source are matched by query
+// alone.
+func fromSource(query map[string]interface{}, source string) map[string]interface{} {
+	if source == "" {
+		return query
 	}
-
-	// Parse the response to get the project details
-	var response map[string]interface{}
-	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
-		return nil, err
-	}
-	// Extract the hits from the response
-	hits, ok := response["hits"].(map[string]interface{})["hits"].([]interface{})
-	if !ok {
-		return nil, fmt.Errorf("Invalid Elasticsearch response format")
-	}
-	// Extract the source of each hit (project details)
-	var projectDetails []map[string]interface{}
-	for _, hit := range hits {
-		source, ok := hit.(map[string]interface{})["_source"].(map[string]interface{})
-		if ok {
-			projectDetails = append(projectDetails, source)
-		}
+	return map[string]interface{}{
+		"bool": map[string]interface{}{
+			"must": query,
+			"filter": map[string]interface{}{
+				"term": map[string]interface{}{config.SourceField: source},
+			},
+		},
 	}
+}
 
-	return projectDetails, nil
+// searchHit is a search hit with its source.
+type searchHit struct {
+	Source map[string]interface{} `json:"_source"`
 }
 
-func GetUsersDetails(userIDs []int) ([]map[string]interface{}, error) {
-	_, err := ConnectEsClient()
+// searchProjects runs the search named query on the projects index and
+// returns its hits.
+func searchProjects(query string, searchRequest map[string]interface{}) ([]searchHit, error) {
+	// Convert the search request to JSON
+	searchJSON, err := json.Marshal(searchRequest)
 	if err != nil {
 		return nil, err
 	}
-	indexName := config.UserIndex
 
-	// Build the terms query for user IDs
-	termsQuery := map[string]interface{}{
-		"terms": map[string]interface{}{
-			"id": userIDs,
-		},
+	// Execute the search query against Elasticsearch
+	body, err := search(query, config.ProjectIndex, searchJSON)
+	if err != nil {
+		return nil, err
 	}
 
-	// Create the search request
-	searchRequest := map[string]interface{}{
-		"query": termsQuery,
+	// Parse the response to get the hits
+	var response struct {
+		Hits struct {
+			Hits []searchHit `json:"hits"`
+		} `json:"hits"`
 	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, err
+	}
+	return response.Hits.Hits, nil
+}
 
-	// Convert the search request to JSON
-	searchJSON, err := json.Marshal(searchRequest)
+// search runs a search on index and returns the response body. With shadow
+// reads on, the same search is repeated on the index's shadow in the
+// background and the results compared; the caller only sees the primary's.
+func search(query, index string, searchJSON []byte) ([]byte, error) {
+	start := time.Now()
+	body, err := searchIndex(index, searchJSON)
 	if err != nil {
 		return nil, err
 	}
+	if config.ShadowRead {
+		go compareShadowSearch(query, index, searchJSON, body, time.Since(start))
+	}
+	return body, nil
+}
 
-	// Execute the search query against Elasticsearch
+func searchIndex(index string, searchJSON []byte) ([]byte, error) {
 	res, err := esClient.Search(
-		esClient.Search.WithIndex(indexName),
+		esClient.Search.WithIndex(index),
 		esClient.Search.WithBody(bytes.NewReader(searchJSON)),
+		esClient.Search.WithSourceExcludes(config.LinkVersionsField),
 	)
 	if err != nil {
 		return nil, err
@@ -386,32 +252,11 @@ func GetUsersDetails(userIDs []int) ([]map[string]interface{}, error) {
 	if res.IsError() {
 		return nil, fmt.Errorf("Elasticsearch error: %s", res.String())
 	}
-
-	// Parse the response to get the user details
-	var response map[string]interface{}
-	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
-		return nil, err
-	}
-
-	// Extract the hits from the response
-	hits, ok := response["hits"].(map[string]interface{})["hits"].([]interface{})
-	if !ok {
-		return nil, fmt.Errorf("Invalid Elasticsearch response format")
-	}
-
-	// Extract the source of each hit (user details)
-	var userDetails []map[string]interface{}
-	for _, hit := range hits {
-		source, ok := hit.(map[string]interface{})["_source"].(map[string]interface{})
-		if ok {
-			userDetails = append(userDetails, source)
-		}
-	}
-
-	return userDetails, nil
+	return io.ReadAll(res.Body)
 }
 
 func FuzzySearchSlugDescription(slug string, description string) ([]map[string]interface{}, error) {
+	defer observeQuery("fuzzy_search", time.Now())
 	// Build the fuzzy search query for slug
 	_, err := ConnectEsClient()
 	if err != nil {
@@ -442,23 +287,14 @@ func FuzzySearchSlugDescription(slug string, description string) ([]map[string]i
 	}
 
 	// Execute the search query against Elasticsearch
-	res, err := esClient.Search(
-		esClient.Search.WithIndex(config.ProjectIndex),
-		esClient.Search.WithBody(bytes.NewReader(searchJSON)),
-	)
+	body, err := search("fuzzy_search", config.ProjectIndex, searchJSON)
 	if err != nil {
 		return nil, err
 	}
-	defer res.Body.Close()
-
-	// Check if the response is successful
-	if res.IsError() {
-		return nil, fmt.Errorf("Elasticsearch error: %s", res.String())
-	}
 
 	// Parse the response to get the project details
 	var response map[string]interface{}
-	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+	if err := json.Unmarshal(body, &response); err != nil {
 		return nil, err
 	}
 
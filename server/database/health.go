@@ -0,0 +1,67 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"net/http"
+	"pgsync/server/config"
+	"strings"
+)
+
+const HealthOK = "ok"
+const HealthUnavailable = "unavailable"
+
+// HealthCheck is the outcome of checking one dependency.
+type HealthCheck struct {
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// CheckElasticsearch fails on a red cluster. A yellow cluster, usual for
+// single-node setups, is reported but still counts as healthy.
+func CheckElasticsearch(ctx context.Context) HealthCheck {
+	_, err := ConnectEsClient()
+	if err != nil {
+		return HealthCheck{Status: HealthUnavailable, Detail: err.Error()}
+	}
+	response, err := esapi.ClusterHealthRequest{}.Do(ctx, esClient)
+	if err != nil {
+		return HealthCheck{Status: HealthUnavailable, Detail: err.Error()}
+	}
+	defer response.Body.Close()
+
+	var health struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&health); err != nil {
+		return HealthCheck{Status: HealthUnavailable, Detail: err.Error()}
+	}
+	if health.Status == "red" {
+		return HealthCheck{Status: HealthUnavailable, Detail: "cluster status red"}
+	}
+	return HealthCheck{Status: HealthOK, Detail: "cluster status " + health.Status}
+}
+
+// CheckIndexes fails when any index the API searches is missing.
+func CheckIndexes(ctx context.Context) HealthCheck {
+	_, err := ConnectEsClient()
+	if err != nil {
+		return HealthCheck{Status: HealthUnavailable, Detail: err.Error()}
+	}
+	var missing []string
+	for _, index := range []string{config.ProjectIndex, config.UserIndex, config.HashtagIndex} {
+		response, err := esapi.IndicesExistsRequest{Index: []string{index}}.Do(ctx, esClient)
+		if err != nil {
+			return HealthCheck{Status: HealthUnavailable, Detail: err.Error()}
+		}
+		response.Body.Close()
+		if response.StatusCode == http.StatusNotFound {
+			missing = append(missing, index)
+		}
+	}
+	if len(missing) > 0 {
+		return HealthCheck{Status: HealthUnavailable, Detail: "missing " + strings.Join(missing, ", ")}
+	}
+	return HealthCheck{Status: HealthOK}
+}
@@ -0,0 +1,36 @@
+package database
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"time"
+)
+
+var queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "pgsync_api_elasticsearch_query_duration_seconds",
+	Help:    "Latency of Elasticsearch queries made by the API, by query.",
+	Buckets: prometheus.DefBuckets,
+}, []string{"query"})
+
+var shadowDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "pgsync_api_shadow_query_duration_seconds",
+	Help:    "Latency of searches repeated on shadow indexes, by query.",
+	Buckets: prometheus.DefBuckets,
+}, []string{"query"})
+
+var shadowOverlap = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "pgsync_api_shadow_hit_overlap",
+	Help:    "Share of the hits of a search returned by both its index and the shadow, by query.",
+	Buckets: prometheus.LinearBuckets(0, 0.1, 11),
+}, []string{"query"})
+
+var shadowErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "pgsync_api_shadow_errors_total",
+	Help: "Searches repeated on shadow indexes that failed, by query.",
+}, []string{"query"})
+
+// observeQuery records the time since start against query. Call it with
+// defer at the top of each query function.
+func observeQuery(query string, start time.Time) {
+	queryDuration.WithLabelValues(query).Observe(time.Since(start).Seconds())
+}
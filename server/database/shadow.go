@@ -0,0 +1,83 @@
+package database
+
+import (
+	"encoding/json"
+	"log"
+	"pgsync/server/config"
+	"time"
+)
+
+// compareShadowSearch repeats a search on the shadow of index and records how
+// its hits overlap with the primary's and how long it took in comparison.
+// Overlap is the share of the hits returned by either index that both
+// returned, from 0 to 1.
+func compareShadowSearch(query, index string, searchJSON, primaryBody []byte, primaryLatency time.Duration) {
+	start := time.Now()
+	shadowBody, err := searchIndex(index+config.ShadowIndexSuffix, searchJSON)
+	shadowLatency := time.Since(start)
+	if err != nil {
+		shadowErrors.WithLabelValues(query).Inc()
+		log.Printf("shadow_read_error query=%s index=%s: %v", query, index, err)
+		return
+	}
+	shadowDuration.WithLabelValues(query).Observe(shadowLatency.Seconds())
+
+	primaryIDs, err := hitIDs(primaryBody)
+	if err != nil {
+		log.Printf("shadow_read_error query=%s index=%s: decoding primary hits: %v", query, index, err)
+		return
+	}
+	shadowIDs, err := hitIDs(shadowBody)
+	if err != nil {
+		shadowErrors.WithLabelValues(query).Inc()
+		log.Printf("shadow_read_error query=%s index=%s: decoding shadow hits: %v", query, index, err)
+		return
+	}
+
+	overlap := hitOverlap(primaryIDs, shadowIDs)
+	shadowOverlap.WithLabelValues(query).Observe(overlap)
+	log.Printf("shadow_read query=%s index=%s overlap=%.2f primary_hits=%d shadow_hits=%d primary_latency=%v shadow_latency=%v",
+		query, index, overlap, len(primaryIDs), len(shadowIDs), primaryLatency, shadowLatency)
+}
+
+// hitIDs returns the document ids of the hits in a search response, in order.
+func hitIDs(body []byte) ([]string, error) {
+	var response struct {
+		Hits struct {
+			Hits []struct {
+				ID string `json:"_id"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(response.Hits.Hits))
+	for i, hit := range response.Hits.Hits {
+		ids[i] = hit.ID
+	}
+	return ids, nil
+}
+
+// hitOverlap is the number of ids in both lists over the number in either.
+// Two empty results overlap fully.
+func hitOverlap(primary, shadow []string) float64 {
+	seen := make(map[string]bool, len(primary))
+	for _, id := range primary {
+		seen[id] = true
+	}
+	union := len(seen)
+	common := 0
+	for _, id := range shadow {
+		if seen[id] {
+			common++
+			delete(seen, id)
+		} else {
+			union++
+		}
+	}
+	if union == 0 {
+		return 1
+	}
+	return float64(common) / float64(union)
+}